@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/go-chi/chi/v5"
+)
+
+// apiPageSize is the number of posts or messages in a page of API results.
+const apiPageSize = 25
+
+// apiRoutes registers the read-only JSON API, which serves the same data as
+// the HTML pages.
+func (s *server) apiRoutes(r chi.Router) {
+	getHead(r, "/guilds/{guildID:\\d+}", s.apiGetGuild)
+	getHead(r, "/forums/{forumID:\\d+}", s.apiGetForum)
+	getHead(r, "/posts/{postID:\\d+}/messages", s.apiGetMessages)
+	r.NotFound(func(w http.ResponseWriter, _ *http.Request) {
+		s.apiErr(w, http.StatusNotFound, nil)
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, _ *http.Request) {
+		s.apiErr(w, http.StatusMethodNotAllowed, nil)
+	})
+}
+
+func (s *server) writeJSON(w http.ResponseWriter, r *http.Request, v any) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		s.apiErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", fmt.Sprintf("\"%x\"", crc32.ChecksumIEEE(buf.Bytes())))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+}
+
+// apiErr is the API's counterpart to displayErr.
+func (s *server) apiErr(w http.ResponseWriter, status int, err error) {
+	msg := http.StatusText(status)
+	if err != nil {
+		msg = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{msg})
+}
+
+// apiChannel looks up the channel with the ID in the named URL parameter.
+func (s *server) apiChannel(w http.ResponseWriter, r *http.Request, param string) (*discord.Channel, bool) {
+	sf, err := discord.ParseSnowflake(chi.URLParam(r, param))
+	if err != nil {
+		s.apiErr(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+	ch, err := s.channel(discord.ChannelID(sf))
+	if err != nil {
+		if discordStatusIs(err, http.StatusNotFound) {
+			s.apiErr(w, http.StatusNotFound, nil)
+		} else {
+			s.apiErr(w, http.StatusInternalServerError,
+				fmt.Errorf("fetching channel: %w", err))
+		}
+		return nil, false
+	}
+	return ch, true
+}
+
+// apiForum checks that forum can be served and returns its guild.
+func (s *server) apiForum(w http.ResponseWriter, forum *discord.Channel) (*discord.Guild, bool) {
+	if forum.Type != discord.GuildForum {
+		s.apiErr(w, http.StatusNotFound, errors.New("channel is not a forum"))
+		return nil, false
+	}
+	if forum.NSFW {
+		s.apiErr(w, http.StatusForbidden, errors.New("NSFW content is not served"))
+		return nil, false
+	}
+	guild, err := s.discord.Cabinet.Guild(forum.GuildID)
+	if err != nil {
+		s.apiErr(w, http.StatusInternalServerError,
+			fmt.Errorf("fetching guild: %w", err))
+		return nil, false
+	}
+	return guild, true
+}
+
+// apiCursor parses the snowflake in the named query parameter, which is 0 if
+// it isn't set.
+func (s *server) apiCursor(w http.ResponseWriter, r *http.Request, param string) (discord.Snowflake, bool) {
+	str := r.URL.Query().Get(param)
+	if str == "" {
+		return 0, true
+	}
+	sf, err := discord.ParseSnowflake(str)
+	if err != nil {
+		s.apiErr(w, http.StatusBadRequest,
+			fmt.Errorf("invalid %s cursor: %w", param, err))
+		return 0, false
+	}
+	return sf, true
+}
+
+func (s *server) apiGetGuild(w http.ResponseWriter, r *http.Request) {
+	sf, err := discord.ParseSnowflake(chi.URLParam(r, "guildID"))
+	if err != nil {
+		s.apiErr(w, http.StatusBadRequest, err)
+		return
+	}
+	guild, err := s.discord.Cabinet.Guild(discord.GuildID(sf))
+	if err != nil {
+		if discordStatusIs(err, http.StatusNotFound) {
+			s.apiErr(w, http.StatusNotFound, nil)
+		} else {
+			s.apiErr(w, http.StatusInternalServerError,
+				fmt.Errorf("fetching guild: %w", err))
+		}
+		return
+	}
+	channels, err := s.channels(guild.ID)
+	if err != nil {
+		s.apiErr(w, http.StatusInternalServerError,
+			fmt.Errorf("fetching guild channels: %w", err))
+		return
+	}
+	forumchannels, err := s.forumChannels(guild, channels)
+	if err != nil {
+		s.apiErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	type apiForum struct {
+		ForumChannel
+		PostCount int `json:"post_count"`
+	}
+	forums := make([]apiForum, 0, len(forumchannels))
+	for _, forum := range forumchannels {
+		if forum.NSFW {
+			continue
+		}
+		forums = append(forums, apiForum{forum, len(forum.Posts)})
+	}
+	s.writeJSON(w, r, struct {
+		ID     discord.GuildID `json:"id"`
+		Name   string          `json:"name"`
+		Icon   string          `json:"icon,omitempty"`
+		Forums []apiForum      `json:"forums"`
+	}{guild.ID, guild.Name, guild.IconURL(), forums})
+}
+
+// apiGetForum lists the posts of a forum in the same order as the forum page.
+// The after parameter is the ID of the last post of the previous page.
+func (s *server) apiGetForum(w http.ResponseWriter, r *http.Request) {
+	forum, ok := s.apiChannel(w, r, "forumID")
+	if !ok {
+		return
+	}
+	if _, ok := s.apiForum(w, forum); !ok {
+		return
+	}
+	after, ok := s.apiCursor(w, r, "after")
+	if !ok {
+		return
+	}
+	channels, err := s.channels(forum.GuildID)
+	if err != nil {
+		s.apiErr(w, http.StatusInternalServerError,
+			fmt.Errorf("fetching guild threads: %w", err))
+		return
+	}
+	posts := forumPosts(forum, channels, tagFilter{})
+	if after.IsValid() {
+		start := -1
+		for i, post := range posts {
+			if discord.Snowflake(post.ID) == after {
+				start = i + 1
+				break
+			}
+		}
+		if start == -1 {
+			s.apiErr(w, http.StatusBadRequest,
+				fmt.Errorf("forum has no post with ID %s", after))
+			return
+		}
+		posts = posts[start:]
+	}
+	var next discord.ChannelID
+	if len(posts) > apiPageSize {
+		posts = posts[:apiPageSize]
+		next = posts[len(posts)-1].ID
+	}
+	if posts == nil {
+		posts = []Post{}
+	}
+	s.writeJSON(w, r, struct {
+		Forum *discord.Channel  `json:"forum"`
+		Posts []Post            `json:"posts"`
+		Next  discord.ChannelID `json:"next,omitempty"`
+	}{forum, posts, next})
+}
+
+// apiGetMessages returns a page of the messages in a post, grouped by author
+// like on the post page. Pages are selected with the before and after
+// parameters, using the prev and next cursors of the response.
+func (s *server) apiGetMessages(w http.ResponseWriter, r *http.Request) {
+	post, ok := s.apiChannel(w, r, "postID")
+	if !ok {
+		return
+	}
+	if post.Type != discord.GuildPublicThread {
+		s.apiErr(w, http.StatusNotFound, errors.New("channel is not a post"))
+		return
+	}
+	forum, err := s.channel(post.ParentID)
+	if err != nil {
+		s.apiErr(w, http.StatusInternalServerError,
+			fmt.Errorf("fetching forum: %w", err))
+		return
+	}
+	guild, ok := s.apiForum(w, forum)
+	if !ok {
+		return
+	}
+	before, ok := s.apiCursor(w, r, "before")
+	if !ok {
+		return
+	}
+	after, ok := s.apiCursor(w, r, "after")
+	if !ok {
+		return
+	}
+	var msgs []discord.Message
+	var hasbefore, hasafter bool
+	if before.IsValid() {
+		msgs, hasbefore, hasafter, err = s.messageCache.MessagesBefore(r.Context(), post.ID, discord.MessageID(before), apiPageSize)
+	} else {
+		msgs, hasbefore, hasafter, err = s.messageCache.MessagesAfter(r.Context(), post.ID, discord.MessageID(after), apiPageSize)
+	}
+	if err != nil {
+		s.apiErr(w, http.StatusInternalServerError,
+			fmt.Errorf("fetching post's messages: %w", err))
+		return
+	}
+	if err := s.ensureMembers(r.Context(), *post, msgs); err != nil {
+		s.apiErr(w, http.StatusInternalServerError,
+			fmt.Errorf("fetching post's members: %w", err))
+		return
+	}
+	consentRole, err := s.consentRole(forum)
+	if err != nil {
+		s.apiErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	msgrps, err := s.messageGroups(r.Context(), guild.ID, msgs, consentRole)
+	if err != nil {
+		s.apiErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	if msgrps == nil {
+		msgrps = []MessageGroup{}
+	}
+	resp := struct {
+		Post          Post              `json:"post"`
+		MessageGroups []MessageGroup    `json:"message_groups"`
+		Prev          discord.MessageID `json:"prev,omitempty"`
+		Next          discord.MessageID `json:"next,omitempty"`
+	}{Post: newPost(forum, *post), MessageGroups: msgrps}
+	if hasbefore && len(msgs) > 0 {
+		resp.Prev = msgs[0].ID
+	}
+	if hasafter && len(msgs) > 0 {
+		resp.Next = msgs[len(msgs)-1].ID
+	}
+	s.writeJSON(w, r, resp)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+)
+
+// subcommand is a command the dforum binary can run, like "dforum serve".
+type subcommand struct {
+	name string
+	help string
+	// flags registers the subcommand's flags, and returns the function that
+	// runs it once they have been parsed and the config has been loaded.
+	flags func(fs *flag.FlagSet) func(ctx context.Context, config config) error
+}
+
+var subcommands = []subcommand{
+	{
+		name: "serve",
+		help: "Connect to Discord and serve the site. This is the default.",
+		flags: func(*flag.FlagSet) func(context.Context, config) error {
+			return serve
+		},
+	},
+	{
+		name:  "migrate",
+		help:  "Bring the database schema up to date and print its version.",
+		flags: migrateFlags,
+	},
+	{
+		name:  "backfill",
+		help:  "Store the messages of every post in the database, then exit.",
+		flags: backfillFlags,
+	},
+	{
+		name:  "sitemap",
+		help:  "Write the sitemap to SitemapDir once, then exit.",
+		flags: sitemapFlags,
+	},
+	{
+		name: "purge",
+		help: "Delete everything stored about a guild from the database.\n" +
+			"If the bot is still in the guild, it is stored again on the next start.",
+		flags: purgeFlags,
+	},
+	{
+		name: "export",
+		help: "Write the stored forums and posts to a directory as a static site.\n" +
+			"Only what is stored in the database is used, Discord isn't contacted.\n" +
+			"Media in the media cache is copied along, other media is linked to on\n" +
+			"the live site.",
+		flags: exportFlags,
+	},
+	{
+		name:  "check-config",
+		help:  "Check the config file for mistakes, without connecting to anything.",
+		flags: checkConfigFlags,
+	},
+}
+
+func findSubcommand(name string) *subcommand {
+	for i := range subcommands {
+		if subcommands[i].name == name {
+			return &subcommands[i]
+		}
+	}
+	return nil
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: dforum [-config path] [command] [flags]\n\ncommands:\n")
+	for _, cmd := range subcommands {
+		help, _, _ := strings.Cut(cmd.help, "\n")
+		fmt.Fprintf(out, "  %-14s %s\n", cmd.name, help)
+	}
+	fmt.Fprintf(out, "\nRun \"dforum [command] -h\" for the flags of a command.\n\nflags:\n")
+	flag.PrintDefaults()
+}
+
+// guildFlag registers the -guild flag on fs.
+func guildFlag(fs *flag.FlagSet, usage string) *discord.GuildID {
+	var id discord.GuildID
+	fs.Func("guild", usage, func(s string) error {
+		sf, err := discord.ParseSnowflake(s)
+		if err != nil || !sf.IsValid() {
+			return fmt.Errorf("invalid guild ID %q", s)
+		}
+		id = discord.GuildID(sf)
+		return nil
+	})
+	return &id
+}
+
+func migrateFlags(*flag.FlagSet) func(context.Context, config) error {
+	return func(ctx context.Context, config config) error {
+		db, err := openDatabase(config)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		if config.Database == "memory://" {
+			fmt.Println("The memory database has no schema to migrate.")
+			return nil
+		}
+		version, err := db.SchemaVersion(ctx)
+		if err != nil {
+			return fmt.Errorf("Error reading schema version: %w", err)
+		}
+		fmt.Println("Database schema is at version", version)
+		return nil
+	}
+}
+
+func backfillFlags(fs *flag.FlagSet) func(context.Context, config) error {
+	guildID := guildFlag(fs, "only store the posts of this guild")
+	workers := fs.Int("workers", 0, "posts to load at once (default CrawlWorkers)")
+	rate := fs.Float64("rate", 0, "requests to Discord per second (default CrawlRequestsPerSecond)")
+	return func(ctx context.Context, config config) error {
+		if *workers > 0 {
+			config.CrawlWorkers = *workers
+		}
+		if *rate > 0 {
+			config.CrawlRequestsPerSecond = *rate
+		}
+		if config.CrawlWorkers <= 0 || config.CrawlRequestsPerSecond <= 0 {
+			return errors.New("backfill needs a positive number of workers and requests per second")
+		}
+		server, err := setup(config)
+		if err != nil {
+			return err
+		}
+		defer server.db.Close()
+		if err := server.connect(ctx); err != nil {
+			return err
+		}
+		defer server.discord.Close()
+		wait, stop := server.crawlLimiter(ctx)
+		defer stop()
+		server.crawlPass(ctx, wait, *guildID)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if p := server.crawlProgress(); p.Errors > 0 {
+			return fmt.Errorf("%d of %d posts could not be loaded", p.Errors, p.Posts)
+		}
+		return nil
+	}
+}
+
+func sitemapFlags(*flag.FlagSet) func(context.Context, config) error {
+	return func(ctx context.Context, config config) error {
+		server, err := setup(config)
+		if err != nil {
+			return err
+		}
+		defer server.db.Close()
+		if err := server.connect(ctx); err != nil {
+			return err
+		}
+		defer server.discord.Close()
+		if err := server.writeSitemap(); err != nil {
+			return fmt.Errorf("Error writing sitemap: %w", err)
+		}
+		return nil
+	}
+}
+
+func purgeFlags(fs *flag.FlagSet) func(context.Context, config) error {
+	guildID := guildFlag(fs, "the guild to delete (required)")
+	return func(ctx context.Context, config config) error {
+		if !guildID.IsValid() {
+			return errors.New("purge needs -guild")
+		}
+		db, err := openDatabase(config)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		if err := db.DeleteGuild(ctx, *guildID); err != nil {
+			return fmt.Errorf("Error deleting guild %s: %w", *guildID, err)
+		}
+		fmt.Println("Deleted guild", *guildID)
+		return nil
+	}
+}
+
+func exportFlags(fs *flag.FlagSet) func(context.Context, config) error {
+	dir := fs.String("dir", "", "directory to write the site to (required)")
+	guildID := guildFlag(fs, "only export this guild")
+	siteURL := fs.String("url", "", "URL the site is going to be served at (default SiteURL)")
+	return func(ctx context.Context, config config) error {
+		if *dir == "" {
+			return errors.New("export needs -dir")
+		}
+		baseURL := strings.TrimSuffix(config.SiteURL, "/")
+		if *siteURL != "" {
+			baseURL = strings.TrimSuffix(*siteURL, "/")
+		}
+		server, err := setup(config)
+		if err != nil {
+			return err
+		}
+		defer server.db.Close()
+		if err := server.loadStored(config.BotToken); err != nil {
+			return err
+		}
+		pages, err := server.exportSite(ctx, *dir, baseURL, *guildID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Exported %d pages to %s\n", pages, *dir)
+		return nil
+	}
+}
+
+func checkConfigFlags(*flag.FlagSet) func(context.Context, config) error {
+	return func(_ context.Context, config config) error {
+		problems := checkConfig(config)
+		if len(problems) == 0 {
+			fmt.Println("Config is OK")
+			return nil
+		}
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		return fmt.Errorf("Config has %d problems", len(problems))
+	}
+}
+
+// checkConfig returns the mistakes in config that it can find without
+// connecting to anything.
+func checkConfig(config config) []string {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	if config.BotToken == "" {
+		add("Config option 'BotToken' is not set")
+	}
+	if _, err := databaseOpener(config); err != nil {
+		add("%v", err)
+	}
+	if u, err := url.Parse(config.SiteURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		add("Config option 'SiteURL' is not an http:// or https:// URL: %q", config.SiteURL)
+	}
+	if _, _, err := net.SplitHostPort(config.ListenAddr); err != nil {
+		add("Config option 'ListenAddr' is not a valid address: %v", err)
+	}
+	if config.SitemapDir == "" {
+		add("Config option 'SitemapDir' is not set")
+	} else if stat, err := os.Stat(config.SitemapDir); err != nil && !errors.Is(err, os.ErrNotExist) {
+		add("Config option 'SitemapDir': %v", err)
+	} else if err == nil && !stat.IsDir() {
+		add("Config option 'SitemapDir' is not a directory: %q", config.SitemapDir)
+	}
+	resourcesOK := true
+	if config.Resources != "" {
+		if stat, err := os.Stat(config.Resources); err != nil {
+			add("Config option 'Resources': %v", err)
+			resourcesOK = false
+		} else if !stat.IsDir() {
+			add("Config option 'Resources' is not a directory: %q", config.Resources)
+			resourcesOK = false
+		}
+	}
+	if resourcesOK {
+		if _, _, err := loadResources(config); err != nil {
+			add("%v", err)
+		}
+	}
+	if config.CrawlWorkers < 0 {
+		add("Config option 'CrawlWorkers' is negative: %d", config.CrawlWorkers)
+	}
+	if config.CrawlRequestsPerSecond < 0 {
+		add("Config option 'CrawlRequestsPerSecond' is negative: %g", config.CrawlRequestsPerSecond)
+	}
+	if config.IndexNowKey != "" {
+		if _, err := newIndexNow(config.IndexNowEndpoint, config.IndexNowKey, config.SiteURL); err != nil {
+			add("Config option 'IndexNowKey' or 'IndexNowEndpoint': %v", err)
+		}
+	}
+	if config.MediaCacheDir != "" {
+		if stat, err := os.Stat(config.MediaCacheDir); err != nil && !errors.Is(err, os.ErrNotExist) {
+			add("Config option 'MediaCacheDir': %v", err)
+		} else if err == nil && !stat.IsDir() {
+			add("Config option 'MediaCacheDir' is not a directory: %q", config.MediaCacheDir)
+		}
+		if config.MediaCacheSize <= 0 {
+			add("Config option 'MediaCacheSize' is not positive: %d", config.MediaCacheSize)
+		}
+	}
+	return problems
+}
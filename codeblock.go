@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"io"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/util"
+)
+
+// codeFormatter writes highlighted code with classes rather than inline
+// styles, so that it can be restyled through static/code.css.
+var codeFormatter = chromahtml.New(chromahtml.WithClasses(true))
+
+// codeBlockRenderer renders fenced code blocks, highlighted for the language
+// they are tagged with, along with a button to copy them that static/code.js
+// brings to life.
+type codeBlockRenderer struct{}
+
+func (r codeBlockRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindFencedCodeBlock, r.render)
+}
+
+func (r codeBlockRenderer) render(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	block := n.(*ast.FencedCodeBlock)
+	var code bytes.Buffer
+	lines := block.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		line := lines.At(i)
+		code.Write(line.Value(source))
+	}
+	lang := string(block.Language(source))
+
+	w.WriteString("<div class='codeblock'>")
+	w.WriteString("<button type='button' class='copy-code' hidden>Copy</button>")
+	// highlighted into a buffer first, so that nothing of it is written if
+	// highlighting fails partway through
+	var highlighted bytes.Buffer
+	if err := highlightCode(&highlighted, lang, code.String()); err == nil {
+		w.Write(highlighted.Bytes())
+	} else {
+		w.WriteString("<pre><code>")
+		w.WriteString(html.EscapeString(code.String()))
+		w.WriteString("</code></pre>")
+	}
+	w.WriteString("</div>\n")
+	return ast.WalkSkipChildren, nil
+}
+
+// highlightCode writes code highlighted as lang, or as plain text if lang is
+// unknown. Like Discord, the language isn't guessed.
+func highlightCode(w io.Writer, lang, code string) error {
+	lexer := lexers.Fallback
+	if lang != "" {
+		if l := lexers.Get(lang); l != nil {
+			lexer = l
+		}
+	}
+	it, err := chroma.Coalesce(lexer).Tokenise(nil, code)
+	if err != nil {
+		return err
+	}
+	// the style is ignored as classes are used
+	return codeFormatter.Format(w, styles.Fallback, it)
+}
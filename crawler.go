@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+)
+
+// crawlInterval is how long the crawler waits between passes over all forums.
+const crawlInterval = time.Hour
+
+// crawlProgress describes how far the current or last pass of the crawler
+// has got.
+type crawlProgress struct {
+	Running      bool       `json:"running"`
+	PassStarted  *time.Time `json:"pass_started,omitempty"`
+	PassFinished *time.Time `json:"pass_finished,omitempty"`
+	// Posts is the number of posts in the pass, and PostsDone how many of
+	// them have been checked so far. PostsLoaded is how many of those had
+	// to be fetched from Discord.
+	Posts       int `json:"posts"`
+	PostsDone   int `json:"posts_done"`
+	PostsLoaded int `json:"posts_loaded"`
+	Errors      int `json:"errors"`
+}
+
+// Crawl stores the messages of every post in the database ahead of time, so
+// that visitors don't have to wait for them to be fetched from Discord. It
+// makes a pass over all forums every crawlInterval until ctx is done. Posts
+// that are stored and up to date are skipped, so each pass, including the
+// first one after a restart, picks up where the last one left off.
+func (s *server) Crawl(ctx context.Context) {
+	wait, stop := s.crawlLimiter(ctx)
+	defer stop()
+	for {
+		s.crawlPass(ctx, wait, 0)
+		select {
+		case <-time.After(crawlInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// crawlLimiter returns a function that blocks until the crawler may make its
+// next request. It is shared by all workers, so that the crawler as a whole
+// stays within its budget of requests.
+func (s *server) crawlLimiter(ctx context.Context) (wait func() error, stop func()) {
+	limiter := time.NewTicker(time.Duration(float64(time.Second) / s.crawlRate))
+	return func() error {
+		select {
+		case <-limiter.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}, limiter.Stop
+}
+
+// crawlPass checks the posts of guildID, or of all guilds if it is 0.
+func (s *server) crawlPass(ctx context.Context, wait func() error, guildID discord.GuildID) {
+	posts := s.crawlPosts(guildID, wait)
+	started := time.Now()
+	s.crawlMu.Lock()
+	s.crawl = crawlProgress{Running: true, PassStarted: &started, Posts: len(posts)}
+	s.crawlMu.Unlock()
+	crawlerPosts.WithLabelValues("total").Set(float64(len(posts)))
+	crawlerPosts.WithLabelValues("done").Set(0)
+	log.Printf("Crawler: checking %d posts", len(posts))
+
+	queue := make(chan discord.ChannelID)
+	var wg sync.WaitGroup
+	for i := 0; i < s.crawlWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for post := range queue {
+				loaded, err := s.messageCache.Backfill(ctx, post, wait)
+				if ctx.Err() != nil {
+					return
+				}
+				s.crawlMu.Lock()
+				s.crawl.PostsDone++
+				if loaded {
+					s.crawl.PostsLoaded++
+				}
+				if err != nil {
+					s.crawl.Errors++
+					crawlerErrors.Inc()
+					log.Printf("Crawler: loading messages of %s: %v", post, err)
+				}
+				if s.crawl.PostsDone%100 == 0 {
+					log.Printf("Crawler: checked %d of %d posts", s.crawl.PostsDone, s.crawl.Posts)
+				}
+				s.crawlMu.Unlock()
+				crawlerPosts.WithLabelValues("done").Inc()
+			}
+		}()
+	}
+Queue:
+	for _, post := range posts {
+		select {
+		case queue <- post:
+		case <-ctx.Done():
+			break Queue
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	finished := time.Now()
+	s.crawlMu.Lock()
+	s.crawl.Running = false
+	s.crawl.PassFinished = &finished
+	p := s.crawl
+	s.crawlMu.Unlock()
+	log.Printf("Crawler: pass finished in %s, checked %d of %d posts, loaded %d, %d errors",
+		finished.Sub(started).Round(time.Second), p.PostsDone, p.Posts, p.PostsLoaded, p.Errors)
+}
+
+// crawlPosts returns the posts of every forum in guildID that dforum serves,
+// or in all guilds if guildID is 0. Archived posts that have to be fetched
+// from Discord are fetched within the crawler's budget, using wait.
+func (s *server) crawlPosts(guildID discord.GuildID, wait func() error) []discord.ChannelID {
+	guilds, err := s.discord.Cabinet.Guilds()
+	if err != nil {
+		log.Println("Crawler: listing guilds:", err)
+		return nil
+	}
+	var posts []discord.ChannelID
+	for i, guild := range guilds {
+		if guildID.IsValid() && guild.ID != guildID {
+			continue
+		}
+		channels, err := s.channelsLimited(guild.ID, wait)
+		if err != nil {
+			log.Printf("Crawler: fetching channels of %s: %v", guild.ID, err)
+			continue
+		}
+		forums, err := s.visibleForums(&guilds[i], channels)
+		if err != nil {
+			log.Printf("Crawler: fetching forums of %s: %v", guild.ID, err)
+			continue
+		}
+		for _, forum := range forums {
+			if forum.NSFW {
+				continue
+			}
+			for _, post := range forumThreads(forum.ID, channels) {
+				posts = append(posts, post.ID)
+			}
+		}
+	}
+	return posts
+}
+
+func (s *server) crawlProgress() crawlProgress {
+	s.crawlMu.Lock()
+	defer s.crawlMu.Unlock()
+	return s.crawl
+}
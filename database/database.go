@@ -2,13 +2,23 @@ package database
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/diamondburned/arikawa/v3/discord"
 )
 
 type Database interface {
 	Close() error
+	// Ping checks that the database can be reached.
+	Ping(ctx context.Context) error
+	// SchemaVersion returns the version of the database's schema, which is
+	// 0 for databases without one.
+	SchemaVersion(ctx context.Context) (int, error)
 
 	SetUpdatedAt(ctx context.Context, post discord.ChannelID, t time.Time) error
 	UpdatedAt(ctx context.Context, post discord.ChannelID) (time.Time, error)
@@ -16,6 +26,99 @@ type Database interface {
 	InsertMessage(ctx context.Context, msg discord.Message) error
 	UpdateMessage(ctx context.Context, msg discord.Message) error
 	DeleteMessage(ctx context.Context, msg discord.MessageID) error
+	// DeleteChannel deletes a post or forum channel along with its
+	// messages. Deleting a forum channel also deletes its posts.
+	DeleteChannel(ctx context.Context, post discord.ChannelID) error
 	MessagesAfter(ctx context.Context, post discord.ChannelID, after discord.MessageID, limit uint) ([]discord.Message, bool, error)
 	MessagesBefore(ctx context.Context, post discord.ChannelID, before discord.MessageID, limit uint) ([]discord.Message, bool, error)
+	// MessageIndex returns how many messages of post come before msg, and
+	// whether msg itself is stored.
+	MessageIndex(ctx context.Context, post discord.ChannelID, msg discord.MessageID) (uint, bool, error)
+	SearchMessages(ctx context.Context, query string, posts []discord.ChannelID, limit, offset uint) ([]SearchResult, error)
+
+	// SetOptOut records whether user has opted out of having their
+	// messages shown.
+	SetOptOut(ctx context.Context, user discord.UserID, optout bool) error
+	// OptedOut returns the users among users that have opted out.
+	OptedOut(ctx context.Context, users []discord.UserID) ([]discord.UserID, error)
+
+	// The methods below keep a snapshot of the guilds dforum is in, so that
+	// pages can be served after a restart without going through Discord.
+
+	// SetGuild stores guild, replacing what was stored about it before.
+	SetGuild(ctx context.Context, guild discord.Guild) error
+	Guilds(ctx context.Context) ([]discord.Guild, error)
+	// DeleteGuild deletes guild along with its roles, members, channels
+	// and their messages.
+	DeleteGuild(ctx context.Context, guild discord.GuildID) error
+	SetRole(ctx context.Context, guild discord.GuildID, role discord.Role) error
+	DeleteRole(ctx context.Context, guild discord.GuildID, role discord.RoleID) error
+	Roles(ctx context.Context, guild discord.GuildID) ([]discord.Role, error)
+	// SetChannel stores a forum channel or post. Other channels are
+	// ignored, as dforum doesn't serve them.
+	SetChannel(ctx context.Context, ch discord.Channel) error
+	// Channels returns the stored forum channels and posts of guild.
+	Channels(ctx context.Context, guild discord.GuildID) ([]discord.Channel, error)
+	// SetThreadsFetchedAt records when the archived posts of forum were
+	// last fetched. ThreadsFetchedAt returns the zero time if they never
+	// were.
+	SetThreadsFetchedAt(ctx context.Context, forum discord.ChannelID, t time.Time) error
+	ThreadsFetchedAt(ctx context.Context, forum discord.ChannelID) (time.Time, error)
+	SetMember(ctx context.Context, guild discord.GuildID, member discord.Member) error
+	DeleteMember(ctx context.Context, guild discord.GuildID, user discord.UserID) error
+	Members(ctx context.Context, guild discord.GuildID) ([]discord.Member, error)
+}
+
+// Highlighted terms in SearchResult.Snippet are wrapped in HighlightStart and
+// HighlightEnd. These control characters don't occur in ordinary message
+// content, so callers can escape the snippet and then turn them into markup.
+const (
+	HighlightStart = "\x02"
+	HighlightEnd   = "\x03"
+)
+
+// SearchResult is a message matching a full-text search, along with an
+// excerpt of its content showing the matching terms.
+type SearchResult struct {
+	Message discord.Message
+	Snippet string
+	Rank    float64
+}
+
+// searchTerms splits a search query into lowercase words, for backends that
+// don't parse queries themselves.
+func searchTerms(query string) []string {
+	return strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// storedChannel reports whether ch is a kind of channel that SetChannel
+// stores, and whether it is a forum rather than a post.
+func storedChannel(ch discord.Channel) (stored, forum bool) {
+	switch ch.Type {
+	case discord.GuildForum:
+		return true, true
+	case discord.GuildPublicThread, discord.GuildPrivateThread, discord.GuildAnnouncementThread:
+		return true, false
+	}
+	return false, false
+}
+
+// scanJSON unmarshals the only column of rows into a T per row.
+func scanJSON[T any](rows *sql.Rows) ([]T, error) {
+	defer rows.Close()
+	var values []T
+	for rows.Next() {
+		var jsonb []byte
+		if err := rows.Scan(&jsonb); err != nil {
+			return nil, err
+		}
+		var v T
+		if err := json.Unmarshal(jsonb, &v); err != nil {
+			return nil, fmt.Errorf("unmarshaling %T: %w", v, err)
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
 }
@@ -0,0 +1,706 @@
+// Package dbtest contains a conformance suite for database.Database
+// implementations. Every backend is expected to pass it:
+//
+//	func TestPostgres(t *testing.T) {
+//		dbtest.Run(t, func(t *testing.T) database.Database {
+//			db, err := database.OpenPostgres(os.Getenv("DFORUM_TEST_POSTGRES"))
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return db
+//		})
+//	}
+//
+// Each subtest receives a freshly opened database, and uses channel IDs
+// derived from the current time so that persistent backends can be shared
+// between runs.
+package dbtest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IoIxD/dforum/database"
+	"github.com/diamondburned/arikawa/v3/discord"
+)
+
+// Run runs the conformance suite against the databases returned by open.
+func Run(t *testing.T, open func(t *testing.T) database.Database) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, db database.Database, ch discord.ChannelID)
+	}{
+		{"Empty", testEmpty},
+		{"UpdateMessages", testUpdateMessages},
+		{"UpdateMessagesReconciles", testUpdateMessagesReconciles},
+		{"UpdatedAt", testUpdatedAt},
+		{"MessagesAfter", testMessagesAfter},
+		{"MessagesBefore", testMessagesBefore},
+		{"MessageIndex", testMessageIndex},
+		{"InsertMessage", testInsertMessage},
+		{"UpdateMessage", testUpdateMessage},
+		{"DeleteMessage", testDeleteMessage},
+		{"DeleteChannel", testDeleteChannel},
+		{"SearchMessages", testSearchMessages},
+		{"OptOut", testOptOut},
+		{"Guilds", testGuilds},
+		{"Channels", testChannels},
+		{"Concurrent", testConcurrent},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			db := open(t)
+			t.Cleanup(func() {
+				if err := db.Close(); err != nil {
+					t.Errorf("closing database: %v", err)
+				}
+			})
+			test.fn(t, db, newChannelID())
+		})
+	}
+}
+
+var (
+	lastIDMu sync.Mutex
+	lastID   discord.Snowflake
+)
+
+// newSnowflake returns a snowflake that is unique for this process and
+// larger than any snowflake used by a previous run.
+func newSnowflake() discord.Snowflake {
+	lastIDMu.Lock()
+	defer lastIDMu.Unlock()
+	id := discord.NewSnowflake(time.Now())
+	if id <= lastID {
+		id = lastID + 1
+	}
+	lastID = id
+	return id
+}
+
+func newChannelID() discord.ChannelID {
+	return discord.ChannelID(newSnowflake())
+}
+
+// newMessages returns n messages in ch, in ascending order.
+func newMessages(ch discord.ChannelID, n int) []discord.Message {
+	msgs := make([]discord.Message, n)
+	for i := range msgs {
+		msgs[i] = discord.Message{
+			ID:        discord.MessageID(newSnowflake()),
+			ChannelID: ch,
+			Author:    discord.User{ID: discord.UserID(i + 1), Username: fmt.Sprintf("user%d", i)},
+			Content:   fmt.Sprintf("message %d", i),
+		}
+	}
+	return msgs
+}
+
+func expectMessages(t *testing.T, got, want []discord.Message) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d messages, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i].ID != want[i].ID {
+			t.Errorf("message %d: got ID %v, want %v", i, got[i].ID, want[i].ID)
+		}
+		if got[i].Content != want[i].Content {
+			t.Errorf("message %d: got content %q, want %q", i, got[i].Content, want[i].Content)
+		}
+		if got[i].Author.ID != want[i].Author.ID {
+			t.Errorf("message %d: got author %v, want %v", i, got[i].Author.ID, want[i].Author.ID)
+		}
+	}
+}
+
+func allMessages(t *testing.T, db database.Database, ch discord.ChannelID) []discord.Message {
+	t.Helper()
+	msgs, _, err := db.MessagesAfter(context.Background(), ch, 0, 1000)
+	if err != nil {
+		t.Fatalf("MessagesAfter: %v", err)
+	}
+	return msgs
+}
+
+func testEmpty(t *testing.T, db database.Database, ch discord.ChannelID) {
+	ctx := context.Background()
+	if _, err := db.SchemaVersion(ctx); err != nil {
+		t.Fatalf("SchemaVersion: %v", err)
+	}
+	upd, err := db.UpdatedAt(ctx, ch)
+	if err != nil {
+		t.Fatalf("UpdatedAt: %v", err)
+	}
+	if !upd.IsZero() {
+		t.Errorf("UpdatedAt of unknown channel is %v, want zero", upd)
+	}
+	msgs, hasbefore, err := db.MessagesAfter(ctx, ch, 0, 25)
+	if err != nil {
+		t.Fatalf("MessagesAfter: %v", err)
+	}
+	if len(msgs) != 0 || hasbefore {
+		t.Errorf("MessagesAfter of unknown channel returned %d messages, hasbefore=%v", len(msgs), hasbefore)
+	}
+	msgs, hasafter, err := db.MessagesBefore(ctx, ch, discord.MessageID(newSnowflake()), 25)
+	if err != nil {
+		t.Fatalf("MessagesBefore: %v", err)
+	}
+	if len(msgs) != 0 || hasafter {
+		t.Errorf("MessagesBefore of unknown channel returned %d messages, hasafter=%v", len(msgs), hasafter)
+	}
+}
+
+func testUpdateMessages(t *testing.T, db database.Database, ch discord.ChannelID) {
+	msgs := newMessages(ch, 5)
+	if err := db.UpdateMessages(context.Background(), ch, msgs); err != nil {
+		t.Fatalf("UpdateMessages: %v", err)
+	}
+	expectMessages(t, allMessages(t, db, ch), msgs)
+}
+
+func testUpdateMessagesReconciles(t *testing.T, db database.Database, ch discord.ChannelID) {
+	ctx := context.Background()
+	msgs := newMessages(ch, 5)
+	if err := db.UpdateMessages(ctx, ch, msgs); err != nil {
+		t.Fatalf("UpdateMessages: %v", err)
+	}
+	edited := make([]discord.Message, 0, len(msgs))
+	for i, msg := range msgs {
+		if i == 1 || i == 3 {
+			// deleted while we weren't looking
+			continue
+		}
+		if i == 2 {
+			msg.Content = "edited"
+			msg.EditedTimestamp = discord.NewTimestamp(time.Now())
+		}
+		edited = append(edited, msg)
+	}
+	extra := newMessages(ch, 1)
+	edited = append(edited, extra...)
+	if err := db.UpdateMessages(ctx, ch, edited); err != nil {
+		t.Fatalf("UpdateMessages: %v", err)
+	}
+	expectMessages(t, allMessages(t, db, ch), edited)
+}
+
+func testUpdatedAt(t *testing.T, db database.Database, ch discord.ChannelID) {
+	ctx := context.Background()
+	before := time.Now().Add(-time.Second)
+	if err := db.UpdateMessages(ctx, ch, newMessages(ch, 1)); err != nil {
+		t.Fatalf("UpdateMessages: %v", err)
+	}
+	upd, err := db.UpdatedAt(ctx, ch)
+	if err != nil {
+		t.Fatalf("UpdatedAt: %v", err)
+	}
+	if upd.Before(before) {
+		t.Errorf("UpdatedAt after UpdateMessages is %v, want after %v", upd, before)
+	}
+	want := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := db.SetUpdatedAt(ctx, ch, want); err != nil {
+		t.Fatalf("SetUpdatedAt: %v", err)
+	}
+	upd, err = db.UpdatedAt(ctx, ch)
+	if err != nil {
+		t.Fatalf("UpdatedAt: %v", err)
+	}
+	if !upd.Equal(want) {
+		t.Errorf("UpdatedAt after SetUpdatedAt is %v, want %v", upd, want)
+	}
+}
+
+func testMessagesAfter(t *testing.T, db database.Database, ch discord.ChannelID) {
+	ctx := context.Background()
+	msgs := newMessages(ch, 5)
+	if err := db.UpdateMessages(ctx, ch, msgs); err != nil {
+		t.Fatalf("UpdateMessages: %v", err)
+	}
+	tests := []struct {
+		after     discord.MessageID
+		limit     uint
+		want      []discord.Message
+		hasbefore bool
+	}{
+		{0, 2, msgs[:2], false},
+		{0, 10, msgs, false},
+		{msgs[0].ID, 2, msgs[1:3], true},
+		{msgs[2].ID - 1, 2, msgs[2:4], true},
+		{msgs[4].ID, 2, nil, true},
+	}
+	for i, test := range tests {
+		got, hasbefore, err := db.MessagesAfter(ctx, ch, test.after, test.limit)
+		if err != nil {
+			t.Fatalf("%d: MessagesAfter: %v", i, err)
+		}
+		if hasbefore != test.hasbefore {
+			t.Errorf("%d: got hasbefore=%v, want %v", i, hasbefore, test.hasbefore)
+		}
+		expectMessages(t, got, test.want)
+	}
+}
+
+func testMessagesBefore(t *testing.T, db database.Database, ch discord.ChannelID) {
+	ctx := context.Background()
+	msgs := newMessages(ch, 5)
+	if err := db.UpdateMessages(ctx, ch, msgs); err != nil {
+		t.Fatalf("UpdateMessages: %v", err)
+	}
+	end := msgs[4].ID + 1
+	tests := []struct {
+		before   discord.MessageID
+		limit    uint
+		want     []discord.Message
+		hasafter bool
+	}{
+		{end, 2, msgs[3:], false},
+		{end, 10, msgs, false},
+		{msgs[4].ID, 2, msgs[2:4], true},
+		{msgs[2].ID + 1, 2, msgs[1:3], true},
+		{msgs[0].ID, 2, nil, true},
+	}
+	for i, test := range tests {
+		got, hasafter, err := db.MessagesBefore(ctx, ch, test.before, test.limit)
+		if err != nil {
+			t.Fatalf("%d: MessagesBefore: %v", i, err)
+		}
+		if hasafter != test.hasafter {
+			t.Errorf("%d: got hasafter=%v, want %v", i, hasafter, test.hasafter)
+		}
+		expectMessages(t, got, test.want)
+	}
+}
+
+func testMessageIndex(t *testing.T, db database.Database, ch discord.ChannelID) {
+	ctx := context.Background()
+	msgs := newMessages(ch, 5)
+	// msgs[3] is left out
+	stored := append(append([]discord.Message(nil), msgs[:3]...), msgs[4])
+	if err := db.UpdateMessages(ctx, ch, stored); err != nil {
+		t.Fatalf("UpdateMessages: %v", err)
+	}
+	tests := []struct {
+		msg   discord.MessageID
+		index uint
+		found bool
+	}{
+		{msgs[0].ID, 0, true},
+		{msgs[2].ID, 2, true},
+		{msgs[3].ID, 3, false},
+		{msgs[4].ID, 3, true},
+		{msgs[0].ID - 1, 0, false},
+		{msgs[4].ID + 1, 4, false},
+	}
+	for i, test := range tests {
+		index, found, err := db.MessageIndex(ctx, ch, test.msg)
+		if err != nil {
+			t.Fatalf("%d: MessageIndex: %v", i, err)
+		}
+		if index != test.index || found != test.found {
+			t.Errorf("%d: got (%d, %v), want (%d, %v)", i, index, found, test.index, test.found)
+		}
+	}
+	if _, found, err := db.MessageIndex(ctx, newChannelID(), msgs[0].ID); err != nil || found {
+		t.Errorf("MessageIndex in another channel: got found=%v, err=%v", found, err)
+	}
+}
+
+func testInsertMessage(t *testing.T, db database.Database, ch discord.ChannelID) {
+	ctx := context.Background()
+	msgs := newMessages(ch, 3)
+	if err := db.UpdateMessages(ctx, ch, msgs[:2]); err != nil {
+		t.Fatalf("UpdateMessages: %v", err)
+	}
+	if err := db.InsertMessage(ctx, msgs[2]); err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	dup := msgs[2]
+	dup.Content = "duplicate"
+	if err := db.InsertMessage(ctx, dup); err != nil {
+		t.Fatalf("InsertMessage of existing message: %v", err)
+	}
+	expectMessages(t, allMessages(t, db, ch), msgs)
+}
+
+func testUpdateMessage(t *testing.T, db database.Database, ch discord.ChannelID) {
+	ctx := context.Background()
+	msgs := newMessages(ch, 2)
+	if err := db.UpdateMessages(ctx, ch, msgs); err != nil {
+		t.Fatalf("UpdateMessages: %v", err)
+	}
+	now := time.Now()
+	edit := msgs[1]
+	edit.Content = "edited"
+	edit.EditedTimestamp = discord.NewTimestamp(now)
+	if err := db.UpdateMessage(ctx, edit); err != nil {
+		t.Fatalf("UpdateMessage: %v", err)
+	}
+	stale := msgs[1]
+	stale.Content = "stale"
+	stale.EditedTimestamp = discord.NewTimestamp(now.Add(-time.Hour))
+	if err := db.UpdateMessage(ctx, stale); err != nil {
+		t.Fatalf("UpdateMessage with stale edit: %v", err)
+	}
+	missing := newMessages(ch, 1)[0]
+	if err := db.UpdateMessage(ctx, missing); err != nil {
+		t.Fatalf("UpdateMessage of missing message: %v", err)
+	}
+	expectMessages(t, allMessages(t, db, ch), []discord.Message{msgs[0], edit})
+}
+
+func testDeleteMessage(t *testing.T, db database.Database, ch discord.ChannelID) {
+	ctx := context.Background()
+	msgs := newMessages(ch, 3)
+	if err := db.UpdateMessages(ctx, ch, msgs); err != nil {
+		t.Fatalf("UpdateMessages: %v", err)
+	}
+	if err := db.DeleteMessage(ctx, msgs[1].ID); err != nil {
+		t.Fatalf("DeleteMessage: %v", err)
+	}
+	if err := db.DeleteMessage(ctx, msgs[1].ID); err != nil {
+		t.Fatalf("DeleteMessage of missing message: %v", err)
+	}
+	expectMessages(t, allMessages(t, db, ch), []discord.Message{msgs[0], msgs[2]})
+}
+
+func testDeleteChannel(t *testing.T, db database.Database, ch discord.ChannelID) {
+	ctx := context.Background()
+	other := newChannelID()
+	if err := db.UpdateMessages(ctx, ch, newMessages(ch, 3)); err != nil {
+		t.Fatalf("UpdateMessages: %v", err)
+	}
+	otherMsgs := newMessages(other, 2)
+	if err := db.UpdateMessages(ctx, other, otherMsgs); err != nil {
+		t.Fatalf("UpdateMessages: %v", err)
+	}
+	if err := db.DeleteChannel(ctx, ch); err != nil {
+		t.Fatalf("DeleteChannel: %v", err)
+	}
+	if err := db.DeleteChannel(ctx, ch); err != nil {
+		t.Fatalf("DeleteChannel of missing channel: %v", err)
+	}
+	expectMessages(t, allMessages(t, db, ch), nil)
+	upd, err := db.UpdatedAt(ctx, ch)
+	if err != nil {
+		t.Fatalf("UpdatedAt: %v", err)
+	}
+	if !upd.IsZero() {
+		t.Errorf("got UpdatedAt %v for deleted channel, want zero", upd)
+	}
+	expectMessages(t, allMessages(t, db, other), otherMsgs)
+}
+
+func testSearchMessages(t *testing.T, db database.Database, ch discord.ChannelID) {
+	ctx := context.Background()
+	msgs := newMessages(ch, 4)
+	msgs[0].Content = "my quick brown fox won't compile"
+	msgs[1].Content = "have you tried turning it off and on again"
+	msgs[2].Content = "quick fix: the fox needs a quick restart"
+	msgs[3].Content = "unrelated"
+	if err := db.UpdateMessages(ctx, ch, msgs); err != nil {
+		t.Fatalf("UpdateMessages: %v", err)
+	}
+	results, err := db.SearchMessages(ctx, "quick fox", []discord.ChannelID{ch}, 10, 0)
+	if err != nil {
+		t.Fatalf("SearchMessages: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	if results[0].Message.ID != msgs[2].ID || results[1].Message.ID != msgs[0].ID {
+		t.Errorf("got results %v, %v, want %v, %v",
+			results[0].Message.ID, results[1].Message.ID, msgs[2].ID, msgs[0].ID)
+	}
+	for _, result := range results {
+		if result.Message.Content == "" {
+			t.Errorf("result %v has no content", result.Message.ID)
+		}
+		if !strings.Contains(result.Snippet, database.HighlightStart) ||
+			!strings.Contains(result.Snippet, database.HighlightEnd) {
+			t.Errorf("snippet %q of %v has no highlighted terms", result.Snippet, result.Message.ID)
+		}
+	}
+	results, err = db.SearchMessages(ctx, "quick fox", []discord.ChannelID{ch}, 10, 1)
+	if err != nil {
+		t.Fatalf("SearchMessages with offset: %v", err)
+	}
+	if len(results) != 1 || results[0].Message.ID != msgs[0].ID {
+		t.Errorf("got %d results with offset, want %v", len(results), msgs[0].ID)
+	}
+	results, err = db.SearchMessages(ctx, "quick fox", []discord.ChannelID{newChannelID()}, 10, 0)
+	if err != nil {
+		t.Fatalf("SearchMessages in other post: %v", err)
+	}
+	if len(results) != 0 {
+		t.Errorf("got %d results from other post, want 0", len(results))
+	}
+	if err := db.DeleteMessage(ctx, msgs[2].ID); err != nil {
+		t.Fatalf("DeleteMessage: %v", err)
+	}
+	results, err = db.SearchMessages(ctx, "restart", []discord.ChannelID{ch}, 10, 0)
+	if err != nil {
+		t.Fatalf("SearchMessages: %v", err)
+	}
+	if len(results) != 0 {
+		t.Errorf("got %d results for deleted message, want 0", len(results))
+	}
+}
+
+func testOptOut(t *testing.T, db database.Database, _ discord.ChannelID) {
+	ctx := context.Background()
+	alice, bob := discord.UserID(newSnowflake()), discord.UserID(newSnowflake())
+	users := []discord.UserID{alice, bob}
+	expect := func(want ...discord.UserID) {
+		t.Helper()
+		got, err := db.OptedOut(ctx, users)
+		if err != nil {
+			t.Fatalf("OptedOut: %v", err)
+		}
+		if len(got) != len(want) || (len(want) == 1 && got[0] != want[0]) {
+			t.Errorf("got opted out users %v, want %v", got, want)
+		}
+	}
+	expect()
+	for i := 0; i < 2; i++ {
+		if err := db.SetOptOut(ctx, alice, true); err != nil {
+			t.Fatalf("SetOptOut: %v", err)
+		}
+	}
+	expect(alice)
+	if err := db.SetOptOut(ctx, alice, false); err != nil {
+		t.Fatalf("SetOptOut: %v", err)
+	}
+	expect()
+	if got, err := db.OptedOut(ctx, nil); err != nil || len(got) != 0 {
+		t.Errorf("OptedOut of no users: got %v, %v", got, err)
+	}
+}
+
+func testGuilds(t *testing.T, db database.Database, _ discord.ChannelID) {
+	ctx := context.Background()
+	guild := discord.Guild{ID: discord.GuildID(newSnowflake()), Name: "guild"}
+	role := discord.Role{ID: discord.RoleID(newSnowflake()), Name: "role"}
+	member := discord.Member{
+		User:    discord.User{ID: discord.UserID(newSnowflake()), Username: "member"},
+		RoleIDs: []discord.RoleID{role.ID},
+	}
+	forum := discord.Channel{ID: newChannelID(), GuildID: guild.ID, Type: discord.GuildForum}
+	post := discord.Channel{ID: newChannelID(), GuildID: guild.ID, ParentID: forum.ID, Type: discord.GuildPublicThread}
+	findGuild := func() *discord.Guild {
+		t.Helper()
+		guilds, err := db.Guilds(ctx)
+		if err != nil {
+			t.Fatalf("Guilds: %v", err)
+		}
+		for _, g := range guilds {
+			if g.ID == guild.ID {
+				return &g
+			}
+		}
+		return nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := db.SetGuild(ctx, guild); err != nil {
+			t.Fatalf("SetGuild: %v", err)
+		}
+		guild.Name = "renamed"
+	}
+	if g := findGuild(); g == nil || g.Name != "renamed" {
+		t.Errorf("got guild %+v, want it named %q", g, "renamed")
+	}
+	if err := db.SetRole(ctx, guild.ID, role); err != nil {
+		t.Fatalf("SetRole: %v", err)
+	}
+	if err := db.SetMember(ctx, guild.ID, member); err != nil {
+		t.Fatalf("SetMember: %v", err)
+	}
+	if err := db.SetChannel(ctx, forum); err != nil {
+		t.Fatalf("SetChannel: %v", err)
+	}
+	if err := db.SetChannel(ctx, post); err != nil {
+		t.Fatalf("SetChannel: %v", err)
+	}
+	msgs := newMessages(post.ID, 2)
+	if err := db.UpdateMessages(ctx, post.ID, msgs); err != nil {
+		t.Fatalf("UpdateMessages: %v", err)
+	}
+	roles, err := db.Roles(ctx, guild.ID)
+	if err != nil {
+		t.Fatalf("Roles: %v", err)
+	}
+	if len(roles) != 1 || roles[0].ID != role.ID || roles[0].Name != role.Name {
+		t.Errorf("got roles %+v, want [%+v]", roles, role)
+	}
+	members, err := db.Members(ctx, guild.ID)
+	if err != nil {
+		t.Fatalf("Members: %v", err)
+	}
+	if len(members) != 1 || members[0].User.ID != member.User.ID ||
+		len(members[0].RoleIDs) != 1 || members[0].RoleIDs[0] != role.ID {
+		t.Errorf("got members %+v, want [%+v]", members, member)
+	}
+
+	if err := db.DeleteRole(ctx, guild.ID, role.ID); err != nil {
+		t.Fatalf("DeleteRole: %v", err)
+	}
+	if roles, err := db.Roles(ctx, guild.ID); err != nil || len(roles) != 0 {
+		t.Errorf("got roles %v, %v after DeleteRole, want none", roles, err)
+	}
+	if err := db.DeleteMember(ctx, guild.ID, member.User.ID); err != nil {
+		t.Fatalf("DeleteMember: %v", err)
+	}
+	if members, err := db.Members(ctx, guild.ID); err != nil || len(members) != 0 {
+		t.Errorf("got members %v, %v after DeleteMember, want none", members, err)
+	}
+
+	if err := db.SetRole(ctx, guild.ID, role); err != nil {
+		t.Fatalf("SetRole: %v", err)
+	}
+	if err := db.SetMember(ctx, guild.ID, member); err != nil {
+		t.Fatalf("SetMember: %v", err)
+	}
+	if err := db.DeleteGuild(ctx, guild.ID); err != nil {
+		t.Fatalf("DeleteGuild: %v", err)
+	}
+	if g := findGuild(); g != nil {
+		t.Errorf("got guild %+v after DeleteGuild, want none", g)
+	}
+	if roles, err := db.Roles(ctx, guild.ID); err != nil || len(roles) != 0 {
+		t.Errorf("got roles %v, %v after DeleteGuild, want none", roles, err)
+	}
+	if members, err := db.Members(ctx, guild.ID); err != nil || len(members) != 0 {
+		t.Errorf("got members %v, %v after DeleteGuild, want none", members, err)
+	}
+	if channels, err := db.Channels(ctx, guild.ID); err != nil || len(channels) != 0 {
+		t.Errorf("got channels %v, %v after DeleteGuild, want none", channels, err)
+	}
+	expectMessages(t, allMessages(t, db, post.ID), nil)
+}
+
+func testChannels(t *testing.T, db database.Database, _ discord.ChannelID) {
+	ctx := context.Background()
+	guild := discord.GuildID(newSnowflake())
+	forum := discord.Channel{
+		ID:      newChannelID(),
+		GuildID: guild,
+		Type:    discord.GuildForum,
+		Name:    "forum",
+		Topic:   "topic",
+		AvailableTags: []discord.Tag{
+			{ID: discord.TagID(newSnowflake()), Name: "solved"},
+		},
+	}
+	post := discord.Channel{
+		ID:           newChannelID(),
+		GuildID:      guild,
+		ParentID:     forum.ID,
+		Type:         discord.GuildPublicThread,
+		Name:         "post",
+		MessageCount: 2,
+		AppliedTags:  []discord.TagID{forum.AvailableTags[0].ID},
+	}
+	text := discord.Channel{ID: newChannelID(), GuildID: guild, Type: discord.GuildText}
+	for _, ch := range []discord.Channel{forum, post, text} {
+		if err := db.SetChannel(ctx, ch); err != nil {
+			t.Fatalf("SetChannel: %v", err)
+		}
+	}
+	post.MessageCount = 3
+	if err := db.SetChannel(ctx, post); err != nil {
+		t.Fatalf("SetChannel: %v", err)
+	}
+	channels, err := db.Channels(ctx, guild)
+	if err != nil {
+		t.Fatalf("Channels: %v", err)
+	}
+	if len(channels) != 2 || channels[0].ID != forum.ID || channels[1].ID != post.ID {
+		t.Fatalf("got channels %+v, want the forum and post", channels)
+	}
+	if got := channels[0]; got.Topic != forum.Topic || len(got.AvailableTags) != 1 ||
+		got.AvailableTags[0].ID != forum.AvailableTags[0].ID {
+		t.Errorf("got forum %+v, want %+v", got, forum)
+	}
+	if got := channels[1]; got.MessageCount != 3 || got.ParentID != forum.ID ||
+		len(got.AppliedTags) != 1 || got.AppliedTags[0] != post.AppliedTags[0] {
+		t.Errorf("got post %+v, want %+v", got, post)
+	}
+
+	fetched, err := db.ThreadsFetchedAt(ctx, forum.ID)
+	if err != nil {
+		t.Fatalf("ThreadsFetchedAt: %v", err)
+	}
+	if !fetched.IsZero() {
+		t.Errorf("got ThreadsFetchedAt %v before setting it, want zero", fetched)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	if err := db.SetThreadsFetchedAt(ctx, forum.ID, now); err != nil {
+		t.Fatalf("SetThreadsFetchedAt: %v", err)
+	}
+	if err := db.SetChannel(ctx, forum); err != nil {
+		t.Fatalf("SetChannel: %v", err)
+	}
+	fetched, err = db.ThreadsFetchedAt(ctx, forum.ID)
+	if err != nil {
+		t.Fatalf("ThreadsFetchedAt: %v", err)
+	}
+	if !fetched.Equal(now) {
+		t.Errorf("got ThreadsFetchedAt %v, want %v", fetched, now)
+	}
+
+	msgs := newMessages(post.ID, 2)
+	if err := db.UpdateMessages(ctx, post.ID, msgs); err != nil {
+		t.Fatalf("UpdateMessages: %v", err)
+	}
+	if err := db.DeleteChannel(ctx, forum.ID); err != nil {
+		t.Fatalf("DeleteChannel: %v", err)
+	}
+	if channels, err := db.Channels(ctx, guild); err != nil || len(channels) != 0 {
+		t.Errorf("got channels %v, %v after deleting the forum, want none", channels, err)
+	}
+	expectMessages(t, allMessages(t, db, post.ID), nil)
+	fetched, err = db.ThreadsFetchedAt(ctx, forum.ID)
+	if err != nil {
+		t.Fatalf("ThreadsFetchedAt: %v", err)
+	}
+	if !fetched.IsZero() {
+		t.Errorf("got ThreadsFetchedAt %v for deleted forum, want zero", fetched)
+	}
+}
+
+func testConcurrent(t *testing.T, db database.Database, ch discord.ChannelID) {
+	ctx := context.Background()
+	msgs := newMessages(ch, 50)
+	if err := db.UpdateMessages(ctx, ch, nil); err != nil {
+		t.Fatalf("UpdateMessages: %v", err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, len(msgs)*2)
+	for _, msg := range msgs {
+		msg := msg
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs <- db.InsertMessage(ctx, msg)
+		}()
+		go func() {
+			defer wg.Done()
+			_, _, err := db.MessagesBefore(ctx, ch, msg.ID, 10)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent access: %v", err)
+		}
+	}
+	expectMessages(t, allMessages(t, db, ch), msgs)
+}
@@ -0,0 +1,482 @@
+package database
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+)
+
+// Memory is a Database that keeps everything in memory. Nothing survives a
+// restart, which makes it useful for tests and throwaway instances.
+type Memory struct {
+	mu        sync.RWMutex
+	messages  map[discord.ChannelID][]discord.Message // sorted by ID
+	channelOf map[discord.MessageID]discord.ChannelID
+	updatedAt map[discord.ChannelID]time.Time
+	optOuts   map[discord.UserID]struct{}
+
+	guilds         map[discord.GuildID]discord.Guild
+	roles          map[discord.GuildID]map[discord.RoleID]discord.Role
+	channels       map[discord.ChannelID]discord.Channel
+	threadsFetched map[discord.ChannelID]time.Time
+	members        map[discord.GuildID]map[discord.UserID]discord.Member
+}
+
+func NewMemory() Database {
+	return &Memory{
+		messages:  make(map[discord.ChannelID][]discord.Message),
+		channelOf: make(map[discord.MessageID]discord.ChannelID),
+		updatedAt: make(map[discord.ChannelID]time.Time),
+		optOuts:   make(map[discord.UserID]struct{}),
+
+		guilds:         make(map[discord.GuildID]discord.Guild),
+		roles:          make(map[discord.GuildID]map[discord.RoleID]discord.Role),
+		channels:       make(map[discord.ChannelID]discord.Channel),
+		threadsFetched: make(map[discord.ChannelID]time.Time),
+		members:        make(map[discord.GuildID]map[discord.UserID]discord.Member),
+	}
+}
+
+func (db *Memory) Close() error {
+	return nil
+}
+
+func (db *Memory) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (db *Memory) SchemaVersion(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+func (db *Memory) SetUpdatedAt(ctx context.Context, post discord.ChannelID, t time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.updatedAt[post]; ok {
+		db.updatedAt[post] = t
+	}
+	return nil
+}
+
+func (db *Memory) UpdatedAt(ctx context.Context, post discord.ChannelID) (time.Time, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.updatedAt[post], nil
+}
+
+func (db *Memory) UpdateMessages(ctx context.Context, post discord.ChannelID, msgs []discord.Message) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.updatedAt[post] = time.Now().UTC()
+	existing := make(map[discord.MessageID]discord.Message)
+	for _, msg := range db.messages[post] {
+		existing[msg.ID] = msg
+		delete(db.channelOf, msg.ID)
+	}
+	updated := make([]discord.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if old, ok := existing[msg.ID]; ok &&
+			!old.EditedTimestamp.Time().Before(msg.EditedTimestamp.Time()) {
+			msg = old
+		}
+		updated = append(updated, msg)
+		db.channelOf[msg.ID] = post
+	}
+	sort.Slice(updated, func(i, j int) bool {
+		return updated[i].ID < updated[j].ID
+	})
+	db.messages[post] = updated
+	return nil
+}
+
+func (db *Memory) InsertMessage(ctx context.Context, msg discord.Message) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.channelOf[msg.ID]; ok {
+		return nil
+	}
+	msgs := db.messages[msg.ChannelID]
+	i := sort.Search(len(msgs), func(i int) bool {
+		return msgs[i].ID >= msg.ID
+	})
+	msgs = append(msgs, discord.Message{})
+	copy(msgs[i+1:], msgs[i:])
+	msgs[i] = msg
+	db.messages[msg.ChannelID] = msgs
+	db.channelOf[msg.ID] = msg.ChannelID
+	return nil
+}
+
+func (db *Memory) UpdateMessage(ctx context.Context, msg discord.Message) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	ch, ok := db.channelOf[msg.ID]
+	if !ok {
+		return nil
+	}
+	msgs := db.messages[ch]
+	i := db.index(msgs, msg.ID)
+	if msg.EditedTimestamp.Time().Before(msgs[i].EditedTimestamp.Time()) {
+		return nil
+	}
+	msgs[i] = msg
+	return nil
+}
+
+func (db *Memory) DeleteMessage(ctx context.Context, msg discord.MessageID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	ch, ok := db.channelOf[msg]
+	if !ok {
+		return nil
+	}
+	delete(db.channelOf, msg)
+	msgs := db.messages[ch]
+	i := db.index(msgs, msg)
+	db.messages[ch] = append(msgs[:i], msgs[i+1:]...)
+	return nil
+}
+
+func (db *Memory) SetOptOut(ctx context.Context, user discord.UserID, optout bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if optout {
+		db.optOuts[user] = struct{}{}
+	} else {
+		delete(db.optOuts, user)
+	}
+	return nil
+}
+
+func (db *Memory) OptedOut(ctx context.Context, users []discord.UserID) ([]discord.UserID, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var optedout []discord.UserID
+	for _, user := range users {
+		if _, ok := db.optOuts[user]; ok {
+			optedout = append(optedout, user)
+		}
+	}
+	return optedout, nil
+}
+
+func (db *Memory) DeleteChannel(ctx context.Context, post discord.ChannelID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for id, ch := range db.channels {
+		if ch.ParentID == post {
+			db.deleteChannel(id)
+		}
+	}
+	db.deleteChannel(post)
+	return nil
+}
+
+func (db *Memory) deleteChannel(id discord.ChannelID) {
+	for _, msg := range db.messages[id] {
+		delete(db.channelOf, msg.ID)
+	}
+	delete(db.messages, id)
+	delete(db.updatedAt, id)
+	delete(db.channels, id)
+	delete(db.threadsFetched, id)
+}
+
+func (db *Memory) SetGuild(ctx context.Context, guild discord.Guild) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.guilds[guild.ID] = guild
+	return nil
+}
+
+func (db *Memory) Guilds(ctx context.Context) ([]discord.Guild, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var guilds []discord.Guild
+	for _, guild := range db.guilds {
+		guilds = append(guilds, guild)
+	}
+	sort.Slice(guilds, func(i, j int) bool {
+		return guilds[i].ID < guilds[j].ID
+	})
+	return guilds, nil
+}
+
+func (db *Memory) DeleteGuild(ctx context.Context, guild discord.GuildID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for id, ch := range db.channels {
+		if ch.GuildID == guild {
+			db.deleteChannel(id)
+		}
+	}
+	delete(db.guilds, guild)
+	delete(db.roles, guild)
+	delete(db.members, guild)
+	return nil
+}
+
+func (db *Memory) SetRole(ctx context.Context, guild discord.GuildID, role discord.Role) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.roles[guild] == nil {
+		db.roles[guild] = make(map[discord.RoleID]discord.Role)
+	}
+	db.roles[guild][role.ID] = role
+	return nil
+}
+
+func (db *Memory) DeleteRole(ctx context.Context, guild discord.GuildID, role discord.RoleID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.roles[guild], role)
+	return nil
+}
+
+func (db *Memory) Roles(ctx context.Context, guild discord.GuildID) ([]discord.Role, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var roles []discord.Role
+	for _, role := range db.roles[guild] {
+		roles = append(roles, role)
+	}
+	sort.Slice(roles, func(i, j int) bool {
+		return roles[i].ID < roles[j].ID
+	})
+	return roles, nil
+}
+
+func (db *Memory) SetChannel(ctx context.Context, ch discord.Channel) error {
+	if stored, _ := storedChannel(ch); !stored {
+		return nil
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.channels[ch.ID] = ch
+	return nil
+}
+
+func (db *Memory) Channels(ctx context.Context, guild discord.GuildID) ([]discord.Channel, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var channels []discord.Channel
+	for _, ch := range db.channels {
+		if ch.GuildID == guild {
+			channels = append(channels, ch)
+		}
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].ID < channels[j].ID
+	})
+	return channels, nil
+}
+
+func (db *Memory) SetThreadsFetchedAt(ctx context.Context, forum discord.ChannelID, t time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.channels[forum]; ok {
+		db.threadsFetched[forum] = t
+	}
+	return nil
+}
+
+func (db *Memory) ThreadsFetchedAt(ctx context.Context, forum discord.ChannelID) (time.Time, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.threadsFetched[forum], nil
+}
+
+func (db *Memory) SetMember(ctx context.Context, guild discord.GuildID, member discord.Member) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.members[guild] == nil {
+		db.members[guild] = make(map[discord.UserID]discord.Member)
+	}
+	db.members[guild][member.User.ID] = member
+	return nil
+}
+
+func (db *Memory) DeleteMember(ctx context.Context, guild discord.GuildID, user discord.UserID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.members[guild], user)
+	return nil
+}
+
+func (db *Memory) Members(ctx context.Context, guild discord.GuildID) ([]discord.Member, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var members []discord.Member
+	for _, member := range db.members[guild] {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].User.ID < members[j].User.ID
+	})
+	return members, nil
+}
+
+func (db *Memory) MessagesAfter(ctx context.Context, ch discord.ChannelID, msg discord.MessageID, limit uint) ([]discord.Message, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	msgs := db.messages[ch]
+	i := sort.Search(len(msgs), func(i int) bool {
+		return msgs[i].ID > msg
+	})
+	hasbefore := i > 0
+	end := len(msgs)
+	if end-i > int(limit) {
+		end = i + int(limit)
+	}
+	return db.copy(msgs[i:end]), hasbefore, nil
+}
+
+func (db *Memory) MessagesBefore(ctx context.Context, ch discord.ChannelID, msg discord.MessageID, limit uint) ([]discord.Message, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	msgs := db.messages[ch]
+	i := sort.Search(len(msgs), func(i int) bool {
+		return msgs[i].ID >= msg
+	})
+	hasafter := i < len(msgs)
+	start := 0
+	if i > int(limit) {
+		start = i - int(limit)
+	}
+	return db.copy(msgs[start:i]), hasafter, nil
+}
+
+func (db *Memory) MessageIndex(ctx context.Context, ch discord.ChannelID, msg discord.MessageID) (uint, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	msgs := db.messages[ch]
+	i := sort.Search(len(msgs), func(i int) bool {
+		return msgs[i].ID >= msg
+	})
+	return uint(i), i < len(msgs) && msgs[i].ID == msg, nil
+}
+
+// SearchMessages matches messages containing every word of the query, ranked
+// by how often the words occur.
+func (db *Memory) SearchMessages(ctx context.Context, query string, posts []discord.ChannelID, limit, offset uint) ([]SearchResult, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	db.mu.RLock()
+	var results []SearchResult
+	for _, post := range posts {
+	Messages:
+		for _, msg := range db.messages[post] {
+			content := strings.ToLower(msg.Content)
+			var rank float64
+			for _, term := range terms {
+				n := strings.Count(content, term)
+				if n == 0 {
+					continue Messages
+				}
+				rank += float64(n)
+			}
+			results = append(results, SearchResult{
+				Message: msg,
+				Snippet: memorySnippet(msg.Content, terms),
+				Rank:    rank,
+			})
+		}
+	}
+	db.mu.RUnlock()
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		return results[i].Message.ID > results[j].Message.ID
+	})
+	if offset >= uint(len(results)) {
+		return nil, nil
+	}
+	results = results[offset:]
+	if uint(len(results)) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// memorySnippet returns up to snippetLen bytes of content around the first
+// matching term, with every term highlighted.
+func memorySnippet(content string, terms []string) string {
+	const snippetLen = 200
+	lower := strings.ToLower(content)
+	if len(lower) != len(content) {
+		// Lowercasing changed byte offsets, so highlighting would
+		// misplace the markers.
+		lower = content
+	}
+	start := len(content)
+	for _, term := range terms {
+		if i := strings.Index(lower, term); i >= 0 && i < start {
+			start = i
+		}
+	}
+	if start == len(content) {
+		start = 0
+	}
+	start -= snippetLen / 4
+	if start < 0 {
+		start = 0
+	}
+	end := start + snippetLen
+	if end > len(content) {
+		end = len(content)
+	}
+	for start > 0 && !utf8.RuneStart(content[start]) {
+		start--
+	}
+	for end < len(content) && !utf8.RuneStart(content[end]) {
+		end++
+	}
+	var sb strings.Builder
+	if start > 0 {
+		sb.WriteString("... ")
+	}
+	for i := start; i < end; {
+		matched := ""
+		for _, term := range terms {
+			if strings.HasPrefix(lower[i:end], term) && len(term) > len(matched) {
+				matched = term
+			}
+		}
+		if matched == "" {
+			sb.WriteByte(content[i])
+			i++
+			continue
+		}
+		sb.WriteString(HighlightStart)
+		sb.WriteString(content[i : i+len(matched)])
+		sb.WriteString(HighlightEnd)
+		i += len(matched)
+	}
+	if end < len(content) {
+		sb.WriteString(" ...")
+	}
+	return sb.String()
+}
+
+// index returns the position of the message with the given ID in msgs,
+// which must contain it.
+func (db *Memory) index(msgs []discord.Message, id discord.MessageID) int {
+	return sort.Search(len(msgs), func(i int) bool {
+		return msgs[i].ID >= id
+	})
+}
+
+func (db *Memory) copy(msgs []discord.Message) []discord.Message {
+	if len(msgs) == 0 {
+		return nil
+	}
+	return append([]discord.Message(nil), msgs...)
+}
@@ -0,0 +1,14 @@
+package database_test
+
+import (
+	"testing"
+
+	"github.com/IoIxD/dforum/database"
+	"github.com/IoIxD/dforum/database/dbtest"
+)
+
+func TestMemory(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) database.Database {
+		return database.NewMemory()
+	})
+}
@@ -10,7 +10,7 @@ import (
 	"time"
 
 	"github.com/diamondburned/arikawa/v3/discord"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 const postgresConfigSchema = `
@@ -28,16 +28,75 @@ CREATE TABLE "Message" (
 	author BIGINT NOT NULL,
 	channel BIGINT NOT NULL,
 	content TEXT NOT NULL,
-	json TEXT NOT NULL
+	json TEXT NOT NULL,
+	search TSVECTOR GENERATED ALWAYS AS (to_tsvector('english', content)) STORED
 );
 
+CREATE INDEX "MessageSearch" ON "Message" USING GIN (search);
+
 CREATE TABLE "Channel" (
 	id BIGINT NOT NULL PRIMARY KEY,
 	updated_at TIMESTAMP NOT NULL
 );
+
+CREATE TABLE "OptOut" (
+	id BIGINT NOT NULL PRIMARY KEY,
+	opted_out_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+` + postgresStateSchema
+
+// postgresStateSchema holds the snapshot of guilds, channels and members.
+const postgresStateSchema = `
+CREATE TABLE "Guild" (
+	id BIGINT NOT NULL PRIMARY KEY,
+	json TEXT NOT NULL
+);
+
+CREATE TABLE "Role" (
+	id BIGINT NOT NULL PRIMARY KEY,
+	guild BIGINT NOT NULL,
+	json TEXT NOT NULL
+);
+
+CREATE INDEX "RoleGuild" ON "Role" (guild);
+
+CREATE TABLE "Forum" (
+	id BIGINT NOT NULL PRIMARY KEY,
+	guild BIGINT NOT NULL,
+	threads_fetched_at TIMESTAMP WITH TIME ZONE,
+	json TEXT NOT NULL
+);
+
+CREATE INDEX "ForumGuild" ON "Forum" (guild);
+
+CREATE TABLE "Thread" (
+	id BIGINT NOT NULL PRIMARY KEY,
+	guild BIGINT NOT NULL,
+	parent BIGINT NOT NULL,
+	json TEXT NOT NULL
+);
+
+CREATE INDEX "ThreadGuild" ON "Thread" (guild);
+CREATE INDEX "ThreadParent" ON "Thread" (parent);
+
+CREATE TABLE "Member" (
+	guild BIGINT NOT NULL,
+	id BIGINT NOT NULL,
+	json TEXT NOT NULL,
+	PRIMARY KEY (guild, id)
+);
 `
 
-var postgresMigrations = []string{""}
+var postgresMigrations = []string{"", `
+ALTER TABLE "Message" ADD COLUMN search TSVECTOR
+	GENERATED ALWAYS AS (to_tsvector('english', content)) STORED;
+CREATE INDEX "MessageSearch" ON "Message" USING GIN (search);
+`, `
+CREATE TABLE "OptOut" (
+	id BIGINT NOT NULL PRIMARY KEY,
+	opted_out_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+`, postgresStateSchema}
 
 type Postgres struct {
 	db          *sql.DB
@@ -48,6 +107,16 @@ func (db *Postgres) Close() error {
 	return db.db.Close()
 }
 
+func (db *Postgres) Ping(ctx context.Context) error {
+	return db.db.PingContext(ctx)
+}
+
+func (db *Postgres) SchemaVersion(ctx context.Context) (int, error) {
+	var version int
+	err := db.db.QueryRowContext(ctx, `SELECT version FROM "Config"`).Scan(&version)
+	return version, err
+}
+
 func (db *Postgres) SetUpdatedAt(ctx context.Context, post discord.ChannelID, time time.Time) error {
 	_, err := db.db.ExecContext(ctx, `UPDATE "Channel" SET updated_at = $1 WHERE id = $2`, time, post)
 	return err
@@ -68,121 +137,64 @@ func (db *Postgres) UpdateMessages(ctx context.Context, post discord.ChannelID,
 		return err
 	}
 	defer tx.Rollback()
-	var exists bool
-	err = tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM "Channel" WHERE id = $1)`, post).Scan(&exists)
-	if err != nil {
-		return fmt.Errorf("reading channel cache information: %w", err)
-	}
-	if exists {
-		_, err = tx.ExecContext(ctx, `UPDATE "Channel" SET updated_at = $1 WHERE id = $2`, time.Now().UTC(), post)
-	} else {
-		_, err = tx.ExecContext(ctx, `INSERT INTO "Channel" (id, updated_at) VALUES ($1, $2)`, post, time.Now().UTC())
-	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO "Channel" (id, updated_at) VALUES ($1, $2)
+	ON CONFLICT (id) DO UPDATE SET updated_at = EXCLUDED.updated_at`, post, time.Now().UTC())
 	if err != nil {
 		return fmt.Errorf("writing channel cache information: %w", err)
 	}
-	insert, err := tx.PrepareContext(ctx, `INSERT INTO "Message" (id, author, channel, edited_at, content, json) VALUES($1, $2, $3, $4, $5, $6)`)
+	rows, err := tx.QueryContext(ctx, `SELECT id, edited_at FROM "Message" WHERE channel = $1`, post)
 	if err != nil {
 		return err
 	}
-	defer insert.Close()
-	if !exists {
-		for _, msg := range msgs {
-			content := msg.Content
-			msg.Content = ""
-			jsonb, err := json.Marshal(msg)
-			if err != nil {
-				return err
-			}
-			_, err = insert.ExecContext(ctx, msg.ID, msg.Author.ID, msg.ChannelID, msg.EditedTimestamp.Time(), content, jsonb)
-			if err != nil {
-				return fmt.Errorf("inserting message: %w", err)
-			}
+	existing := make(map[discord.MessageID]time.Time)
+	for rows.Next() {
+		var id discord.MessageID
+		var edited sql.NullTime
+		if err = rows.Scan(&id, &edited); err != nil {
+			rows.Close()
+			return err
 		}
-		return tx.Commit()
+		existing[id] = edited.Time
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
 	}
-	rows, err := tx.QueryContext(ctx, `SELECT id, edited_at FROM "Message" WHERE channel = $1 ORDER BY id ASC`, post)
+	upsert, err := tx.PrepareContext(ctx, `INSERT INTO "Message" (id, author, channel, edited_at, content, json) VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (id) DO UPDATE SET edited_at = EXCLUDED.edited_at, content = EXCLUDED.content, json = EXCLUDED.json`)
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
-	var toDelete []discord.MessageID
-	var toInsert []discord.Message
-	var toUpdate []discord.Message
+	defer upsert.Close()
 	for _, msg := range msgs {
-		var id discord.MessageID
-		var updated time.Time
-		exists := false
-		for rows.Next() {
-			if err = rows.Scan(&id, &updated); err != nil {
-				return err
-			}
-			if id != msg.ID {
-				toDelete = append(toDelete, id)
-				continue
-			}
-			exists = true
-		}
-		if !exists {
-			toInsert = append(toInsert, msg)
+		edited, ok := existing[msg.ID]
+		delete(existing, msg.ID)
+		if ok && !edited.Before(msg.EditedTimestamp.Time()) {
 			continue
 		}
-		if updated.Before(msg.EditedTimestamp.Time()) {
-			toUpdate = append(toUpdate, msg)
+		content := msg.Content
+		msg.Content = ""
+		jsonb, err := json.Marshal(msg)
+		if err != nil {
+			return fmt.Errorf("marshaling message as JSON: %v", err)
 		}
-	}
-	for rows.Next() {
-		var id discord.MessageID
-		var updated time.Time
-		if err = rows.Scan(&id, &updated); err != nil {
-			return err
+		_, err = upsert.ExecContext(ctx, msg.ID, msg.Author.ID, msg.ChannelID, msg.EditedTimestamp.Time(), content, jsonb)
+		if err != nil {
+			return fmt.Errorf("inserting message: %w", err)
 		}
-		toDelete = append(toDelete, id)
 	}
-	if len(toDelete) > 0 {
-		del, err := tx.PrepareContext(ctx, `DELETE FROM "Message" WHERE ID = $1`)
+	if len(existing) > 0 {
+		del, err := tx.PrepareContext(ctx, `DELETE FROM "Message" WHERE id = $1`)
 		if err != nil {
 			return err
 		}
 		defer del.Close()
-		for _, id := range toDelete {
+		for id := range existing {
 			if _, err := del.ExecContext(ctx, id); err != nil {
 				return err
 			}
 		}
 	}
-	if len(toUpdate) > 0 {
-		update, err := tx.PrepareContext(ctx, `UPDATE "Message" SET content = $1, edited_at = $2, json = $3 WHERE id = $4`)
-		if err != nil {
-			return err
-		}
-		defer update.Close()
-		for _, msg := range toUpdate {
-			content := msg.Content
-			msg.Content = ""
-			jsonb, err := json.Marshal(msg)
-			if err != nil {
-				return fmt.Errorf("marshaling message as JSON: %v", err)
-			}
-			if _, err := update.ExecContext(ctx, content, msg.EditedTimestamp.Time(), jsonb, msg.ID); err != nil {
-				return err
-			}
-		}
-	}
-	if len(toInsert) > 0 {
-		for _, msg := range toInsert {
-			content := msg.Content
-			msg.Content = ""
-			jsonb, err := json.Marshal(msg)
-			if err != nil {
-				return err
-			}
-			_, err = insert.ExecContext(ctx, msg.ID, msg.Author.ID, msg.ChannelID, msg.EditedTimestamp.Time(), content, jsonb)
-			if err != nil {
-				return fmt.Errorf("inserting message: %w", err)
-			}
-		}
-	}
 	return tx.Commit()
 }
 
@@ -203,6 +215,193 @@ func (db *Postgres) DeleteMessage(ctx context.Context, msg discord.MessageID) er
 	return err
 }
 
+func (db *Postgres) SetOptOut(ctx context.Context, user discord.UserID, optout bool) error {
+	var err error
+	if optout {
+		_, err = db.db.ExecContext(ctx, `INSERT INTO "OptOut" (id, opted_out_at) VALUES ($1, $2)
+		ON CONFLICT (id) DO NOTHING`, user, time.Now().UTC())
+	} else {
+		_, err = db.db.ExecContext(ctx, `DELETE FROM "OptOut" WHERE id = $1`, user)
+	}
+	return err
+}
+
+func (db *Postgres) OptedOut(ctx context.Context, users []discord.UserID) ([]discord.UserID, error) {
+	if len(users) == 0 {
+		return nil, nil
+	}
+	ids := make([]int64, len(users))
+	for i, user := range users {
+		ids[i] = int64(user)
+	}
+	rows, err := db.db.QueryContext(ctx, `SELECT id FROM "OptOut" WHERE id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var optedout []discord.UserID
+	for rows.Next() {
+		var id discord.UserID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		optedout = append(optedout, id)
+	}
+	return optedout, rows.Err()
+}
+
+func (db *Postgres) DeleteChannel(ctx context.Context, post discord.ChannelID) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	queries := []string{
+		`DELETE FROM "Message" WHERE channel = $1 OR channel IN (SELECT id FROM "Thread" WHERE parent = $1)`,
+		`DELETE FROM "Channel" WHERE id = $1 OR id IN (SELECT id FROM "Thread" WHERE parent = $1)`,
+		`DELETE FROM "Thread" WHERE id = $1 OR parent = $1`,
+		`DELETE FROM "Forum" WHERE id = $1`,
+	}
+	for _, query := range queries {
+		if _, err = tx.ExecContext(ctx, query, post); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *Postgres) SetGuild(ctx context.Context, guild discord.Guild) error {
+	jsonb, err := json.Marshal(guild)
+	if err != nil {
+		return fmt.Errorf("marshaling guild as JSON: %v", err)
+	}
+	_, err = db.db.ExecContext(ctx, `INSERT INTO "Guild" (id, json) VALUES ($1, $2)
+	ON CONFLICT (id) DO UPDATE SET json = excluded.json`, guild.ID, jsonb)
+	return err
+}
+
+func (db *Postgres) Guilds(ctx context.Context) ([]discord.Guild, error) {
+	rows, err := db.db.QueryContext(ctx, `SELECT json FROM "Guild" ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	return scanJSON[discord.Guild](rows)
+}
+
+func (db *Postgres) DeleteGuild(ctx context.Context, guild discord.GuildID) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	queries := []string{
+		`DELETE FROM "Message" WHERE channel IN (SELECT id FROM "Thread" WHERE guild = $1)`,
+		`DELETE FROM "Channel" WHERE id IN (SELECT id FROM "Thread" WHERE guild = $1)`,
+		`DELETE FROM "Thread" WHERE guild = $1`,
+		`DELETE FROM "Forum" WHERE guild = $1`,
+		`DELETE FROM "Member" WHERE guild = $1`,
+		`DELETE FROM "Role" WHERE guild = $1`,
+		`DELETE FROM "Guild" WHERE id = $1`,
+	}
+	for _, query := range queries {
+		if _, err = tx.ExecContext(ctx, query, guild); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *Postgres) SetRole(ctx context.Context, guild discord.GuildID, role discord.Role) error {
+	jsonb, err := json.Marshal(role)
+	if err != nil {
+		return fmt.Errorf("marshaling role as JSON: %v", err)
+	}
+	_, err = db.db.ExecContext(ctx, `INSERT INTO "Role" (id, guild, json) VALUES ($1, $2, $3)
+	ON CONFLICT (id) DO UPDATE SET guild = excluded.guild, json = excluded.json`, role.ID, guild, jsonb)
+	return err
+}
+
+func (db *Postgres) DeleteRole(ctx context.Context, guild discord.GuildID, role discord.RoleID) error {
+	_, err := db.db.ExecContext(ctx, `DELETE FROM "Role" WHERE id = $1 AND guild = $2`, role, guild)
+	return err
+}
+
+func (db *Postgres) Roles(ctx context.Context, guild discord.GuildID) ([]discord.Role, error) {
+	rows, err := db.db.QueryContext(ctx, `SELECT json FROM "Role" WHERE guild = $1 ORDER BY id`, guild)
+	if err != nil {
+		return nil, err
+	}
+	return scanJSON[discord.Role](rows)
+}
+
+func (db *Postgres) SetChannel(ctx context.Context, ch discord.Channel) error {
+	stored, forum := storedChannel(ch)
+	if !stored {
+		return nil
+	}
+	jsonb, err := json.Marshal(ch)
+	if err != nil {
+		return fmt.Errorf("marshaling channel as JSON: %v", err)
+	}
+	if forum {
+		_, err = db.db.ExecContext(ctx, `INSERT INTO "Forum" (id, guild, json) VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET guild = excluded.guild, json = excluded.json`, ch.ID, ch.GuildID, jsonb)
+	} else {
+		_, err = db.db.ExecContext(ctx, `INSERT INTO "Thread" (id, guild, parent, json) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO UPDATE SET guild = excluded.guild, parent = excluded.parent, json = excluded.json`,
+			ch.ID, ch.GuildID, ch.ParentID, jsonb)
+	}
+	return err
+}
+
+func (db *Postgres) Channels(ctx context.Context, guild discord.GuildID) ([]discord.Channel, error) {
+	rows, err := db.db.QueryContext(ctx, `SELECT json FROM (
+		SELECT id, json FROM "Forum" WHERE guild = $1
+		UNION ALL SELECT id, json FROM "Thread" WHERE guild = $1
+	) AS x ORDER BY id`, guild)
+	if err != nil {
+		return nil, err
+	}
+	return scanJSON[discord.Channel](rows)
+}
+
+func (db *Postgres) SetThreadsFetchedAt(ctx context.Context, forum discord.ChannelID, t time.Time) error {
+	_, err := db.db.ExecContext(ctx, `UPDATE "Forum" SET threads_fetched_at = $1 WHERE id = $2`, t, forum)
+	return err
+}
+
+func (db *Postgres) ThreadsFetchedAt(ctx context.Context, forum discord.ChannelID) (time.Time, error) {
+	var t sql.NullTime
+	err := db.db.QueryRowContext(ctx, `SELECT threads_fetched_at FROM "Forum" WHERE id = $1`, forum).Scan(&t)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, err
+	}
+	return t.Time, nil
+}
+
+func (db *Postgres) SetMember(ctx context.Context, guild discord.GuildID, member discord.Member) error {
+	jsonb, err := json.Marshal(member)
+	if err != nil {
+		return fmt.Errorf("marshaling member as JSON: %v", err)
+	}
+	_, err = db.db.ExecContext(ctx, `INSERT INTO "Member" (guild, id, json) VALUES ($1, $2, $3)
+	ON CONFLICT (guild, id) DO UPDATE SET json = excluded.json`, guild, member.User.ID, jsonb)
+	return err
+}
+
+func (db *Postgres) DeleteMember(ctx context.Context, guild discord.GuildID, user discord.UserID) error {
+	_, err := db.db.ExecContext(ctx, `DELETE FROM "Member" WHERE guild = $1 AND id = $2`, guild, user)
+	return err
+}
+
+func (db *Postgres) Members(ctx context.Context, guild discord.GuildID) ([]discord.Member, error) {
+	rows, err := db.db.QueryContext(ctx, `SELECT json FROM "Member" WHERE guild = $1 ORDER BY id`, guild)
+	if err != nil {
+		return nil, err
+	}
+	return scanJSON[discord.Member](rows)
+}
+
 func (db *Postgres) UpdateMessage(ctx context.Context, msg discord.Message) error {
 	tx, err := db.db.BeginTx(ctx, nil)
 	if err != nil {
@@ -211,7 +410,10 @@ func (db *Postgres) UpdateMessage(ctx context.Context, msg discord.Message) erro
 	defer tx.Rollback()
 	var edited time.Time
 	err = tx.QueryRowContext(ctx, `SELECT edited_at FROM "Message" WHERE id = $1`, msg.ID).Scan(&edited)
-	if err != nil && errors.Is(err, sql.ErrNoRows) {
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
 		return err
 	}
 	if msg.EditedTimestamp.Time().Before(edited) {
@@ -298,6 +500,49 @@ func (db *Postgres) MessagesBefore(ctx context.Context, ch discord.ChannelID, ms
 	return
 }
 
+func (db *Postgres) MessageIndex(ctx context.Context, ch discord.ChannelID, msg discord.MessageID) (index uint, found bool, err error) {
+	var n uint
+	err = db.db.QueryRowContext(ctx, `SELECT COUNT(CASE WHEN id < $2 THEN 1 END), COUNT(CASE WHEN id = $2 THEN 1 END) FROM "Message" WHERE channel = $1 AND id <= $2`,
+		ch, msg).Scan(&index, &n)
+	return index, n > 0, err
+}
+
+func (db *Postgres) SearchMessages(ctx context.Context, query string, posts []discord.ChannelID, limit, offset uint) ([]SearchResult, error) {
+	if len(posts) == 0 {
+		return nil, nil
+	}
+	ids := make([]int64, len(posts))
+	for i, id := range posts {
+		ids[i] = int64(id)
+	}
+	options := fmt.Sprintf(`StartSel="%s", StopSel="%s", MaxWords=35, MinWords=15, MaxFragments=2, FragmentDelimiter=" ... "`,
+		HighlightStart, HighlightEnd)
+	rows, err := db.db.QueryContext(ctx, `SELECT content, json, ts_rank(search, query) AS rank, ts_headline('english', content, query, $5)
+	FROM "Message", websearch_to_tsquery('english', $1) AS query
+	WHERE search @@ query AND channel = ANY($2)
+	ORDER BY rank DESC, id DESC LIMIT $3 OFFSET $4`,
+		query, pq.Array(ids), limit, offset, options)
+	if err != nil {
+		return nil, fmt.Errorf("searching messages: %w", err)
+	}
+	defer rows.Close()
+	var results []SearchResult
+	for rows.Next() {
+		var content string
+		var jsonb []byte
+		var result SearchResult
+		if err := rows.Scan(&content, &jsonb, &result.Rank, &result.Snippet); err != nil {
+			return nil, fmt.Errorf("error scanning search result: %w", err)
+		}
+		if err := json.Unmarshal(jsonb, &result.Message); err != nil {
+			return nil, fmt.Errorf("unmarshaling message content: %w", err)
+		}
+		result.Message.Content = content
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
 func OpenPostgres(source string) (Database, error) {
 	sqldb, err := sql.Open("postgres", source)
 	if err != nil {
@@ -336,6 +581,7 @@ func (db *Postgres) upgrade() error {
 			return fmt.Errorf("failed while executing schema: %v", err)
 		}
 	} else if version < len(postgresMigrations) {
+		log.Printf("Migrating database schema from version %d to %d", version, len(postgresMigrations))
 		for version < len(postgresMigrations) {
 			_, err := tx.Exec(postgresMigrations[version])
 			if err != nil {
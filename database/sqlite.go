@@ -0,0 +1,625 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+	_ "modernc.org/sqlite"
+)
+
+const sqliteConfigSchema = `
+CREATE TABLE IF NOT EXISTS "Config" (
+	id SMALLINT PRIMARY KEY,
+	version INTEGER NOT NULL,
+	CHECK(id = 1)
+);
+`
+
+const sqliteSchema = `
+CREATE TABLE "Message" (
+	id BIGINT NOT NULL PRIMARY KEY,
+	edited_at TIMESTAMP,
+	author BIGINT NOT NULL,
+	channel BIGINT NOT NULL,
+	content TEXT NOT NULL,
+	json TEXT NOT NULL
+);
+
+CREATE INDEX "MessageChannel" ON "Message" (channel, id);
+
+CREATE VIRTUAL TABLE "MessageSearch" USING fts5(content, content='Message', content_rowid='id');
+` + sqliteSearchTriggers + `
+CREATE TABLE "Channel" (
+	id BIGINT NOT NULL PRIMARY KEY,
+	updated_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE "OptOut" (
+	id BIGINT NOT NULL PRIMARY KEY,
+	opted_out_at TIMESTAMP NOT NULL
+);
+` + sqliteStateSchema
+
+// sqliteStateSchema holds the snapshot of guilds, channels and members.
+const sqliteStateSchema = `
+CREATE TABLE "Guild" (
+	id BIGINT NOT NULL PRIMARY KEY,
+	json TEXT NOT NULL
+);
+
+CREATE TABLE "Role" (
+	id BIGINT NOT NULL PRIMARY KEY,
+	guild BIGINT NOT NULL,
+	json TEXT NOT NULL
+);
+
+CREATE INDEX "RoleGuild" ON "Role" (guild);
+
+CREATE TABLE "Forum" (
+	id BIGINT NOT NULL PRIMARY KEY,
+	guild BIGINT NOT NULL,
+	threads_fetched_at TIMESTAMP,
+	json TEXT NOT NULL
+);
+
+CREATE INDEX "ForumGuild" ON "Forum" (guild);
+
+CREATE TABLE "Thread" (
+	id BIGINT NOT NULL PRIMARY KEY,
+	guild BIGINT NOT NULL,
+	parent BIGINT NOT NULL,
+	json TEXT NOT NULL
+);
+
+CREATE INDEX "ThreadGuild" ON "Thread" (guild);
+CREATE INDEX "ThreadParent" ON "Thread" (parent);
+
+CREATE TABLE "Member" (
+	guild BIGINT NOT NULL,
+	id BIGINT NOT NULL,
+	json TEXT NOT NULL,
+	PRIMARY KEY (guild, id)
+);
+`
+
+// sqliteSearchTriggers keep the external content full-text index in sync
+// with the "Message" table.
+const sqliteSearchTriggers = `
+CREATE TRIGGER "MessageSearchInsert" AFTER INSERT ON "Message" BEGIN
+	INSERT INTO "MessageSearch" (rowid, content) VALUES (new.id, new.content);
+END;
+CREATE TRIGGER "MessageSearchDelete" AFTER DELETE ON "Message" BEGIN
+	INSERT INTO "MessageSearch" ("MessageSearch", rowid, content) VALUES ('delete', old.id, old.content);
+END;
+CREATE TRIGGER "MessageSearchUpdate" AFTER UPDATE ON "Message" BEGIN
+	INSERT INTO "MessageSearch" ("MessageSearch", rowid, content) VALUES ('delete', old.id, old.content);
+	INSERT INTO "MessageSearch" (rowid, content) VALUES (new.id, new.content);
+END;
+`
+
+// sqliteMigrations mirrors postgresMigrations so that both backends share
+// the same schema versions.
+var sqliteMigrations = []string{"", `
+CREATE VIRTUAL TABLE "MessageSearch" USING fts5(content, content='Message', content_rowid='id');
+` + sqliteSearchTriggers + `
+INSERT INTO "MessageSearch" ("MessageSearch") VALUES ('rebuild');
+`, `
+CREATE TABLE "OptOut" (
+	id BIGINT NOT NULL PRIMARY KEY,
+	opted_out_at TIMESTAMP NOT NULL
+);
+`, sqliteStateSchema}
+
+type SQLite struct {
+	db          *sql.DB
+	connectedAt time.Time
+}
+
+func (db *SQLite) Close() error {
+	return db.db.Close()
+}
+
+func (db *SQLite) Ping(ctx context.Context) error {
+	return db.db.PingContext(ctx)
+}
+
+func (db *SQLite) SchemaVersion(ctx context.Context) (int, error) {
+	var version int
+	err := db.db.QueryRowContext(ctx, `SELECT version FROM "Config"`).Scan(&version)
+	return version, err
+}
+
+func (db *SQLite) SetUpdatedAt(ctx context.Context, post discord.ChannelID, time time.Time) error {
+	_, err := db.db.ExecContext(ctx, `UPDATE "Channel" SET updated_at = ? WHERE id = ?`, time, post)
+	return err
+}
+
+func (db *SQLite) UpdatedAt(ctx context.Context, post discord.ChannelID) (time.Time, error) {
+	var t time.Time
+	err := db.db.QueryRowContext(ctx, `SELECT updated_at FROM "Channel" WHERE id = ?`, post).Scan(&t)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, err
+	}
+	return t, nil
+}
+
+func (db *SQLite) UpdateMessages(ctx context.Context, post discord.ChannelID, msgs []discord.Message) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, `INSERT INTO "Channel" (id, updated_at) VALUES (?, ?)
+	ON CONFLICT (id) DO UPDATE SET updated_at = excluded.updated_at`, post, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("writing channel cache information: %w", err)
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT id, edited_at FROM "Message" WHERE channel = ?`, post)
+	if err != nil {
+		return err
+	}
+	existing := make(map[discord.MessageID]time.Time)
+	for rows.Next() {
+		var id discord.MessageID
+		var edited time.Time
+		if err = rows.Scan(&id, &edited); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[id] = edited
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	upsert, err := tx.PrepareContext(ctx, `INSERT INTO "Message" (id, author, channel, edited_at, content, json) VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT (id) DO UPDATE SET edited_at = excluded.edited_at, content = excluded.content, json = excluded.json`)
+	if err != nil {
+		return err
+	}
+	defer upsert.Close()
+	for _, msg := range msgs {
+		edited, ok := existing[msg.ID]
+		delete(existing, msg.ID)
+		if ok && !edited.Before(msg.EditedTimestamp.Time()) {
+			continue
+		}
+		content := msg.Content
+		msg.Content = ""
+		jsonb, err := json.Marshal(msg)
+		if err != nil {
+			return fmt.Errorf("marshaling message as JSON: %v", err)
+		}
+		_, err = upsert.ExecContext(ctx, msg.ID, msg.Author.ID, msg.ChannelID, msg.EditedTimestamp.Time(), content, jsonb)
+		if err != nil {
+			return fmt.Errorf("inserting message: %w", err)
+		}
+	}
+	if len(existing) > 0 {
+		del, err := tx.PrepareContext(ctx, `DELETE FROM "Message" WHERE id = ?`)
+		if err != nil {
+			return err
+		}
+		defer del.Close()
+		for id := range existing {
+			if _, err := del.ExecContext(ctx, id); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *SQLite) InsertMessage(ctx context.Context, msg discord.Message) error {
+	content := msg.Content
+	msg.Content = ""
+	jsonb, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshaling message as JSON: %v", err)
+	}
+	_, err = db.db.ExecContext(ctx, `INSERT INTO "Message" (id, author, channel, edited_at, content, json) VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+		msg.ID, msg.Author.ID, msg.ChannelID, msg.EditedTimestamp.Time(), content, jsonb)
+	return err
+}
+
+func (db *SQLite) DeleteMessage(ctx context.Context, msg discord.MessageID) error {
+	_, err := db.db.ExecContext(ctx, `DELETE FROM "Message" WHERE id = ?`, msg)
+	return err
+}
+
+func (db *SQLite) SetOptOut(ctx context.Context, user discord.UserID, optout bool) error {
+	var err error
+	if optout {
+		_, err = db.db.ExecContext(ctx, `INSERT INTO "OptOut" (id, opted_out_at) VALUES (?, ?)
+		ON CONFLICT (id) DO NOTHING`, user, time.Now().UTC())
+	} else {
+		_, err = db.db.ExecContext(ctx, `DELETE FROM "OptOut" WHERE id = ?`, user)
+	}
+	return err
+}
+
+func (db *SQLite) OptedOut(ctx context.Context, users []discord.UserID) ([]discord.UserID, error) {
+	if len(users) == 0 {
+		return nil, nil
+	}
+	args := make([]any, len(users))
+	for i, user := range users {
+		args[i] = user
+	}
+	placeholders := strings.Repeat(", ?", len(users))[2:]
+	rows, err := db.db.QueryContext(ctx, `SELECT id FROM "OptOut" WHERE id IN (`+placeholders+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var optedout []discord.UserID
+	for rows.Next() {
+		var id discord.UserID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		optedout = append(optedout, id)
+	}
+	return optedout, rows.Err()
+}
+
+func (db *SQLite) DeleteChannel(ctx context.Context, post discord.ChannelID) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	queries := []string{
+		`DELETE FROM "Message" WHERE channel = ?1 OR channel IN (SELECT id FROM "Thread" WHERE parent = ?1)`,
+		`DELETE FROM "Channel" WHERE id = ?1 OR id IN (SELECT id FROM "Thread" WHERE parent = ?1)`,
+		`DELETE FROM "Thread" WHERE id = ?1 OR parent = ?1`,
+		`DELETE FROM "Forum" WHERE id = ?1`,
+	}
+	for _, query := range queries {
+		if _, err = tx.ExecContext(ctx, query, post); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *SQLite) SetGuild(ctx context.Context, guild discord.Guild) error {
+	jsonb, err := json.Marshal(guild)
+	if err != nil {
+		return fmt.Errorf("marshaling guild as JSON: %v", err)
+	}
+	_, err = db.db.ExecContext(ctx, `INSERT INTO "Guild" (id, json) VALUES (?, ?)
+	ON CONFLICT (id) DO UPDATE SET json = excluded.json`, guild.ID, jsonb)
+	return err
+}
+
+func (db *SQLite) Guilds(ctx context.Context) ([]discord.Guild, error) {
+	rows, err := db.db.QueryContext(ctx, `SELECT json FROM "Guild" ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	return scanJSON[discord.Guild](rows)
+}
+
+func (db *SQLite) DeleteGuild(ctx context.Context, guild discord.GuildID) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	queries := []string{
+		`DELETE FROM "Message" WHERE channel IN (SELECT id FROM "Thread" WHERE guild = ?)`,
+		`DELETE FROM "Channel" WHERE id IN (SELECT id FROM "Thread" WHERE guild = ?)`,
+		`DELETE FROM "Thread" WHERE guild = ?`,
+		`DELETE FROM "Forum" WHERE guild = ?`,
+		`DELETE FROM "Member" WHERE guild = ?`,
+		`DELETE FROM "Role" WHERE guild = ?`,
+		`DELETE FROM "Guild" WHERE id = ?`,
+	}
+	for _, query := range queries {
+		if _, err = tx.ExecContext(ctx, query, guild); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *SQLite) SetRole(ctx context.Context, guild discord.GuildID, role discord.Role) error {
+	jsonb, err := json.Marshal(role)
+	if err != nil {
+		return fmt.Errorf("marshaling role as JSON: %v", err)
+	}
+	_, err = db.db.ExecContext(ctx, `INSERT INTO "Role" (id, guild, json) VALUES (?, ?, ?)
+	ON CONFLICT (id) DO UPDATE SET guild = excluded.guild, json = excluded.json`, role.ID, guild, jsonb)
+	return err
+}
+
+func (db *SQLite) DeleteRole(ctx context.Context, guild discord.GuildID, role discord.RoleID) error {
+	_, err := db.db.ExecContext(ctx, `DELETE FROM "Role" WHERE id = ? AND guild = ?`, role, guild)
+	return err
+}
+
+func (db *SQLite) Roles(ctx context.Context, guild discord.GuildID) ([]discord.Role, error) {
+	rows, err := db.db.QueryContext(ctx, `SELECT json FROM "Role" WHERE guild = ? ORDER BY id`, guild)
+	if err != nil {
+		return nil, err
+	}
+	return scanJSON[discord.Role](rows)
+}
+
+func (db *SQLite) SetChannel(ctx context.Context, ch discord.Channel) error {
+	stored, forum := storedChannel(ch)
+	if !stored {
+		return nil
+	}
+	jsonb, err := json.Marshal(ch)
+	if err != nil {
+		return fmt.Errorf("marshaling channel as JSON: %v", err)
+	}
+	if forum {
+		_, err = db.db.ExecContext(ctx, `INSERT INTO "Forum" (id, guild, json) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET guild = excluded.guild, json = excluded.json`, ch.ID, ch.GuildID, jsonb)
+	} else {
+		_, err = db.db.ExecContext(ctx, `INSERT INTO "Thread" (id, guild, parent, json) VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET guild = excluded.guild, parent = excluded.parent, json = excluded.json`,
+			ch.ID, ch.GuildID, ch.ParentID, jsonb)
+	}
+	return err
+}
+
+func (db *SQLite) Channels(ctx context.Context, guild discord.GuildID) ([]discord.Channel, error) {
+	rows, err := db.db.QueryContext(ctx, `SELECT json FROM (
+		SELECT id, json FROM "Forum" WHERE guild = ?1
+		UNION ALL SELECT id, json FROM "Thread" WHERE guild = ?1
+	) AS x ORDER BY id`, guild)
+	if err != nil {
+		return nil, err
+	}
+	return scanJSON[discord.Channel](rows)
+}
+
+func (db *SQLite) SetThreadsFetchedAt(ctx context.Context, forum discord.ChannelID, t time.Time) error {
+	_, err := db.db.ExecContext(ctx, `UPDATE "Forum" SET threads_fetched_at = ? WHERE id = ?`, t, forum)
+	return err
+}
+
+func (db *SQLite) ThreadsFetchedAt(ctx context.Context, forum discord.ChannelID) (time.Time, error) {
+	var t sql.NullTime
+	err := db.db.QueryRowContext(ctx, `SELECT threads_fetched_at FROM "Forum" WHERE id = ?`, forum).Scan(&t)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, err
+	}
+	return t.Time, nil
+}
+
+func (db *SQLite) SetMember(ctx context.Context, guild discord.GuildID, member discord.Member) error {
+	jsonb, err := json.Marshal(member)
+	if err != nil {
+		return fmt.Errorf("marshaling member as JSON: %v", err)
+	}
+	_, err = db.db.ExecContext(ctx, `INSERT INTO "Member" (guild, id, json) VALUES (?, ?, ?)
+	ON CONFLICT (guild, id) DO UPDATE SET json = excluded.json`, guild, member.User.ID, jsonb)
+	return err
+}
+
+func (db *SQLite) DeleteMember(ctx context.Context, guild discord.GuildID, user discord.UserID) error {
+	_, err := db.db.ExecContext(ctx, `DELETE FROM "Member" WHERE guild = ? AND id = ?`, guild, user)
+	return err
+}
+
+func (db *SQLite) Members(ctx context.Context, guild discord.GuildID) ([]discord.Member, error) {
+	rows, err := db.db.QueryContext(ctx, `SELECT json FROM "Member" WHERE guild = ? ORDER BY id`, guild)
+	if err != nil {
+		return nil, err
+	}
+	return scanJSON[discord.Member](rows)
+}
+
+func (db *SQLite) UpdateMessage(ctx context.Context, msg discord.Message) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var edited time.Time
+	err = tx.QueryRowContext(ctx, `SELECT edited_at FROM "Message" WHERE id = ?`, msg.ID).Scan(&edited)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	if msg.EditedTimestamp.Time().Before(edited) {
+		return nil
+	}
+	content := msg.Content
+	msg.Content = ""
+	jsonb, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshaling message as JSON: %v", err)
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE "Message" SET content = ?, edited_at = ?, json = ? WHERE id = ?`,
+		content, msg.EditedTimestamp.Time(), jsonb, msg.ID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *SQLite) MessagesAfter(ctx context.Context, ch discord.ChannelID, msg discord.MessageID, limit uint) (msgs []discord.Message, hasbefore bool, err error) {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM "Message" WHERE channel = ? AND id <= ?)`, ch, msg).Scan(&hasbefore)
+	if err != nil {
+		return
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT content, json FROM "Message" WHERE channel = ? AND id > ? ORDER BY id ASC LIMIT ?`,
+		ch, msg, limit)
+	if err != nil {
+		err = fmt.Errorf("querying messages: %v", err)
+		return
+	}
+	defer rows.Close()
+	msgs, err = scanSQLiteMessages(rows)
+	return
+}
+
+func (db *SQLite) MessagesBefore(ctx context.Context, ch discord.ChannelID, msg discord.MessageID, limit uint) (msgs []discord.Message, hasafter bool, err error) {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM "Message" WHERE channel = ? AND id >= ?)`, ch, msg).Scan(&hasafter)
+	if err != nil {
+		return
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT content, json FROM (SELECT id, content, json FROM "Message" WHERE channel = ? AND id < ? ORDER BY id DESC LIMIT ?) AS x ORDER BY id ASC`,
+		ch, msg, limit)
+	if err != nil {
+		err = fmt.Errorf("querying messages: %v", err)
+		return
+	}
+	defer rows.Close()
+	msgs, err = scanSQLiteMessages(rows)
+	return
+}
+
+func (db *SQLite) MessageIndex(ctx context.Context, ch discord.ChannelID, msg discord.MessageID) (index uint, found bool, err error) {
+	var n uint
+	err = db.db.QueryRowContext(ctx, `SELECT COUNT(CASE WHEN id < ? THEN 1 END), COUNT(CASE WHEN id = ? THEN 1 END) FROM "Message" WHERE channel = ? AND id <= ?`,
+		msg, msg, ch, msg).Scan(&index, &n)
+	return index, n > 0, err
+}
+
+func scanSQLiteMessages(rows *sql.Rows) ([]discord.Message, error) {
+	var msgs []discord.Message
+	for rows.Next() {
+		var content string
+		var jsonb []byte
+		if err := rows.Scan(&content, &jsonb); err != nil {
+			return nil, fmt.Errorf("error scanning message: %w", err)
+		}
+		var msg discord.Message
+		if err := json.Unmarshal(jsonb, &msg); err != nil {
+			return nil, fmt.Errorf("unmarshaling message content: %w", err)
+		}
+		msg.Content = content
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
+
+func (db *SQLite) SearchMessages(ctx context.Context, query string, posts []discord.ChannelID, limit, offset uint) ([]SearchResult, error) {
+	terms := searchTerms(query)
+	if len(posts) == 0 || len(terms) == 0 {
+		return nil, nil
+	}
+	for i, term := range terms {
+		terms[i] = `"` + term + `"`
+	}
+	args := []any{HighlightStart, HighlightEnd, strings.Join(terms, " ")}
+	placeholders := make([]string, len(posts))
+	for i, id := range posts {
+		placeholders[i] = "?"
+		args = append(args, id)
+	}
+	args = append(args, limit, offset)
+	rows, err := db.db.QueryContext(ctx, `SELECT m.content, m.json, -bm25("MessageSearch"), snippet("MessageSearch", 0, ?, ?, ' ... ', 24)
+	FROM "MessageSearch" JOIN "Message" AS m ON m.id = "MessageSearch".rowid
+	WHERE "MessageSearch" MATCH ? AND m.channel IN (`+strings.Join(placeholders, ", ")+`)
+	ORDER BY bm25("MessageSearch"), m.id DESC LIMIT ? OFFSET ?`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("searching messages: %w", err)
+	}
+	defer rows.Close()
+	var results []SearchResult
+	for rows.Next() {
+		var content string
+		var jsonb []byte
+		var result SearchResult
+		if err := rows.Scan(&content, &jsonb, &result.Rank, &result.Snippet); err != nil {
+			return nil, fmt.Errorf("error scanning search result: %w", err)
+		}
+		if err := json.Unmarshal(jsonb, &result.Message); err != nil {
+			return nil, fmt.Errorf("unmarshaling message content: %w", err)
+		}
+		result.Message.Content = content
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// OpenSQLite opens the SQLite database at source, which is either a bare
+// path or a DSN of the form sqlite:///path/to/dforum.db.
+func OpenSQLite(source string) (Database, error) {
+	path := strings.TrimPrefix(source, "sqlite://")
+	if path == "" {
+		return nil, errors.New("sqlite database path is empty")
+	}
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_time_format=sqlite"
+	sqldb, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows a single writer at a time, so serialize access
+	// instead of fighting over the database lock.
+	sqldb.SetMaxOpenConns(1)
+
+	db := &SQLite{db: sqldb, connectedAt: time.Now()}
+	if err := db.upgrade(); err != nil {
+		sqldb.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (db *SQLite) upgrade() error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return fmt.Errorf("couldn't start db transaction: %w", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(sqliteConfigSchema)
+	if err != nil {
+		return err
+	}
+	var version int
+	err = tx.QueryRow(`SELECT version FROM "Config"`).Scan(&version)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("couldn't query schema version: %v", err)
+	}
+	if version > len(sqliteMigrations) {
+		log.Fatalln("database is from a newer dforum")
+	}
+	if version == 0 {
+		if _, err := tx.Exec(sqliteSchema); err != nil {
+			return fmt.Errorf("failed while executing schema: %v", err)
+		}
+	} else if version < len(sqliteMigrations) {
+		log.Printf("Migrating database schema from version %d to %d", version, len(sqliteMigrations))
+		for version < len(sqliteMigrations) {
+			_, err := tx.Exec(sqliteMigrations[version])
+			if err != nil {
+				return fmt.Errorf("failed while executing migration %d: %v", version, err)
+			}
+			version++
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO "Config" (id, version) VALUES (1, ?)
+	ON CONFLICT (id) DO UPDATE SET version = excluded.version`, len(sqliteMigrations))
+	if err != nil {
+		return fmt.Errorf("failed to change schema version: %v", err)
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,19 @@
+package database_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/IoIxD/dforum/database"
+	"github.com/IoIxD/dforum/database/dbtest"
+)
+
+func TestSQLite(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) database.Database {
+		db, err := database.OpenSQLite("sqlite://" + filepath.Join(t.TempDir(), "dforum.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
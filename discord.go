@@ -4,16 +4,24 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/http"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/IoIxD/dforum/database"
 	"github.com/diamondburned/arikawa/v3/api"
 	"github.com/diamondburned/arikawa/v3/discord"
 	"github.com/diamondburned/arikawa/v3/gateway"
 	"github.com/diamondburned/arikawa/v3/state"
+	"golang.org/x/exp/slices"
 )
 
+// archivedPostsTTL is how long the archived posts of a forum that were
+// fetched before a restart are trusted for. Posts can be archived while dforum
+// is offline, and only show up as archived once they are fetched again.
+const archivedPostsTTL = 24 * time.Hour
+
 func (s *server) channel(channelID discord.ChannelID) (*discord.Channel, error) {
 	s.fetchedInactiveMu.Lock()
 	defer s.fetchedInactiveMu.Unlock()
@@ -25,6 +33,12 @@ func (s *server) channel(channelID discord.ChannelID) (*discord.Channel, error)
 }
 
 func (s *server) channels(guildID discord.GuildID) ([]discord.Channel, error) {
+	return s.channelsLimited(guildID, nil)
+}
+
+// channelsLimited is channels, but calls wait, unless it is nil, before each
+// request for archived posts, so that the crawler stays within its budget.
+func (s *server) channelsLimited(guildID discord.GuildID, wait func() error) ([]discord.Channel, error) {
 	s.fetchedInactiveMu.Lock()
 	defer s.fetchedInactiveMu.Unlock()
 	channels, err := s.discord.Channels(guildID)
@@ -50,6 +64,14 @@ func (s *server) channels(guildID discord.GuildID) ([]discord.Channel, error) {
 		if _, ok := s.fetchedInactive[ch.ID]; ok {
 			continue
 		}
+		// They may have been fetched before a restart.
+		fetched, err := s.db.ThreadsFetchedAt(context.Background(), ch.ID)
+		if err != nil {
+			log.Printf("reading when posts of %s were fetched: %v", ch.ID, err)
+		} else if time.Since(fetched) < archivedPostsTTL {
+			s.fetchedInactive[ch.ID] = struct{}{}
+			continue
+		}
 		perms := discord.CalcOverwrites(*guild, ch, *selfMember)
 		if !perms.Has(0 |
 			discord.PermissionReadMessageHistory |
@@ -58,6 +80,11 @@ func (s *server) channels(guildID discord.GuildID) ([]discord.Channel, error) {
 		}
 		var before discord.Timestamp
 		for {
+			if wait != nil {
+				if err := wait(); err != nil {
+					return nil, err
+				}
+			}
 			threads, err := s.discord.PublicArchivedThreads(ch.ID, before, 0)
 			if err != nil {
 				return nil, err
@@ -72,6 +99,9 @@ func (s *server) channels(guildID discord.GuildID) ([]discord.Channel, error) {
 			before = threads.Threads[len(threads.Threads)-1].ThreadMetadata.ArchiveTimestamp
 		}
 		s.fetchedInactive[ch.ID] = struct{}{}
+		if err := s.db.SetThreadsFetchedAt(context.Background(), ch.ID, time.Now().UTC()); err != nil {
+			log.Printf("recording that posts of %s were fetched: %v", ch.ID, err)
+		}
 	}
 	return channels, nil
 }
@@ -119,6 +149,189 @@ func (s *server) ensureMembers(ctx context.Context, post discord.Channel, msgs [
 	}
 }
 
+// purgeChannels forgets everything stored about the given channels and
+// schedules a sitemap rebuild so that they disappear from it too.
+func (s *server) purgeChannels(ids ...discord.ChannelID) {
+	if len(ids) == 0 {
+		return
+	}
+	s.fetchedInactiveMu.Lock()
+	for _, id := range ids {
+		delete(s.fetchedInactive, id)
+	}
+	s.fetchedInactiveMu.Unlock()
+	s.requestMembers.Lock()
+	for _, id := range ids {
+		delete(s.membersGot, id)
+	}
+	s.requestMembers.Unlock()
+	// so that queued writes don't store the channels again
+	s.persisted.Flush()
+	for _, id := range ids {
+		if err := s.messageCache.RemoveChannel(context.Background(), id); err != nil {
+			log.Printf("purging channel %s: %v", id, err)
+		}
+	}
+	s.requestSitemapUpdate()
+}
+
+func isThread(t discord.ChannelType) bool {
+	return t == discord.GuildPublicThread ||
+		t == discord.GuildPrivateThread ||
+		t == discord.GuildAnnouncementThread
+}
+
+// handleGuildDelete purges a guild the bot has left. It runs before the
+// state forgets the guild's channels.
+func (s *server) handleGuildDelete(ev *gateway.GuildDeleteEvent) {
+	if ev.Unavailable {
+		// an outage, not a removal
+		return
+	}
+	go s.purgeGuild(ev.ID, s.guildChannelIDs(ev.ID))
+}
+
+func (s *server) guildChannelIDs(guildID discord.GuildID) []discord.ChannelID {
+	channels, _ := s.discord.Cabinet.Channels(guildID)
+	ids := make([]discord.ChannelID, len(channels))
+	for i, ch := range channels {
+		ids[i] = ch.ID
+	}
+	return ids
+}
+
+// purgeGuild forgets everything stored about a guild, including the given
+// channels.
+func (s *server) purgeGuild(guildID discord.GuildID, ids []discord.ChannelID) {
+	s.purgeChannels(ids...)
+	s.persisted.Flush()
+	if err := s.db.DeleteGuild(context.Background(), guildID); err != nil {
+		log.Printf("purging guild %s: %v", guildID, err)
+	}
+}
+
+// handleReady purges the guilds that were restored from the database but
+// that the bot has left since.
+func (s *server) handleReady(ev *gateway.ReadyEvent) {
+	guilds, err := s.discord.Cabinet.Guilds()
+	if err != nil {
+		return
+	}
+	for _, guild := range guilds {
+		guild := guild
+		if slices.ContainsFunc(ev.Guilds, func(g gateway.GuildCreateEvent) bool {
+			return g.ID == guild.ID
+		}) {
+			continue
+		}
+		channels, _ := s.discord.Cabinet.Channels(guild.ID)
+		ids := make([]discord.ChannelID, len(channels))
+		for i := range channels {
+			ids[i] = channels[i].ID
+			s.discord.Cabinet.ChannelRemove(&channels[i])
+		}
+		s.discord.Cabinet.GuildRemove(guild.ID)
+		go s.purgeGuild(guild.ID, ids)
+	}
+}
+
+// handleGuildCreate purges the forums that were restored from the database
+// but have been deleted since.
+func (s *server) handleGuildCreate(ev *gateway.GuildCreateEvent) {
+	if ev.Unavailable {
+		return
+	}
+	channels, err := s.discord.Cabinet.Channels(ev.ID)
+	if err != nil {
+		return
+	}
+	var deleted []discord.ChannelID
+	for i, ch := range channels {
+		if ch.Type != discord.GuildForum || slices.ContainsFunc(ev.Channels, func(c discord.Channel) bool {
+			return c.ID == ch.ID
+		}) {
+			continue
+		}
+		s.discord.Cabinet.ChannelRemove(&channels[i])
+		deleted = append(deleted, s.removePosts(ev.ID, ch.ID)...)
+	}
+	go s.purgeChannels(deleted...)
+}
+
+// handleChannelDelete purges a deleted forum along with its posts, which
+// Discord doesn't send separate events for.
+func (s *server) handleChannelDelete(ev *gateway.ChannelDeleteEvent) {
+	s.purgeChannels(s.removePosts(ev.GuildID, ev.ID)...)
+}
+
+// removePosts removes the posts of forum from the state, and returns their IDs
+// along with the forum's.
+func (s *server) removePosts(guildID discord.GuildID, forum discord.ChannelID) []discord.ChannelID {
+	ids := []discord.ChannelID{forum}
+	channels, _ := s.discord.Cabinet.Channels(guildID)
+	for i, ch := range channels {
+		if ch.ParentID != forum || !isThread(ch.Type) {
+			continue
+		}
+		s.discord.Cabinet.ChannelRemove(&channels[i])
+		ids = append(ids, ch.ID)
+	}
+	return ids
+}
+
+// handleThreadListSync purges the threads that are missing from a sync and
+// turn out to have been deleted. Threads that are only archived are kept.
+// Only threads that were active are checked, as archived ones are never part
+// of a sync; their deletion arrives as a ThreadDelete event instead.
+func (s *server) handleThreadListSync(ev *gateway.ThreadListSyncEvent) {
+	channels, err := s.discord.Cabinet.Channels(ev.GuildID)
+	if err != nil {
+		return
+	}
+	synced := make(map[discord.ChannelID]struct{}, len(ev.Threads))
+	for _, thread := range ev.Threads {
+		synced[thread.ID] = struct{}{}
+	}
+	var deleted []discord.ChannelID
+	for i, ch := range channels {
+		if !isThread(ch.Type) {
+			continue
+		}
+		if ev.ChannelIDs != nil && !slices.Contains(ev.ChannelIDs, ch.ParentID) {
+			continue
+		}
+		if _, ok := synced[ch.ID]; ok {
+			continue
+		}
+		if ch.ThreadMetadata != nil && ch.ThreadMetadata.Archived {
+			continue
+		}
+		thread, err := s.discord.Client.Channel(ch.ID)
+		switch {
+		case err == nil:
+			s.discord.Cabinet.ChannelSet(thread, true)
+		case discordStatusIs(err, http.StatusNotFound):
+			s.discord.Cabinet.ChannelRemove(&channels[i])
+			deleted = append(deleted, ch.ID)
+		default:
+			log.Printf("checking thread %s: %v", ch.ID, err)
+		}
+	}
+	// Archived threads aren't part of the sync, so fetch them again.
+	s.fetchedInactiveMu.Lock()
+	for id := range s.fetchedInactive {
+		if ch, err := s.discord.Cabinet.Channel(id); err == nil && ch.GuildID == ev.GuildID &&
+			(ev.ChannelIDs == nil || slices.Contains(ev.ChannelIDs, id)) {
+			delete(s.fetchedInactive, id)
+			if err := s.db.SetThreadsFetchedAt(context.Background(), id, time.Time{}); err != nil {
+				log.Printf("resetting when posts of %s were fetched: %v", id, err)
+			}
+		}
+	}
+	s.fetchedInactiveMu.Unlock()
+	s.purgeChannels(deleted...)
+}
+
 type messageCache struct {
 	st       *state.State
 	db       database.Database
@@ -235,6 +448,23 @@ func (c *messageCache) Remove(ctx context.Context, chid discord.ChannelID, id di
 	return c.db.DeleteMessage(ctx, id)
 }
 
+// RemoveChannel forgets the messages of a channel, waiting for a fetch of
+// them that is in progress to finish first.
+func (c *messageCache) RemoveChannel(ctx context.Context, chid discord.ChannelID) error {
+	if v, ok := c.channels.Load(chid); ok {
+		ch := v.(*channel)
+		ch.mut.Lock()
+		if fetchdone := ch.fetchDone; fetchdone != nil {
+			ch.mut.Unlock()
+			<-fetchdone
+			ch.mut.Lock()
+		}
+		defer ch.mut.Unlock()
+		c.channels.Delete(chid)
+	}
+	return c.db.DeleteChannel(ctx, chid)
+}
+
 type result struct {
 	msgs []discord.Message
 	err  error
@@ -247,6 +477,7 @@ func (c *messageCache) MessagesAfter(ctx context.Context, chID discord.ChannelID
 	}
 	if *ch.uptodate {
 		ch.mut.Unlock()
+		messageCacheRequests.WithLabelValues("hit").Inc()
 		messages, hasbefore, err = c.db.MessagesAfter(ctx, chID, m, limit+1)
 		if err != nil {
 			return
@@ -257,6 +488,7 @@ func (c *messageCache) MessagesAfter(ctx context.Context, chID discord.ChannelID
 		}
 		return
 	}
+	messageCacheRequests.WithLabelValues("miss").Inc()
 	c.messages(ch, chID, func(msgs []discord.Message, full bool, e error) (done bool) {
 		select {
 		case <-ctx.Done():
@@ -286,7 +518,7 @@ func (c *messageCache) MessagesAfter(ctx context.Context, chID discord.ChannelID
 		}
 		messages = msgs[i:]
 		return full
-	})
+	}, nil)
 	return
 }
 
@@ -297,6 +529,7 @@ func (c *messageCache) MessagesBefore(ctx context.Context, chID discord.ChannelI
 	}
 	if *ch.uptodate {
 		ch.mut.Unlock()
+		messageCacheRequests.WithLabelValues("hit").Inc()
 		messages, hasafter, err = c.db.MessagesBefore(ctx, chID, m, limit+1)
 		if err != nil {
 			return
@@ -307,6 +540,7 @@ func (c *messageCache) MessagesBefore(ctx context.Context, chID discord.ChannelI
 		}
 		return
 	}
+	messageCacheRequests.WithLabelValues("miss").Inc()
 	c.messages(ch, chID, func(msgs []discord.Message, full bool, e error) (done bool) {
 		select {
 		case <-ctx.Done():
@@ -338,11 +572,67 @@ func (c *messageCache) MessagesBefore(ctx context.Context, chID discord.ChannelI
 		messages = make([]discord.Message, i)
 		copy(messages, msgs[:i])
 		return true
-	})
+	}, nil)
 	return
 }
 
-func (c *messageCache) messages(ch *channel, chid discord.ChannelID, fn fetchCallback) {
+// MessageIndex returns how many messages of a channel come before m, and
+// whether m is one of its messages.
+func (c *messageCache) MessageIndex(ctx context.Context, chID discord.ChannelID, m discord.MessageID) (index uint, found bool, err error) {
+	ch, err := c.channel(chID)
+	if err != nil {
+		return
+	}
+	if *ch.uptodate {
+		ch.mut.Unlock()
+		messageCacheRequests.WithLabelValues("hit").Inc()
+		return c.db.MessageIndex(ctx, chID, m)
+	}
+	messageCacheRequests.WithLabelValues("miss").Inc()
+	c.messages(ch, chID, func(msgs []discord.Message, full bool, e error) (done bool) {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return true
+		default:
+		}
+		if e != nil {
+			err = e
+			return true
+		}
+		i := sort.Search(len(msgs), func(i int) bool {
+			return msgs[i].ID >= m
+		})
+		if i == len(msgs) && !full {
+			return false
+		}
+		index = uint(i)
+		found = i < len(msgs) && msgs[i].ID == m
+		return true
+	}, nil)
+	return
+}
+
+// Backfill loads the messages of a post into the database unless they are
+// already there and up to date, calling wait before every request to
+// Discord. It reports whether the messages had to be loaded.
+func (c *messageCache) Backfill(ctx context.Context, chID discord.ChannelID, wait func() error) (loaded bool, err error) {
+	ch, err := c.channel(chID)
+	if err != nil {
+		return false, err
+	}
+	if *ch.uptodate {
+		ch.mut.Unlock()
+		return false, nil
+	}
+	c.messages(ch, chID, func(_ []discord.Message, full bool, e error) (done bool) {
+		err = e
+		return full || e != nil
+	}, wait)
+	return true, err
+}
+
+func (c *messageCache) messages(ch *channel, chid discord.ChannelID, fn fetchCallback, wait func() error) {
 	done := make(chan struct{})
 	wrapped := func(msgs []discord.Message, good bool, err error) bool {
 		found := fn(msgs, good, err)
@@ -365,13 +655,18 @@ func (c *messageCache) messages(ch *channel, chid discord.ChannelID, fn fetchCal
 	ch.fetchCallbacks = callbacks
 	ch.mut.Unlock()
 	go func() {
-		msgs, err := load(c.st.Client, chid, callbacks)
+		messageLoads.Inc()
+		msgs, err := load(c.st.Client, chid, callbacks, wait)
 		ch.mut.Lock()
 		close(fetchdone)
-		err = c.db.UpdateMessages(context.Background(), chid, msgs)
-		if err != nil {
-			// TODO(samhza): handle this better
-			log.Println("updating messages:", err)
+		// Only store complete posts, as they are treated as up to date
+		// from then on.
+		if err == nil {
+			err = c.db.UpdateMessages(context.Background(), chid, msgs)
+			if err != nil {
+				// TODO(samhza): handle this better
+				log.Println("updating messages:", err)
+			}
 		}
 		ch.fetchCallbacks = nil
 		ch.fetchDone = nil
@@ -392,7 +687,9 @@ func (c *messageCache) messages(ch *channel, chid discord.ChannelID, fn fetchCal
 	return
 }
 
-func load(client *api.Client, chanID discord.ChannelID, callbackchan <-chan fetchCallback) ([]discord.Message, error) {
+// load fetches all the messages of a channel. If wait isn't nil, it is called
+// before every request, and loading stops if it returns an error.
+func load(client *api.Client, chanID discord.ChannelID, callbackchan <-chan fetchCallback, wait func() error) ([]discord.Message, error) {
 	var after discord.MessageID
 	var err error
 	var msgs []discord.Message
@@ -401,6 +698,12 @@ func load(client *api.Client, chanID discord.ChannelID, callbackchan <-chan fetc
 		var m []discord.Message
 		done := make(chan struct{})
 		go func() {
+			if wait != nil {
+				if err = wait(); err != nil {
+					done <- struct{}{}
+					return
+				}
+			}
 			m, err = client.MessagesAfter(chanID, after, 100)
 			done <- struct{}{}
 		}()
@@ -416,6 +719,9 @@ func load(client *api.Client, chanID discord.ChannelID, callbackchan <-chan fetc
 			}
 		}
 		if err != nil {
+			for _, f := range callbacks {
+				f(msgs, false, err)
+			}
 			break
 		}
 		for i, j := 0, len(m)-1; i < j; i, j = i+1, j-1 {
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"html/template"
+	"net/url"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+)
+
+// Embed is a rich, link or article embed, as it is shown below a message.
+// Image, video and GIF embeds are shown as MediaPreviews instead.
+type Embed struct {
+	// Color is the CSS color of the side bar, which is empty for the
+	// default one.
+	Color       string        `json:"color,omitempty"`
+	Provider    string        `json:"provider,omitempty"`
+	Author      *EmbedAuthor  `json:"author,omitempty"`
+	Title       string        `json:"title,omitempty"`
+	URL         template.URL  `json:"url,omitempty"`
+	Description template.HTML `json:"description,omitempty"`
+	Fields      []EmbedField  `json:"fields,omitempty"`
+	Image       *MediaPreview `json:"image,omitempty"`
+	Thumbnail   template.URL  `json:"thumbnail,omitempty"`
+	Footer      *EmbedFooter  `json:"footer,omitempty"`
+}
+
+type EmbedAuthor struct {
+	Name string       `json:"name"`
+	URL  template.URL `json:"url,omitempty"`
+	Icon template.URL `json:"icon,omitempty"`
+}
+
+type EmbedField struct {
+	Name   string        `json:"name"`
+	Value  template.HTML `json:"value"`
+	Inline bool          `json:"inline,omitempty"`
+}
+
+type EmbedFooter struct {
+	Text      string            `json:"text,omitempty"`
+	Icon      template.URL      `json:"icon,omitempty"`
+	Timestamp discord.Timestamp `json:"timestamp,omitempty"`
+}
+
+// isRichEmbed reports whether e is shown as an Embed.
+func isRichEmbed(e discord.Embed) bool {
+	switch e.Type {
+	case discord.NormalEmbed, discord.LinkEmbed, discord.ArticleEmbed:
+		return true
+	}
+	return false
+}
+
+// embed massages an embed of m into an Embed. Its description and fields are
+// rendered as markdown like message contents.
+func (s *server) embed(m discord.Message, e discord.Embed) Embed {
+	embed := Embed{
+		Title:       e.Title,
+		URL:         safeURL(string(e.URL)),
+		Description: s.renderMarkdown(m, e.Description),
+	}
+	if e.Color != 0 && e.Color != discord.NullColor {
+		embed.Color = e.Color.String()
+	}
+	if e.Provider != nil {
+		embed.Provider = e.Provider.Name
+	}
+	if e.Author != nil && e.Author.Name != "" {
+		embed.Author = &EmbedAuthor{
+			Name: e.Author.Name,
+			URL:  safeURL(string(e.Author.URL)),
+			Icon: s.proxiedURL(e.Author.ProxyIcon, e.Author.Icon),
+		}
+	}
+	for _, f := range e.Fields {
+		embed.Fields = append(embed.Fields, EmbedField{
+			Name:   f.Name,
+			Value:  s.renderMarkdown(m, f.Value),
+			Inline: f.Inline,
+		})
+	}
+	if e.Image != nil {
+		if thumb := s.proxiedURL(e.Image.Proxy, e.Image.URL); thumb != "" {
+			embed.Image = &MediaPreview{
+				Thumbnail: thumb,
+				URL:       safeURL(string(e.Image.URL)),
+			}
+		}
+	}
+	if e.Thumbnail != nil {
+		embed.Thumbnail = s.proxiedURL(e.Thumbnail.Proxy, e.Thumbnail.URL)
+	}
+	if e.Footer != nil || e.Timestamp.IsValid() {
+		embed.Footer = &EmbedFooter{Timestamp: e.Timestamp}
+		if e.Footer != nil {
+			embed.Footer.Text = e.Footer.Text
+			embed.Footer.Icon = s.proxiedURL(e.Footer.ProxyIcon, e.Footer.Icon)
+		}
+	}
+	return embed
+}
+
+// safeURL returns u if it is an http or https URL, and "" otherwise, so that
+// embeds can't link to javascript: and the like.
+func safeURL(u string) template.URL {
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return ""
+	}
+	return template.URL(u)
+}
+
+// proxiedURL returns the URL of an image through Discord's media proxy if
+// there is one, so that visitors don't load images from arbitrary sites, and
+// through dforum's own if it is enabled.
+func (s *server) proxiedURL(proxy, direct discord.URL) template.URL {
+	if u := safeURL(string(proxy)); u != "" {
+		return template.URL(s.media.URL(string(u)))
+	}
+	return safeURL(string(direct))
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/utils/httputil/httpdriver"
+)
+
+// exporter writes a static copy of the site into a directory, with links
+// between pages made relative so that it can be served from anywhere.
+type exporter struct {
+	s   *server
+	dir string
+	// url is the URL the export is going to be served at.
+	url     string
+	sitemap *sitemapWriter
+	pages   int
+	// media holds the files in the export of the media copied from the
+	// media cache, by link.
+	media map[string]string
+}
+
+// exportSite renders the pages of guildID, or of all guilds if it is 0, into
+// dir along with the static files and a sitemap. It only uses what is stored
+// in the database, see loadStored.
+//
+// Every page of a forum and of a post gets its own file, as query strings
+// can't be used. Links to pages that aren't exported, like search and feeds,
+// point to the live site instead, and so do links to media that isn't in
+// the media cache.
+func (s *server) exportSite(ctx context.Context, dir, baseURL string, guildID discord.GuildID) (pages int, err error) {
+	sitemap, err := newSitemapWriter(dir, "sitemap")
+	if err != nil {
+		return 0, err
+	}
+	defer sitemap.abort()
+	e := &exporter{s: s, dir: dir, url: baseURL, sitemap: sitemap, media: make(map[string]string)}
+	if err := e.copyStatic(); err != nil {
+		return 0, fmt.Errorf("copying static files: %w", err)
+	}
+
+	guilds, err := s.discord.Cabinet.Guilds()
+	if err != nil {
+		return 0, err
+	}
+	var exported int
+	for i, guild := range guilds {
+		if guildID.IsValid() && guild.ID != guildID {
+			continue
+		}
+		if err := e.guild(ctx, &guilds[i]); err != nil {
+			return e.pages, fmt.Errorf("exporting guild %s: %w", guild.ID, err)
+		}
+		exported++
+	}
+	if guildID.IsValid() && exported == 0 {
+		return 0, fmt.Errorf("guild %s is not stored in the database", guildID)
+	}
+
+	index := struct {
+		GuildCount int
+		URL        string
+	}{exported, baseURL}
+	if err := e.page("/", "index.gohtml", index, nil); err != nil {
+		return e.pages, err
+	}
+	tos := struct {
+		ServiceName    string
+		ServerHostedIn string
+	}{s.ServiceName, s.ServerHostedIn}
+	if err := e.page("/tos", "tos.gohtml", tos, nil); err != nil {
+		return e.pages, err
+	}
+	if err := e.page("/privacy", "privacy.gohtml", nil, nil); err != nil {
+		return e.pages, err
+	}
+	files, err := sitemap.Close()
+	if err != nil {
+		return e.pages, err
+	}
+	return e.pages, writeSitemapIndex(dir, baseURL, files)
+}
+
+func (e *exporter) guild(ctx context.Context, guild *discord.Guild) error {
+	channels, err := e.s.discord.Cabinet.Channels(guild.ID)
+	if err != nil {
+		return fmt.Errorf("loading channels: %w", err)
+	}
+	forums, err := e.s.forumChannels(guild, channels)
+	if err != nil {
+		return err
+	}
+	guildPath := fmt.Sprintf("/%s", guild.ID)
+	if err := e.page(guildPath, "guild.gohtml", guildPage{guild, forums, e.url}, nil); err != nil {
+		return err
+	}
+	var lastmod time.Time
+	for _, forum := range forums {
+		if t := postsLastMod(forum.ID, 0, channels); t.After(lastmod) {
+			lastmod = t
+		}
+	}
+	if err := e.addToSitemap(guildPath, lastmod); err != nil {
+		return err
+	}
+	for i := range forums {
+		forum := &forums[i].Channel
+		if forum.NSFW {
+			err := e.page(fmt.Sprintf("/%s/%s", guild.ID, forum.ID), "error.gohtml", errorPage{
+				errors.New("NSFW content is not served"),
+				http.StatusText(http.StatusForbidden), http.StatusForbidden,
+			}, nil)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err := e.forum(ctx, guild, forum, channels); err != nil {
+			return fmt.Errorf("exporting forum %s: %w", forum.ID, err)
+		}
+	}
+	return nil
+}
+
+func (e *exporter) forum(ctx context.Context, guild *discord.Guild, forum *discord.Channel, channels []discord.Channel) error {
+	filters := []tagFilter{{}}
+	for _, tag := range forum.AvailableTags {
+		filters = append(filters, tagFilter{Tags: []discord.TagID{tag.ID}, route: true})
+	}
+	for _, filter := range filters {
+		for page := 1; ; page++ {
+			fp := e.s.forumPage(guild, forum, channels, filter, page)
+			fp.URL = e.url
+			if err := e.page(pagePath(fp.PageBase, page), "forum.gohtml", fp, nil); err != nil {
+				return err
+			}
+			if page == 1 {
+				var tag discord.TagID
+				if len(filter.Tags) > 0 {
+					tag = filter.Tags[0]
+				}
+				if err := e.addToSitemap(fp.PageBase, postsLastMod(forum.ID, tag, channels)); err != nil {
+					return err
+				}
+			}
+			if fp.Next == 0 {
+				break
+			}
+		}
+	}
+	for _, post := range forumThreads(forum.ID, channels) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		post := post
+		if err := e.post(ctx, guild, forum, &post); err != nil {
+			return fmt.Errorf("exporting post %s: %w", post.ID, err)
+		}
+	}
+	return nil
+}
+
+// post exports the pages of post, with the messages stored in the database.
+func (e *exporter) post(ctx context.Context, guild *discord.Guild, forum, post *discord.Channel) error {
+	base := fmt.Sprintf("/%s/%s/%s", guild.ID, forum.ID, post.ID)
+	var after discord.MessageID
+	for page := 1; ; page++ {
+		msgs, hasbefore, err := e.s.db.MessagesAfter(ctx, post.ID, after, messagesPerPage+1)
+		if err != nil {
+			return fmt.Errorf("loading messages: %w", err)
+		}
+		hasafter := len(msgs) > messagesPerPage
+		if hasafter {
+			msgs = msgs[:messagesPerPage]
+		}
+		pp, err := e.s.postPage(ctx, guild, forum, post, msgs, hasbefore, hasafter)
+		if err != nil {
+			return err
+		}
+		pp.URL = e.url
+		// post.gohtml links to the pages before and after by message.
+		links := make(map[string]string)
+		if pp.Prev.IsValid() {
+			links["?before="+pp.Prev.String()] = pagePath(base, page-1)
+		}
+		if pp.Next.IsValid() {
+			links["?after="+pp.Next.String()] = pagePath(base, page+1)
+		}
+		if err := e.page(pagePath(base, page), "post.gohtml", pp, links); err != nil {
+			return err
+		}
+		if page == 1 {
+			if err := e.addToSitemap(base, threadLastMod(post)); err != nil {
+				return err
+			}
+		}
+		if !hasafter {
+			return nil
+		}
+		after = msgs[len(msgs)-1].ID
+	}
+}
+
+// pagePath returns the path of the given page of the forum or post at base.
+func pagePath(base string, page int) string {
+	if page <= 1 {
+		return base
+	}
+	return fmt.Sprintf("%s/page/%d", base, page)
+}
+
+func (e *exporter) addToSitemap(p string, lastmod time.Time) error {
+	return e.sitemap.Add(e.url+p+"/", lastmod)
+}
+
+// page executes the template name with data and writes it to the file for
+// the page at p. links maps links in the page to the paths of the pages they
+// stand for.
+func (e *exporter) page(p, name string, data any, links map[string]string) error {
+	file, ok := exportFile(p)
+	if !ok {
+		return fmt.Errorf("%s can't be exported", p)
+	}
+	var buf bytes.Buffer
+	if err := e.s.executeTemplateFn(&buf, name, data); err != nil {
+		return fmt.Errorf("rendering %s: %w", p, err)
+	}
+	html := linkAttr.ReplaceAllFunc(buf.Bytes(), func(attr []byte) []byte {
+		m := linkAttr.FindSubmatch(attr)
+		link := string(m[3])
+		// Forms send queries, which only the live site can answer.
+		if bytes.Contains(m[1], []byte("action")) {
+			if strings.HasPrefix(link, "/") && !strings.HasPrefix(link, "//") {
+				link = e.s.URL + link
+			}
+		} else {
+			link = e.relink(file, link, links)
+		}
+		return []byte(string(m[1]) + string(m[2]) + link + string(m[2]))
+	})
+	full := filepath.Join(e.dir, filepath.FromSlash(file))
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(full, html, 0644); err != nil {
+		return err
+	}
+	e.pages++
+	if e.pages%1000 == 0 {
+		log.Printf("Exported %d pages", e.pages)
+	}
+	return nil
+}
+
+// linkAttr matches the attributes of HTML elements that link to other pages
+// or files.
+var linkAttr = regexp.MustCompile(`(\s(?:href|src|action)=)(["'])([^"']*)["']`)
+
+// relink returns link as seen from the exported file from.
+func (e *exporter) relink(from, link string, links map[string]string) string {
+	if to, ok := links[link]; ok {
+		link = to
+	}
+	if file, ok := e.copyMedia(link); ok {
+		return relativeLink(from, file, link)
+	}
+	if !strings.HasPrefix(link, "/") || strings.HasPrefix(link, "//") {
+		return link
+	}
+	file, ok := exportFile(link)
+	if !ok {
+		return e.s.URL + link
+	}
+	return relativeLink(from, file, e.s.URL+link)
+}
+
+// relativeLink returns the link to file from the file from, or fallback if
+// there is none.
+func relativeLink(from, file, fallback string) string {
+	rel, err := filepath.Rel(filepath.Dir(filepath.FromSlash(from)), filepath.FromSlash(file))
+	if err != nil {
+		return fallback
+	}
+	return filepath.ToSlash(rel)
+}
+
+// copyMedia copies the media that link to the media proxy stands for from
+// the media cache into the export, and returns the file it is copied to.
+// It returns false if link isn't to the media proxy or the media isn't
+// cached.
+func (e *exporter) copyMedia(link string) (string, bool) {
+	if e.s.mediaProxy == nil {
+		return "", false
+	}
+	if file, ok := e.media[link]; ok {
+		return file, file != ""
+	}
+	file, err := e.copyMediaFile(link)
+	if err != nil {
+		log.Printf("Exporting media %s: %v", link, err)
+	}
+	e.media[link] = file
+	return file, file != ""
+}
+
+func (e *exporter) copyMediaFile(link string) (string, error) {
+	// links in attributes are escaped
+	u, err := url.Parse(html.UnescapeString(strings.TrimPrefix(link, e.s.media.base)))
+	if err != nil || u.Scheme != "" || u.Host != "" || !strings.HasPrefix(u.Path, "/media/") {
+		return "", nil
+	}
+	p := strings.TrimPrefix(u.Path, "/media/")
+	query := u.Query()
+	if !e.s.media.verify(p, query) {
+		return "", nil
+	}
+	key := mediaKey(p, query)
+	f, contentType, err := e.s.mediaProxy.cache.Open(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	file := "media/" + hashString([]byte(key))[:32] + mediaExtension(contentType)
+	full := filepath.Join(e.dir, filepath.FromSlash(file))
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return "", err
+	}
+	dst, err := os.Create(full)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(dst, f); err != nil {
+		dst.Close()
+		return "", err
+	}
+	return file, dst.Close()
+}
+
+// mediaExtensions are the file extensions of the kinds of media that can be
+// shown, which static file servers go by.
+var mediaExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"image/avif": ".avif",
+	"video/mp4":  ".mp4",
+	"video/webm": ".webm",
+	"audio/mpeg": ".mp3",
+	"audio/ogg":  ".ogg",
+	"audio/wav":  ".wav",
+}
+
+// mediaExtension returns the file extension to export media of contentType
+// with. Other kinds of media get none, so that they are downloaded rather
+// than shown, like the media proxy does.
+func mediaExtension(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaExtensions[mediaType]
+}
+
+// exportFile returns the file in the export that the page or file at p is
+// written to, and false if it isn't exported.
+func exportFile(p string) (string, bool) {
+	switch {
+	case p == "/":
+		return "index.html", true
+	case p == "/tos" || p == "/privacy":
+		return p[1:] + "/index.html", true
+	case p == "/sitemap.xml":
+		return "sitemap.xml", true
+	case strings.HasPrefix(p, "/static/") && !strings.ContainsAny(p, "?#"):
+		return path.Clean(p)[1:], true
+	case strings.ContainsAny(p, "?#"):
+		return "", false
+	}
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	// The further pages of forums and posts. The first page is the base.
+	if n := len(parts); n >= 4 && parts[n-2] == "page" && isID(parts[n-1]) {
+		if n-2 < 2 || !isExportedBase(parts[:n-2]) {
+			return "", false
+		}
+		if parts[n-1] == "1" {
+			parts = parts[:n-2]
+		}
+	} else if !isExportedBase(parts) {
+		return "", false
+	}
+	return strings.Join(parts, "/") + "/index.html", true
+}
+
+// isExportedBase reports whether parts is the path of a guild, forum, tag
+// or post page.
+func isExportedBase(parts []string) bool {
+	switch len(parts) {
+	case 1, 2, 3:
+		for _, part := range parts {
+			if !isID(part) {
+				return false
+			}
+		}
+		return true
+	case 4:
+		return isID(parts[0]) && isID(parts[1]) && parts[2] == "tag" && isID(parts[3])
+	}
+	return false
+}
+
+func isID(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *exporter) copyStatic() error {
+	return fs.WalkDir(e.s.fsys, "static", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(e.dir, filepath.FromSlash(p))
+		if d.IsDir() {
+			return os.MkdirAll(dst, 0755)
+		}
+		b, err := fs.ReadFile(e.s.fsys, p)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(dst, b, 0644)
+	})
+}
+
+// loadStored fills the state with the guilds, channels and members stored in
+// the database, without connecting to Discord. Requests to Discord fail from
+// then on, so that nothing else is loaded by accident.
+func (s *server) loadStored(token string) error {
+	s.discord.Client.Client.Client = offlineClient{}
+	if err := s.discord.Cabinet.Reset(); err != nil {
+		return fmt.Errorf("loading state from the database: %w", err)
+	}
+	id, err := tokenUserID(token)
+	if err != nil {
+		return err
+	}
+	return s.discord.Cabinet.MyselfSet(discord.User{ID: id}, false)
+}
+
+// tokenUserID returns the ID of the bot a token belongs to, which is encoded
+// in the token's first part.
+func tokenUserID(token string) (discord.UserID, error) {
+	first, _, _ := strings.Cut(strings.TrimPrefix(token, "Bot "), ".")
+	b, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(first, "="))
+	if err != nil {
+		return 0, fmt.Errorf("bot token is malformed: %w", err)
+	}
+	sf, err := discord.ParseSnowflake(string(b))
+	if err != nil || !sf.IsValid() {
+		return 0, errors.New("bot token is malformed: no user ID")
+	}
+	return discord.UserID(sf), nil
+}
+
+var errOffline = errors.New("not connected to Discord")
+
+// offlineClient is an HTTP client that fails every request.
+type offlineClient struct{}
+
+func (offlineClient) NewRequest(context.Context, string, string) (httpdriver.Request, error) {
+	return nil, errOffline
+}
+
+func (offlineClient) Do(httpdriver.Request) (httpdriver.Response, error) {
+	return nil, errOffline
+}
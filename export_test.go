@@ -0,0 +1,45 @@
+package main
+
+import (
+	"html"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/IoIxD/dforum/database"
+	"github.com/diamondburned/arikawa/v3/state"
+)
+
+func TestExportMedia(t *testing.T) {
+	srv, err := newServer(state.New("Bot x"), os.DirFS("resources"), database.NewMemory(), config{
+		BotToken:       "x",
+		SiteURL:        "https://dforum.example",
+		MediaCacheDir:  t.TempDir(),
+		MediaCacheSize: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	e := &exporter{s: srv, dir: dir, media: make(map[string]string)}
+	cached := srv.media.URL("https://cdn.discordapp.com/attachments/1/2/a.png?ex=1&is=2&hm=3&width=10&height=10")
+	if err := srv.mediaProxy.cache.Put(mediaKey("attachments/1/2/a.png", url.Values{"width": {"10"}, "height": {"10"}}), "image/png", []byte("png")); err != nil {
+		t.Fatal(err)
+	}
+	// links are escaped in the pages
+	link := e.relink("1/2/3/index.html", html.EscapeString(cached), nil)
+	if !strings.HasPrefix(link, "../../../media/") || !strings.HasSuffix(link, ".png") {
+		t.Fatalf("cached media is linked as %q", link)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "1/2/3", filepath.FromSlash(link)))
+	if err != nil || string(b) != "png" {
+		t.Errorf("exported media holds %q, %v", b, err)
+	}
+
+	uncached := html.EscapeString(srv.media.URL("https://cdn.discordapp.com/avatars/1/a.png"))
+	if link := e.relink("index.html", uncached, nil); link != uncached {
+		t.Errorf("media that isn't cached is linked as %q, want %q", link, uncached)
+	}
+}
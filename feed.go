@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+)
+
+// feedLength is the number of entries in a feed.
+const feedLength = 25
+
+// feed is a format-neutral feed, written out as Atom or RSS depending on the
+// extension of the requested URL.
+type feed struct {
+	Title   string
+	URL     string
+	FeedURL string
+	Updated time.Time
+	Entries []feedEntry
+}
+
+type feedEntry struct {
+	Title      string
+	URL        string
+	Author     string
+	Published  time.Time
+	Updated    time.Time
+	Content    template.HTML
+	Categories []string
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Link       atomLink       `xml:"link"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Author     *atomPerson    `xml:"author,omitempty"`
+	Categories []atomCategory `xml:"category"`
+	Content    *atomText      `xml:"content,omitempty"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	GUID        string   `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Categories  []string `xml:"category"`
+	Description string   `xml:"description,omitempty"`
+}
+
+func (f feed) atom() atomFeed {
+	atom := atomFeed{
+		Title:   f.Title,
+		ID:      f.FeedURL,
+		Updated: f.Updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: f.URL, Rel: "alternate", Type: "text/html"},
+			{Href: f.FeedURL, Rel: "self", Type: "application/atom+xml"},
+		},
+	}
+	for _, e := range f.Entries {
+		entry := atomEntry{
+			Title:     e.Title,
+			ID:        e.URL,
+			Link:      atomLink{Href: e.URL, Rel: "alternate", Type: "text/html"},
+			Published: e.Published.UTC().Format(time.RFC3339),
+			Updated:   e.Updated.UTC().Format(time.RFC3339),
+		}
+		if e.Author != "" {
+			entry.Author = &atomPerson{e.Author}
+		}
+		for _, c := range e.Categories {
+			entry.Categories = append(entry.Categories, atomCategory{c})
+		}
+		if e.Content != "" {
+			entry.Content = &atomText{Type: "html", Body: string(e.Content)}
+		}
+		atom.Entries = append(atom.Entries, entry)
+	}
+	return atom
+}
+
+func (f feed) rss() rssFeed {
+	rss := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:         f.Title,
+			Link:          f.URL,
+			Description:   f.Title,
+			LastBuildDate: f.Updated.UTC().Format(time.RFC1123Z),
+		},
+	}
+	for _, e := range f.Entries {
+		rss.Channel.Items = append(rss.Channel.Items, rssItem{
+			Title:       e.Title,
+			Link:        e.URL,
+			GUID:        e.URL,
+			PubDate:     e.Published.UTC().Format(time.RFC1123Z),
+			Categories:  e.Categories,
+			Description: string(e.Content),
+		})
+	}
+	return rss
+}
+
+// writeFeed writes f as RSS if the request is for a .rss URL, and as Atom
+// otherwise.
+func (s *server) writeFeed(w http.ResponseWriter, r *http.Request, f feed) {
+	if f.Updated.IsZero() {
+		for _, e := range f.Entries {
+			if e.Updated.After(f.Updated) {
+				f.Updated = e.Updated
+			}
+		}
+	}
+	if f.Updated.IsZero() {
+		f.Updated = time.Now()
+	}
+	f.FeedURL = s.URL + r.URL.Path
+	var v any
+	if strings.HasSuffix(r.URL.Path, ".rss") {
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		v = f.rss()
+	} else {
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		v = f.atom()
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		s.displayErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	buf.WriteByte('\n')
+	http.ServeContent(w, r, "", f.Updated, bytes.NewReader(buf.Bytes()))
+}
+
+// postEntries returns feed entries for the newest posts, each with its
+// starter message as content.
+func (s *server) postEntries(ctx context.Context, guild *discord.Guild, posts []Post) []feedEntry {
+	sort.SliceStable(posts, func(i, j int) bool {
+		return posts[i].ID > posts[j].ID
+	})
+	if len(posts) > feedLength {
+		posts = posts[:feedLength]
+	}
+	consentRoles := make(map[discord.ChannelID]discord.RoleID)
+	entries := make([]feedEntry, 0, len(posts))
+	for _, post := range posts {
+		entry := feedEntry{
+			Title:     post.Name,
+			URL:       fmt.Sprintf("%s/%s/%s/%s", s.URL, guild.ID, post.ParentID, post.ID),
+			Published: post.ID.Time(),
+			Updated:   post.ID.Time(),
+		}
+		if post.LastMessageID.IsValid() && post.LastMessageID.Time().After(entry.Updated) {
+			entry.Updated = post.LastMessageID.Time()
+		}
+		for _, tag := range post.Tags {
+			entry.Categories = append(entry.Categories, tag.Name)
+		}
+		role, ok := consentRoles[post.ParentID]
+		if !ok {
+			if forum, err := s.channel(post.ParentID); err == nil {
+				role, _ = s.consentRole(forum)
+			}
+			consentRoles[post.ParentID] = role
+		}
+		// Posts whose starter isn't stored yet are listed without
+		// content rather than asking Discord for it, which would make a
+		// request for every such post; the crawler stores it in time.
+		if starter := s.storedStarterMessage(ctx, post.Channel); starter != nil {
+			starter.GuildID = guild.ID
+			msgs := []discord.Message{*starter}
+			var err error
+			if role.IsValid() {
+				// whether the author has the role is only known if they
+				// are cached
+				err = s.ensureMembers(ctx, post.Channel, msgs)
+			}
+			var hidden map[discord.UserID]bool
+			if err == nil {
+				hidden, err = s.hiddenAuthors(ctx, guild.ID, msgs, role)
+			}
+			if err == nil && !hidden[starter.Author.ID] {
+				entry.Author = s.author(*starter).Name
+				entry.Content = s.renderContent(*starter)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// starterMessage returns the first message of a post, preferring the
+// database over asking Discord.
+func (s *server) starterMessage(ctx context.Context, post discord.Channel) *discord.Message {
+	if msg := s.storedStarterMessage(ctx, post); msg != nil {
+		return msg
+	}
+	// The starter message of a forum post shares the post's ID.
+	msg, err := s.discord.Message(post.ID, discord.MessageID(post.ID))
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+// storedStarterMessage returns the first message of a post if it is in the
+// database.
+func (s *server) storedStarterMessage(ctx context.Context, post discord.Channel) *discord.Message {
+	msgs, _, err := s.db.MessagesAfter(ctx, post.ID, 0, 1)
+	if err != nil || len(msgs) == 0 {
+		return nil
+	}
+	return &msgs[0]
+}
+
+func (s *server) getGuildFeed(w http.ResponseWriter, r *http.Request) {
+	guild, ok := s.guildFromReq(w, r)
+	if !ok {
+		return
+	}
+	channels, err := s.channels(guild.ID)
+	if err != nil {
+		s.displayErr(w, http.StatusInternalServerError,
+			fmt.Errorf("fetching guild channels: %w", err))
+		return
+	}
+	forums, err := s.visibleForums(guild, channels)
+	if err != nil {
+		s.displayErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	var posts []Post
+	for i, forum := range forums {
+		if forum.NSFW {
+			continue
+		}
+		posts = append(posts, forumPosts(&forums[i], channels, tagFilter{})...)
+	}
+	s.writeFeed(w, r, feed{
+		Title:   fmt.Sprintf("New posts on %s", guild.Name),
+		URL:     fmt.Sprintf("%s/%s", s.URL, guild.ID),
+		Entries: s.postEntries(r.Context(), guild, posts),
+	})
+}
+
+func (s *server) getForumFeed(w http.ResponseWriter, r *http.Request) {
+	guild, ok := s.guildFromReq(w, r)
+	if !ok {
+		return
+	}
+	forum, ok := s.forumFromReq(w, r)
+	if !ok {
+		return
+	}
+	filter, ok := s.tagFilterFromReq(w, r, forum)
+	if !ok {
+		return
+	}
+	channels, err := s.channels(guild.ID)
+	if err != nil {
+		s.displayErr(w, http.StatusInternalServerError,
+			fmt.Errorf("fetching guild threads: %w", err))
+		return
+	}
+	f := feed{
+		Title: fmt.Sprintf("New posts in the %s forum on %s", forum.Name, guild.Name),
+		URL:   fmt.Sprintf("%s/%s/%s", s.URL, guild.ID, forum.ID),
+	}
+	if tag := filter.Tag(forum); tag != nil {
+		f.Title = fmt.Sprintf("New %s posts in the %s forum on %s", tag.Name, forum.Name, guild.Name)
+		f.URL = fmt.Sprintf("%s/%s/%s/tag/%s", s.URL, guild.ID, forum.ID, tag.ID)
+	}
+	f.Entries = s.postEntries(r.Context(), guild, forumPosts(forum, channels, filter))
+	s.writeFeed(w, r, f)
+}
+
+func (s *server) getPostFeed(w http.ResponseWriter, r *http.Request) {
+	guild, ok := s.guildFromReq(w, r)
+	if !ok {
+		return
+	}
+	forum, ok := s.forumFromReq(w, r)
+	if !ok {
+		return
+	}
+	post, ok := s.postFromReq(w, r)
+	if !ok {
+		return
+	}
+	if forum.Type != discord.GuildForum || post.ParentID != forum.ID {
+		s.displayErr(w, http.StatusNotFound, nil)
+		return
+	}
+	msgs, _, _, err := s.messageCache.MessagesBefore(r.Context(), post.ID,
+		discord.MessageID(math.MaxInt64), feedLength)
+	if err != nil {
+		s.displayErr(w, http.StatusInternalServerError,
+			fmt.Errorf("fetching post's messages: %w", err))
+		return
+	}
+	if err := s.ensureMembers(r.Context(), *post, msgs); err != nil {
+		s.displayErr(w, http.StatusInternalServerError,
+			fmt.Errorf("fetching post's members: %w", err))
+		return
+	}
+	consentRole, err := s.consentRole(forum)
+	if err != nil {
+		s.displayErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	msgrps, err := s.messageGroups(r.Context(), guild.ID, msgs, consentRole)
+	if err != nil {
+		s.displayErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	var entries []feedEntry
+	for _, grp := range msgrps {
+		for _, msg := range grp.Messages {
+			title := fmt.Sprintf("Reply by %s", grp.Author.Name)
+			if grp.Hidden {
+				title = "Hidden reply"
+			}
+			if msg.ID == discord.MessageID(post.ID) {
+				title = post.Name
+			}
+			updated := msg.ID.Time()
+			if msg.EditedTimestamp.IsValid() {
+				updated = msg.EditedTimestamp.Time()
+			}
+			entries = append(entries, feedEntry{
+				Title:     title,
+				URL:       s.URL + messageURL(*post, msg.ID),
+				Author:    grp.Author.Name,
+				Published: msg.ID.Time(),
+				Updated:   updated,
+				Content:   msg.RenderedContent,
+			})
+		}
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	s.writeFeed(w, r, feed{
+		Title:   fmt.Sprintf("%s - %s", post.Name, guild.Name),
+		URL:     fmt.Sprintf("%s/%s/%s/%s", s.URL, guild.ID, forum.ID, post.ID),
+		Entries: entries,
+	})
+}
@@ -1,5 +1,7 @@
 package main
 
+import "html/template"
+
 var funcMap = map[string]any{
 	"TrimForMeta": TrimForMeta,
 }
@@ -11,3 +13,15 @@ func TrimForMeta(value string) string {
 	}
 	return value[:128] + "..."
 }
+
+// templateFuncs returns funcMap along with the functions that depend on
+// config. Media turns links to Discord's CDN into links to the media proxy.
+func templateFuncs(config config) template.FuncMap {
+	funcs := template.FuncMap{
+		"Media": newMediaURLs(config).URL,
+	}
+	for name, fn := range funcMap {
+		funcs[name] = fn
+	}
+	return funcs
+}
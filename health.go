@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/utils/ws"
+)
+
+const (
+	// gatewayDownAfter is how long the gateway may be disconnected before
+	// dforum is considered unhealthy rather than just reconnecting.
+	gatewayDownAfter = 5 * time.Minute
+	// sitemapStaleAfter is how old the sitemap may get before it is
+	// considered stale. It is normally rebuilt every sitemapInterval.
+	sitemapStaleAfter = 12 * time.Hour
+)
+
+// handleGatewayStatus keeps track of whether the gateway is connected.
+func (s *server) handleGatewayStatus(ev interface{}) {
+	switch ev := ev.(type) {
+	case *gateway.ReadyEvent, *gateway.ResumedEvent:
+		s.gatewayMu.Lock()
+		s.gatewayConnected = true
+		s.gatewayChanged = time.Now()
+		s.gatewayErr = nil
+		s.gatewayMu.Unlock()
+	case *ws.CloseEvent:
+		s.gatewayMu.Lock()
+		if s.gatewayConnected {
+			s.gatewayChanged = time.Now()
+		}
+		s.gatewayConnected = false
+		s.gatewayErr = ev.Err
+		s.gatewayMu.Unlock()
+	}
+}
+
+type healthReport struct {
+	Status   string         `json:"status"`
+	Problems []string       `json:"problems,omitempty"`
+	Gateway  gatewayHealth  `json:"gateway"`
+	Database databaseHealth `json:"database"`
+	Sitemap  sitemapHealth  `json:"sitemap"`
+	Backfill backfillHealth `json:"backfill"`
+	Crawler  *crawlProgress `json:"crawler,omitempty"`
+
+	// down is set when restarting dforum might help, as opposed to it
+	// only being degraded.
+	down bool
+}
+
+type gatewayHealth struct {
+	Connected     bool       `json:"connected"`
+	Since         time.Time  `json:"since"`
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty"`
+	LastAck       *time.Time `json:"last_heartbeat_ack,omitempty"`
+	LatencyMillis int64      `json:"latency_ms"`
+	Error         string     `json:"error,omitempty"`
+}
+
+type databaseHealth struct {
+	OK            bool   `json:"ok"`
+	LatencyMillis int64  `json:"latency_ms"`
+	Error         string `json:"error,omitempty"`
+}
+
+type sitemapHealth struct {
+	GeneratedAt *time.Time `json:"generated_at"`
+	AgeSeconds  int64      `json:"age_seconds,omitempty"`
+	Stale       bool       `json:"stale"`
+}
+
+type backfillHealth struct {
+	// Forums is the number of forums in all guilds, and ForumsFetched how
+	// many of them have had their archived posts fetched.
+	Forums        int `json:"forums"`
+	ForumsFetched int `json:"forums_fetched"`
+	// PostsLoaded is the number of posts whose messages have been looked at
+	// since startup.
+	PostsLoaded int `json:"posts_loaded"`
+}
+
+func (h *healthReport) problem(down bool, problem string) {
+	h.Problems = append(h.Problems, problem)
+	h.down = h.down || down
+}
+
+func (s *server) health(ctx context.Context) healthReport {
+	var h healthReport
+
+	s.gatewayMu.Lock()
+	h.Gateway.Connected = s.gatewayConnected
+	h.Gateway.Since = s.gatewayChanged
+	if s.gatewayErr != nil {
+		h.Gateway.Error = s.gatewayErr.Error()
+	}
+	s.gatewayMu.Unlock()
+	if gw := s.discord.Gateway(); gw != nil {
+		if sent := gw.SentBeat(); !sent.IsZero() {
+			h.Gateway.LastHeartbeat = &sent
+		}
+		if echo := gw.EchoBeat(); !echo.IsZero() {
+			h.Gateway.LastAck = &echo
+		}
+		if lat := gw.Latency(); lat > 0 {
+			h.Gateway.LatencyMillis = lat.Milliseconds()
+		}
+	}
+	switch {
+	case !s.discord.GatewayIsAlive():
+		h.problem(true, "gateway has stopped")
+	case !h.Gateway.Connected && time.Since(h.Gateway.Since) > gatewayDownAfter:
+		h.problem(true, "gateway has been disconnected for too long")
+	case !h.Gateway.Connected:
+		h.problem(false, "gateway is reconnecting")
+	}
+
+	pingctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	start := time.Now()
+	err := s.db.Ping(pingctx)
+	cancel()
+	h.Database.LatencyMillis = time.Since(start).Milliseconds()
+	if err != nil {
+		h.Database.Error = err.Error()
+		h.problem(false, "database is unreachable")
+	} else {
+		h.Database.OK = true
+	}
+
+	stat, err := os.Stat(filepath.Join(s.SitemapDir, "sitemap.xml"))
+	if err == nil {
+		generated := stat.ModTime()
+		h.Sitemap.GeneratedAt = &generated
+		h.Sitemap.AgeSeconds = int64(time.Since(generated).Seconds())
+		h.Sitemap.Stale = time.Since(generated) > sitemapStaleAfter
+	} else if errors.Is(err, os.ErrNotExist) {
+		h.Sitemap.Stale = time.Since(s.startedAt) > sitemapStaleAfter
+	}
+	if h.Sitemap.Stale {
+		h.problem(false, "sitemap is stale")
+	}
+
+	guilds, _ := s.discord.Cabinet.Guilds()
+	s.fetchedInactiveMu.Lock()
+	for _, guild := range guilds {
+		channels, _ := s.discord.Cabinet.Channels(guild.ID)
+		for _, ch := range channels {
+			if ch.Type != discord.GuildForum {
+				continue
+			}
+			h.Backfill.Forums++
+			if _, ok := s.fetchedInactive[ch.ID]; ok {
+				h.Backfill.ForumsFetched++
+			}
+		}
+	}
+	s.fetchedInactiveMu.Unlock()
+	s.messageCache.channels.Range(func(_, _ any) bool {
+		h.Backfill.PostsLoaded++
+		return true
+	})
+
+	if s.crawlWorkers > 0 && s.crawlRate > 0 {
+		p := s.crawlProgress()
+		h.Crawler = &p
+	}
+
+	switch {
+	case h.down:
+		h.Status = "down"
+	case len(h.Problems) > 0:
+		h.Status = "degraded"
+	default:
+		h.Status = "ok"
+	}
+	return h
+}
+
+// getHealthz reports whether dforum is alive, failing only when it has
+// stopped working in a way that restarting it could fix.
+func (s *server) getHealthz(w http.ResponseWriter, r *http.Request) {
+	h := s.health(r.Context())
+	status := http.StatusOK
+	if h.down {
+		status = http.StatusServiceUnavailable
+	}
+	s.writeHealth(w, r, status, h)
+}
+
+// getReadyz reports whether dforum is fully working, failing when it is
+// degraded in any way.
+func (s *server) getReadyz(w http.ResponseWriter, r *http.Request) {
+	h := s.health(r.Context())
+	status := http.StatusOK
+	if h.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	s.writeHealth(w, r, status, h)
+}
+
+func (s *server) writeHealth(w http.ResponseWriter, r *http.Request, status int, h healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		json.NewEncoder(w).Encode(h)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+)
+
+const (
+	defaultIndexNowEndpoint = "https://api.indexnow.org/indexnow"
+	// indexNowInterval is how long URLs are collected before they are
+	// submitted together, which is also the most often a request is made.
+	indexNowInterval = 5 * time.Minute
+	// indexNowResubmitAfter is how long a URL isn't submitted again after it
+	// was, however often its post changes.
+	indexNowResubmitAfter = time.Hour
+	// indexNowMaxURLs is how many URLs IndexNow accepts in one request.
+	indexNowMaxURLs = 10000
+)
+
+var indexNowKeyPattern = regexp.MustCompile(`^[a-zA-Z0-9-]{8,128}$`)
+
+// indexNow submits the URLs of new and updated posts to search engines
+// through IndexNow, so that they don't have to wait for the sitemap to be
+// crawled.
+type indexNow struct {
+	endpoint    string
+	key         string
+	keyLocation string
+	host        string
+	client      *http.Client
+
+	mu sync.Mutex
+	// pending holds the URLs to submit with the next request, and submitted
+	// when the URLs submitted recently were.
+	pending   map[string]struct{}
+	submitted map[string]time.Time
+}
+
+func newIndexNow(endpoint, key, siteURL string) (*indexNow, error) {
+	if !indexNowKeyPattern.MatchString(key) {
+		return nil, errors.New("IndexNow key must be 8 to 128 letters, digits or dashes")
+	}
+	if endpoint == "" {
+		endpoint = defaultIndexNowEndpoint
+	}
+	if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("IndexNow endpoint is not an http:// or https:// URL: %q", endpoint)
+	}
+	site, err := url.Parse(siteURL)
+	if err != nil {
+		return nil, err
+	}
+	return &indexNow{
+		endpoint:    endpoint,
+		key:         key,
+		keyLocation: siteURL + indexNowKeyPath(key),
+		host:        site.Host,
+		client:      &http.Client{Timeout: 30 * time.Second},
+		pending:     make(map[string]struct{}),
+		submitted:   make(map[string]time.Time),
+	}, nil
+}
+
+// indexNowKeyPath is where the key file is served, which proves to search
+// engines that the submissions come from the site.
+func indexNowKeyPath(key string) string {
+	return "/" + key + ".txt"
+}
+
+func (n *indexNow) serveKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, n.key)
+}
+
+// Add queues u to be submitted, unless it already is or was submitted
+// recently.
+func (n *indexNow) Add(u string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if t, ok := n.submitted[u]; ok && time.Since(t) < indexNowResubmitAfter {
+		return
+	}
+	n.pending[u] = struct{}{}
+}
+
+// Run submits the queued URLs every indexNowInterval until ctx is done.
+func (n *indexNow) Run(ctx context.Context) {
+	ticker := time.NewTicker(indexNowInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		n.submitPending(ctx)
+	}
+}
+
+// submitPending submits as many queued URLs as fit in one request. If that
+// fails with an error that might go away, they are queued again.
+func (n *indexNow) submitPending(ctx context.Context) {
+	n.mu.Lock()
+	now := time.Now()
+	for u, t := range n.submitted {
+		if now.Sub(t) >= indexNowResubmitAfter {
+			delete(n.submitted, u)
+		}
+	}
+	urls := make([]string, 0, len(n.pending))
+	for u := range n.pending {
+		if len(urls) == indexNowMaxURLs {
+			break
+		}
+		urls = append(urls, u)
+		delete(n.pending, u)
+		n.submitted[u] = now
+	}
+	n.mu.Unlock()
+	if len(urls) == 0 {
+		return
+	}
+
+	retry, err := n.submit(ctx, urls)
+	if err == nil {
+		indexNowURLs.WithLabelValues("ok").Add(float64(len(urls)))
+		return
+	}
+	indexNowURLs.WithLabelValues("error").Add(float64(len(urls)))
+	log.Printf("Error submitting %d URLs to IndexNow: %v", len(urls), err)
+	if !retry {
+		return
+	}
+	n.mu.Lock()
+	for _, u := range urls {
+		delete(n.submitted, u)
+		n.pending[u] = struct{}{}
+	}
+	n.mu.Unlock()
+}
+
+func (n *indexNow) submit(ctx context.Context, urls []string) (retry bool, err error) {
+	body, err := json.Marshal(struct {
+		Host        string   `json:"host"`
+		Key         string   `json:"key"`
+		KeyLocation string   `json:"keyLocation"`
+		URLList     []string `json:"urlList"`
+	}{n.host, n.key, n.keyLocation, urls})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	switch {
+	case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusAccepted:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("%s", resp.Status)
+	default:
+		// the key or the URLs were rejected, which sending them again
+		// won't change
+		return false, fmt.Errorf("%s", resp.Status)
+	}
+}
+
+// handleIndexNow queues the post that an event creates or adds a message
+// to for submission.
+func (s *server) handleIndexNow(ev interface{}) {
+	var postID discord.ChannelID
+	switch ev := ev.(type) {
+	case *gateway.MessageCreateEvent:
+		postID = ev.ChannelID
+	case *gateway.ThreadCreateEvent:
+		postID = ev.ID
+	default:
+		return
+	}
+	post, err := s.discord.Cabinet.Channel(postID)
+	if err != nil || post.Type != discord.GuildPublicThread {
+		return
+	}
+	forum, err := s.discord.Cabinet.Channel(post.ParentID)
+	if err != nil || forum.Type != discord.GuildForum || forum.NSFW {
+		return
+	}
+	s.indexNow.Add(fmt.Sprintf("%s/%s/%s/%s", s.URL, post.GuildID, forum.ID, post.ID))
+}
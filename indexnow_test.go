@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/IoIxD/dforum/database"
+	"github.com/diamondburned/arikawa/v3/state"
+)
+
+const testIndexNowKey = "0123456789abcdef"
+
+// indexNowStandIn stands in for an IndexNow endpoint, answering with the
+// statuses in statuses in turn and then with 200 OK.
+type indexNowStandIn struct {
+	mu       sync.Mutex
+	statuses []int
+	// requests holds the URLs of each request.
+	requests [][]string
+}
+
+func (e *indexNowStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Host        string   `json:"host"`
+		Key         string   `json:"key"`
+		KeyLocation string   `json:"keyLocation"`
+		URLList     []string `json:"urlList"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil ||
+		body.Host != "dforum.example" || body.Key != testIndexNowKey ||
+		body.KeyLocation != "https://dforum.example/"+testIndexNowKey+".txt" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	sort.Strings(body.URLList)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.requests = append(e.requests, body.URLList)
+	status := http.StatusOK
+	if len(e.statuses) > 0 {
+		status, e.statuses = e.statuses[0], e.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+// submitted returns the URLs of the requests made since it was last called.
+func (e *indexNowStandIn) submitted() [][]string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	requests := e.requests
+	e.requests = nil
+	return requests
+}
+
+func newTestIndexNow(t *testing.T, statuses ...int) (*indexNow, *indexNowStandIn) {
+	standIn := &indexNowStandIn{statuses: statuses}
+	ts := httptest.NewServer(standIn)
+	t.Cleanup(ts.Close)
+	n, err := newIndexNow(ts.URL, testIndexNowKey, "https://dforum.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n, standIn
+}
+
+func checkSubmitted(t *testing.T, standIn *indexNowStandIn, want ...[]string) {
+	t.Helper()
+	got := standIn.submitted()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("submitted %v, want %v", got, want)
+	}
+}
+
+func TestIndexNowDedup(t *testing.T) {
+	ctx := context.Background()
+	n, standIn := newTestIndexNow(t)
+	n.Add("https://dforum.example/1/2/3")
+	n.Add("https://dforum.example/1/2/4")
+	n.Add("https://dforum.example/1/2/3")
+	n.submitPending(ctx)
+	checkSubmitted(t, standIn, []string{"https://dforum.example/1/2/3", "https://dforum.example/1/2/4"})
+
+	// submitted within indexNowResubmitAfter
+	n.Add("https://dforum.example/1/2/3")
+	n.submitPending(ctx)
+	checkSubmitted(t, standIn)
+}
+
+func TestIndexNowBatches(t *testing.T) {
+	ctx := context.Background()
+	n, standIn := newTestIndexNow(t)
+	for i := 0; i < indexNowMaxURLs+1; i++ {
+		n.Add(fmt.Sprintf("https://dforum.example/1/2/%d", i))
+	}
+	n.submitPending(ctx)
+	n.submitPending(ctx)
+	got := standIn.submitted()
+	if len(got) != 2 || len(got[0]) != indexNowMaxURLs || len(got[1]) != 1 {
+		var sizes []int
+		for _, urls := range got {
+			sizes = append(sizes, len(urls))
+		}
+		t.Errorf("submitted batches of %v URLs, want [%d 1]", sizes, indexNowMaxURLs)
+	}
+}
+
+func TestIndexNowRequeue(t *testing.T) {
+	ctx := context.Background()
+	urls := []string{"https://dforum.example/1/2/3"}
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusServiceUnavailable} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			n, standIn := newTestIndexNow(t, status)
+			n.Add(urls[0])
+			n.submitPending(ctx)
+			n.submitPending(ctx)
+			checkSubmitted(t, standIn, urls, urls)
+		})
+	}
+	// rejected URLs aren't sent again
+	n, standIn := newTestIndexNow(t, http.StatusForbidden)
+	n.Add(urls[0])
+	n.submitPending(ctx)
+	n.submitPending(ctx)
+	checkSubmitted(t, standIn, urls)
+}
+
+func TestIndexNowKeyFile(t *testing.T) {
+	srv, err := newServer(state.New("Bot x"), os.DirFS("resources"), database.NewMemory(), config{
+		SiteURL:     "https://dforum.example",
+		IndexNowKey: testIndexNowKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+testIndexNowKey+".txt", nil))
+	body, _ := io.ReadAll(rec.Result().Body)
+	if rec.Code != http.StatusOK || string(body) != testIndexNowKey {
+		t.Errorf("key file is %d %q, want 200 %q", rec.Code, body, testIndexNowKey)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"embed"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
@@ -12,14 +13,17 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/IoIxD/dforum/database"
+	"github.com/diamondburned/arikawa/v3/discord"
 	"github.com/diamondburned/arikawa/v3/gateway"
 	"github.com/diamondburned/arikawa/v3/state"
 	"github.com/diamondburned/arikawa/v3/utils/httputil/httpdriver"
 	"github.com/naoina/toml"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 //go:embed resources
@@ -36,105 +40,266 @@ type config struct {
 	ReloadTemplates  bool
 	TraceDiscordREST bool
 	Database         string
+	// The crawler stores the messages of every post ahead of time, with
+	// CrawlWorkers posts at once and at most CrawlRequestsPerSecond
+	// requests to Discord. It is disabled if either is 0.
+	CrawlWorkers           int
+	CrawlRequestsPerSecond float64
+	// Setting IndexNowKey submits new and updated posts to search engines
+	// through IndexNow, at IndexNowEndpoint if it is set.
+	IndexNowKey      string
+	IndexNowEndpoint string
+	// Setting MediaCacheDir serves attachments, avatars, emoji and stickers
+	// from the site rather than from Discord, caching at most
+	// MediaCacheSize megabytes of them in MediaCacheDir.
+	MediaCacheDir  string
+	MediaCacheSize int64
+	// Prometheus metrics are served at /metrics on the site, or on
+	// MetricsListenAddr if it is set. Setting DisableMetrics doesn't serve
+	// them at all.
+	MetricsListenAddr string
+	DisableMetrics    bool
 }
 
+// TraceClient records metrics about Discord REST requests, and logs them if
+// Log is set.
 type TraceClient struct {
 	httpdriver.Client
+	Log bool
 }
 
 func (c TraceClient) Do(req httpdriver.Request) (httpdriver.Response, error) {
 	then := time.Now()
 	resp, err := c.Client.Do(req)
-	log.Printf("Discord REST: %s in %s", req.GetPath(), time.Since(then))
+	took := time.Since(then)
+	path := discordPath(req.GetPath())
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.GetStatus())
+	}
+	discordRequests.WithLabelValues(path, status).Inc()
+	discordDuration.WithLabelValues(path).Observe(took.Seconds())
+	if c.Log {
+		log.Printf("Discord REST: %s in %s", req.GetPath(), took)
+	}
 	return resp, err
 }
 
 func main() {
 	cfgpath := flag.String("config", "config.toml", "path to config.toml")
+	flag.Usage = usage
 	flag.Parse()
-	file, err := os.ReadFile(*cfgpath)
+	name, args := "serve", flag.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	cmd := findSubcommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "dforum: unknown command %q\n", name)
+		flag.Usage()
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("dforum "+cmd.name, flag.ExitOnError)
+	fs.StringVar(cfgpath, "config", *cfgpath, "path to config.toml")
+	run := cmd.flags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: dforum %s [flags]\n\n%s\n\nflags:\n", cmd.name, cmd.help)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	config, err := loadConfig(*cfgpath)
 	if err != nil {
-		log.Fatalln("Error while reading config:", file)
+		log.Fatalln(err)
+	}
+
+	ctx, done := signal.NotifyContext(context.Background(), os.Interrupt)
+	err = run(ctx, config)
+	done()
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func loadConfig(path string) (config, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return config{}, fmt.Errorf("Error while reading config: %w", err)
+	}
+	cfg := config{
+		ListenAddr:             ":8084",
+		CrawlWorkers:           2,
+		CrawlRequestsPerSecond: 1,
+		MediaCacheSize:         1024,
 	}
-	config := config{ListenAddr: ":8084"}
-	if err := toml.Unmarshal(file, &config); err != nil {
-		log.Fatalln("Error while parsing config:", err)
+	if err := toml.Unmarshal(file, &cfg); err != nil {
+		return config{}, fmt.Errorf("Error while parsing config: %w", err)
 	}
-	if !strings.HasPrefix(config.Database, "postgres://") {
-		log.Fatalln("Config option 'Database' does not begin with postgres://", config.Database)
+	return cfg, nil
+}
+
+// databaseOpener returns the function that opens the database in config.
+func databaseOpener(config config) (func(string) (database.Database, error), error) {
+	switch {
+	case strings.HasPrefix(config.Database, "postgres://"):
+		return database.OpenPostgres, nil
+	case strings.HasPrefix(config.Database, "sqlite://"):
+		return database.OpenSQLite, nil
+	case config.Database == "memory://":
+		return func(string) (database.Database, error) {
+			return database.NewMemory(), nil
+		}, nil
+	}
+	return nil, fmt.Errorf("Config option 'Database' does not begin with postgres:// or sqlite://, and is not memory://: %q", config.Database)
+}
+
+func openDatabase(config config) (database.Database, error) {
+	openDB, err := databaseOpener(config)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openDB(config.Database)
+	if err != nil {
+		return nil, fmt.Errorf("Opening database connection: %w", err)
 	}
+	return metricsDB{db}, nil
+}
+
+// loadResources returns the static files and templates to use.
+func loadResources(config config) (fs.FS, ExecuteTemplateFunc, error) {
 	var fsys fs.FS
 	if config.Resources != "" {
 		fsys = os.DirFS(config.Resources)
 	} else {
 		config.ReloadTemplates = false
+		var err error
 		if fsys, err = fs.Sub(embedfs, "resources"); err != nil {
-			log.Fatalln("Error while using embedded resources:")
+			return nil, nil, fmt.Errorf("Error while using embedded resources: %w", err)
 		}
 	}
-	var tmplfn ExecuteTemplateFunc
 	if config.ReloadTemplates {
-		tmplfn = func(wr io.Writer, name string, data interface{}) error {
+		return fsys, func(wr io.Writer, name string, data interface{}) error {
 			tmpl := template.New("")
-			tmpl.Funcs(funcMap)
-			_, err = tmpl.ParseFS(fsys, "templates/*")
+			tmpl.Funcs(templateFuncs(config))
+			_, err := tmpl.ParseFS(fsys, "templates/*")
 			if err != nil {
 				return err
 			}
-			tmpl.Funcs(funcMap)
+			tmpl.Funcs(templateFuncs(config))
 			return tmpl.ExecuteTemplate(wr, name, data)
-		}
-	} else {
-		tmpl := template.New("")
-		tmpl.Funcs(funcMap)
-		_, err = tmpl.ParseFS(fsys, "templates/*")
-		if err != nil {
-			log.Fatalln("Error parsing templates:", err)
-		}
-		tmplfn = tmpl.ExecuteTemplate
+		}, nil
 	}
+	tmpl := template.New("")
+	tmpl.Funcs(templateFuncs(config))
+	if _, err := tmpl.ParseFS(fsys, "templates/*"); err != nil {
+		return nil, nil, fmt.Errorf("Error parsing templates: %w", err)
+	}
+	return fsys, tmpl.ExecuteTemplate, nil
+}
 
-	ctx, done := signal.NotifyContext(context.Background(), os.Interrupt)
-	defer done()
-
+// setup creates a server for config, without connecting to Discord yet.
+func setup(config config) (*server, error) {
+	fsys, tmplfn, err := loadResources(config)
+	if err != nil {
+		return nil, err
+	}
 	state := state.New("Bot " + config.BotToken)
-	if config.TraceDiscordREST {
-		state.Client.Client.Client = TraceClient{state.Client.Client.Client}
+	state.Client.Client.Client = TraceClient{
+		Client: state.Client.Client.Client,
+		Log:    config.TraceDiscordREST,
 	}
 	state.AddIntents(0 |
 		gateway.IntentGuildMessages |
 		gateway.IntentGuilds |
 		gateway.IntentGuildMembers,
 	)
-	db, err := database.OpenPostgres(config.Database)
+	db, err := openDatabase(config)
 	if err != nil {
-		log.Fatalln("Opening database connection:", err)
+		return nil, err
 	}
 	server, err := newServer(state, fsys, db, config)
 	if err != nil {
-		fmt.Println(err)
-		return
+		db.Close()
+		return nil, err
 	}
-	ready, cancel := state.ChanFor(func(e interface{}) bool {
-		_, ok := e.(*gateway.ReadyEvent)
-		return ok
+	server.executeTemplateFn = tmplfn
+	return server, nil
+}
+
+// connect opens the gateway connection to Discord, and waits until the
+// guilds the bot is in have arrived, or a minute has passed.
+func (s *server) connect(ctx context.Context) error {
+	events, cancel := s.discord.ChanFor(func(ev interface{}) bool {
+		switch ev.(type) {
+		case *gateway.ReadyEvent, *gateway.GuildCreateEvent:
+			return true
+		}
+		return false
 	})
-	if err = state.Open(ctx); err != nil {
-		log.Fatalln("Error while opening gateway connection to Discord:", err)
+	defer cancel()
+	if err := s.discord.Open(ctx); err != nil {
+		return fmt.Errorf("Error while opening gateway connection to Discord: %w", err)
 	}
-	self, err := state.Me()
+	// Events are delivered concurrently, so guilds may arrive before Ready.
+	var pending map[discord.GuildID]bool
+	created := make(map[discord.GuildID]bool)
+	timeout := time.After(time.Minute)
+	for pending == nil || len(pending) > 0 {
+		select {
+		case ev := <-events:
+			switch ev := ev.(type) {
+			case *gateway.ReadyEvent:
+				pending = make(map[discord.GuildID]bool)
+				for _, guild := range ev.Guilds {
+					if !created[guild.ID] {
+						pending[guild.ID] = true
+					}
+				}
+			case *gateway.GuildCreateEvent:
+				created[ev.ID] = true
+				delete(pending, ev.ID)
+			}
+		case <-timeout:
+			if pending == nil {
+				return errors.New("timed out waiting for Discord to be ready")
+			}
+			log.Printf("Timed out waiting for %d guilds", len(pending))
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	self, err := s.discord.Me()
 	if err != nil {
-		log.Fatalln("Error fetching self:", err)
+		return fmt.Errorf("Error fetching self: %w", err)
 	}
-	select {
-	case <-ready:
-	case <-ctx.Done():
-		return
+	log.Printf("Connected to Discord as %s#%s (%s)\n", self.Username, self.Discriminator, self.ID)
+	return nil
+}
+
+func serve(ctx context.Context, config config) error {
+	server, err := setup(config)
+	if err != nil {
+		return err
 	}
-	cancel()
+	defer server.db.Close()
+	if err := server.connect(ctx); err != nil {
+		return err
+	}
+	defer server.discord.Close()
 	go server.UpdateSitemap()
-	log.Printf("Connected to Discord as %s#%s (%s)\n", self.Username, self.Discriminator, self.ID)
-	server.executeTemplateFn = tmplfn
+	if config.CrawlWorkers > 0 && config.CrawlRequestsPerSecond > 0 {
+		go server.Crawl(ctx)
+	}
+	if server.indexNow != nil {
+		go server.indexNow.Run(ctx)
+	}
+	if err := server.registerCommands(); err != nil {
+		log.Println("Error registering slash commands:", err)
+	}
 	httpserver := &http.Server{
 		Addr:           config.ListenAddr,
 		Handler:        server,
@@ -142,20 +307,39 @@ func main() {
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
-	httperr := make(chan error, 1)
+	httperr := make(chan error, 2)
 	go func() {
 		httperr <- httpserver.ListenAndServe()
 	}()
+	var metricsserver *http.Server
+	if !config.DisableMetrics && config.MetricsListenAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		metricsserver = &http.Server{
+			Addr:           config.MetricsListenAddr,
+			Handler:        mux,
+			ReadTimeout:    10 * time.Second,
+			WriteTimeout:   10 * time.Second,
+			MaxHeaderBytes: 1 << 20,
+		}
+		go func() {
+			httperr <- metricsserver.ListenAndServe()
+		}()
+	}
 	select {
 	case <-ctx.Done():
-		done()
-		err := httpserver.Shutdown(context.Background())
-		if err != nil {
-			log.Fatalln("HTTP server shutdown:", err)
+		if metricsserver != nil {
+			if err := metricsserver.Shutdown(context.Background()); err != nil {
+				return fmt.Errorf("metrics server shutdown: %w", err)
+			}
+		}
+		if err := httpserver.Shutdown(context.Background()); err != nil {
+			return fmt.Errorf("HTTP server shutdown: %w", err)
 		}
 	case err := <-httperr:
 		if err != nil {
-			log.Fatalln("HTTP server encountered error:", err)
+			return fmt.Errorf("HTTP server encountered error: %w", err)
 		}
 	}
+	return nil
 }
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/diamondburned/ningen/v3/discordmd"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/util"
+)
+
+// discordmd only parses Discord's inline formatting, so the newer parts of
+// its markdown are found by transformMarkdown in the tree it returns.
+
+var (
+	timestampRegex = regexp.MustCompile(`<t:(-?\d{1,13})(?::([tTdDfFR]))?>`)
+	headingRegex   = regexp.MustCompile(`^(#{1,3}|-#) +`)
+	listItemRegex  = regexp.MustCompile(`^( *)([-*]|\d{1,9}\.) +`)
+)
+
+// transformMarkdown turns timestamps into Timestamp nodes, and lines that
+// start with a header, subtext or list marker into the matching blocks.
+func transformMarkdown(doc ast.Node, src []byte) {
+	var paragraphs []*ast.Paragraph
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		if i, ok := n.(*discordmd.Inline); ok && i.Attr.Has(discordmd.AttrMonospace) {
+			return ast.WalkSkipChildren, nil
+		}
+		if n.HasChildren() {
+			mergeTexts(n)
+			splitTimestamps(n, src)
+		}
+		if p, ok := n.(*ast.Paragraph); ok {
+			paragraphs = append(paragraphs, p)
+		}
+		return ast.WalkContinue, nil
+	})
+	// paragraphs are replaced after walking the tree, as that changes it
+	for _, p := range paragraphs {
+		splitParagraph(p, src)
+	}
+}
+
+// mergeTexts joins consecutive texts of n, which the parser leaves split
+// wherever it tried to parse something, so that they can be searched.
+func mergeTexts(n ast.Node) {
+	for c := n.FirstChild(); c != nil; {
+		t, ok := c.(*ast.Text)
+		next, nextOK := c.NextSibling().(*ast.Text)
+		if !ok || !nextOK || t.SoftLineBreak() || t.HardLineBreak() ||
+			t.IsRaw() != next.IsRaw() || t.Segment.Stop != next.Segment.Start ||
+			t.Segment.Padding != 0 || next.Segment.Padding != 0 {
+			c = c.NextSibling()
+			continue
+		}
+		t.Segment = t.Segment.WithStop(next.Segment.Stop)
+		t.SetSoftLineBreak(next.SoftLineBreak())
+		t.SetHardLineBreak(next.HardLineBreak())
+		n.RemoveChild(n, next)
+	}
+}
+
+// splitTimestamps replaces the timestamps in the texts of n with Timestamp
+// nodes.
+func splitTimestamps(n ast.Node, src []byte) {
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		t, ok := c.(*ast.Text)
+		if !ok || t.IsRaw() {
+			continue
+		}
+		for {
+			loc := timestampRegex.FindSubmatchIndex(t.Segment.Value(src))
+			if loc == nil {
+				break
+			}
+			start := t.Segment.Start
+			unix, err := strconv.ParseInt(string(src[start+loc[2]:start+loc[3]]), 10, 64)
+			if err != nil {
+				break
+			}
+			style := byte('f')
+			if loc[4] >= 0 {
+				style = src[start+loc[4]]
+			}
+			if loc[0] > 0 {
+				n.InsertBefore(n, t, ast.NewTextSegment(t.Segment.WithStop(start+loc[0])))
+			}
+			n.InsertBefore(n, t, &Timestamp{Time: time.Unix(unix, 0), Style: style})
+			t.Segment = t.Segment.WithStart(start + loc[1])
+		}
+	}
+}
+
+// splitParagraph replaces p with paragraphs, headers, subtext and lists,
+// going by how each of its lines starts.
+func splitParagraph(p *ast.Paragraph, src []byte) {
+	parent := p.Parent()
+	if parent == nil {
+		return
+	}
+	var blocks []ast.Node
+	var plain *ast.Paragraph
+	// lists holds the lists the last item is in, from the outermost one
+	var lists []*ast.List
+	var indents []int
+
+	lines := paragraphLines(p)
+	for _, line := range lines {
+		first, _ := line[0].(*ast.Text)
+		var value []byte
+		if first != nil {
+			value = first.Segment.Value(src)
+		}
+
+		var block ast.Node
+		if loc := headingRegex.FindSubmatchIndex(value); loc != nil && hasContent(line, loc[1], src) {
+			if string(value[loc[2]:loc[3]]) == "-#" {
+				sub := ast.NewParagraph()
+				sub.SetAttributeString("class", []byte("subtext"))
+				block = sub
+			} else {
+				block = ast.NewHeading(loc[3] - loc[2])
+			}
+			trimStart(first, loc[1])
+		} else if loc := listItemRegex.FindSubmatchIndex(value); loc != nil && hasContent(line, loc[1], src) {
+			indent := loc[3] - loc[2]
+			marker := value[loc[4]:loc[5]]
+			trimStart(first, loc[1])
+			plain = nil
+
+			for len(lists) > 0 && indents[len(indents)-1] > indent {
+				lists, indents = lists[:len(lists)-1], indents[:len(indents)-1]
+			}
+			ordered := marker[len(marker)-1] == '.'
+			if len(lists) > 0 && indents[len(indents)-1] == indent && lists[len(lists)-1].IsOrdered() != ordered {
+				lists, indents = lists[:len(lists)-1], indents[:len(indents)-1]
+			}
+			if len(lists) == 0 || indents[len(indents)-1] < indent {
+				list := newList(marker)
+				if len(lists) == 0 {
+					blocks = append(blocks, list)
+				} else {
+					outer := lists[len(lists)-1]
+					outer.LastChild().AppendChild(outer.LastChild(), list)
+				}
+				lists, indents = append(lists, list), append(indents, indent)
+			}
+			list := lists[len(lists)-1]
+			item := ast.NewListItem(indent)
+			textBlock := ast.NewTextBlock()
+			appendLine(textBlock, line)
+			item.AppendChild(item, textBlock)
+			list.AppendChild(list, item)
+			continue
+		}
+
+		lists, indents = nil, nil
+		if block == nil {
+			if plain == nil {
+				plain = ast.NewParagraph()
+				blocks = append(blocks, plain)
+			}
+			appendLine(plain, line)
+			continue
+		}
+		plain = nil
+		appendLine(block, line)
+		blocks = append(blocks, block)
+	}
+
+	if len(blocks) == 1 && blocks[0] == plain {
+		// nothing changed, so keep p as it is
+		appendLine(p, lines...)
+		return
+	}
+	for _, b := range blocks {
+		// the line break before a block is implied by it
+		if t, ok := b.LastChild().(*ast.Text); ok && b.Kind() == ast.KindParagraph {
+			t.SetSoftLineBreak(false)
+		}
+		parent.InsertBefore(parent, p, b)
+	}
+	parent.RemoveChild(parent, p)
+}
+
+// paragraphLines takes the children of p out of it, split into lines.
+func paragraphLines(p *ast.Paragraph) [][]ast.Node {
+	var lines [][]ast.Node
+	var line []ast.Node
+	for c := p.FirstChild(); c != nil; {
+		next := c.NextSibling()
+		p.RemoveChild(p, c)
+		line = append(line, c)
+		if t, ok := c.(*ast.Text); ok && (t.SoftLineBreak() || t.HardLineBreak()) {
+			lines = append(lines, line)
+			line = nil
+		}
+		c = next
+	}
+	if len(line) > 0 {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// appendLine appends the nodes of lines to block.
+func appendLine(block ast.Node, lines ...[]ast.Node) {
+	for _, line := range lines {
+		for _, n := range line {
+			block.AppendChild(block, n)
+		}
+	}
+	if block.Kind() == ast.KindParagraph {
+		return
+	}
+	// the end of other blocks ends the line
+	if t, ok := block.LastChild().(*ast.Text); ok {
+		t.SetSoftLineBreak(false)
+		t.SetHardLineBreak(false)
+	}
+}
+
+// hasContent reports whether there is anything in line after its first n
+// bytes, which are a block marker.
+func hasContent(line []ast.Node, n int, src []byte) bool {
+	first := line[0].(*ast.Text)
+	return len(line) > 1 || len(util.TrimRightSpace(first.Segment.Value(src)[n:])) > 0
+}
+
+func trimStart(t *ast.Text, n int) {
+	t.Segment = t.Segment.WithStart(t.Segment.Start + n)
+}
+
+func newList(marker []byte) *ast.List {
+	list := ast.NewList(marker[len(marker)-1])
+	list.IsTight = true
+	if list.IsOrdered() {
+		list.Start, _ = strconv.Atoi(string(marker[:len(marker)-1]))
+	}
+	return list
+}
+
+// Timestamp is a <t:unix:style> timestamp.
+type Timestamp struct {
+	ast.BaseInline
+	Time time.Time
+	// Style is one of Discord's styles, which are t, T, d, D, f, F and R
+	// for relative times.
+	Style byte
+}
+
+var KindTimestamp = ast.NewNodeKind("Timestamp")
+
+// Kind implements Node.Kind.
+func (t *Timestamp) Kind() ast.NodeKind {
+	return KindTimestamp
+}
+
+// Dump implements Node.Dump.
+func (t *Timestamp) Dump(source []byte, level int) {
+	ast.DumpHelper(t, source, level, map[string]string{
+		"Time":  t.Time.String(),
+		"Style": string(t.Style),
+	}, nil)
+}
+
+var timestampLayouts = map[byte]string{
+	't': "3:04 PM",
+	'T': "3:04:05 PM",
+	'd': "01/02/2006",
+	'D': "January 2, 2006",
+	'f': "January 2, 2006 3:04 PM",
+	'F': "Monday, January 2, 2006 3:04 PM",
+}
+
+// formatTimestamp formats t like Discord does for style, in UTC as the
+// time zone of visitors isn't known.
+func formatTimestamp(t time.Time, style byte, now time.Time) string {
+	if style == 'R' {
+		return relativeTime(t, now)
+	}
+	layout, ok := timestampLayouts[style]
+	if !ok {
+		layout = timestampLayouts['f']
+	}
+	return t.UTC().Format(layout)
+}
+
+// relativeTime describes how long before or after now t is, like
+// "3 days ago" or "in 2 hours".
+func relativeTime(t, now time.Time) string {
+	d := now.Sub(t)
+	future := d < 0
+	if future {
+		d = -d
+	}
+	units := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"year", 365 * 24 * time.Hour},
+		{"month", 30 * 24 * time.Hour},
+		{"day", 24 * time.Hour},
+		{"hour", time.Hour},
+		{"minute", time.Minute},
+		{"second", time.Second},
+	}
+	amount, unit := 0, "second"
+	for _, u := range units {
+		if d >= u.d {
+			amount, unit = int(d/u.d), u.name
+			break
+		}
+	}
+	if amount != 1 {
+		unit += "s"
+	}
+	if future {
+		return fmt.Sprintf("in %d %s", amount, unit)
+	}
+	return fmt.Sprintf("%d %s ago", amount, unit)
+}
+
+type timestampRenderer struct{}
+
+func (r timestampRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindTimestamp, r.render)
+}
+
+func (r timestampRenderer) render(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	t := n.(*Timestamp)
+	fmt.Fprintf(w, "<time datetime='%s' title='%s'>%s</time>",
+		t.Time.UTC().Format(time.RFC3339),
+		html.EscapeString(formatTimestamp(t.Time, 'F', time.Now())+" UTC"),
+		html.EscapeString(formatTimestamp(t.Time, t.Style, time.Now())))
+	return ast.WalkContinue, nil
+}
+
+// linkRenderer renders masked links, leaving only their text if they don't
+// link to a website.
+type linkRenderer struct{}
+
+func (r linkRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindLink, r.render)
+	// Discord doesn't show images, which are parsed as links anyway
+	reg.Register(ast.KindImage, r.render)
+}
+
+func (r linkRenderer) render(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	var dest []byte
+	switch l := n.(type) {
+	case *ast.Link:
+		dest = l.Destination
+	case *ast.Image:
+		dest = l.Destination
+	}
+	u := safeURL(string(dest))
+	if u == "" {
+		return ast.WalkContinue, nil
+	}
+	if entering {
+		w.WriteString("<a href='")
+		w.WriteString(html.EscapeString(string(u)))
+		w.WriteString("' rel='nofollow ugc'>")
+	} else {
+		w.WriteString("</a>")
+	}
+	return ast.WalkContinue, nil
+}
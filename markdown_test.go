@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/state"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// Relative timestamps are left out, as they depend on when the test runs.
+var markdownTests = []struct {
+	name string
+	text string
+}{
+	{"timestamps", "<t:1700000000> <t:1700000000:t> <t:1700000000:T> <t:1700000000:d> <t:1700000000:D> <t:1700000000:f> <t:1700000000:F>\n" +
+		"`<t:1700000000:F>` and\n```\n<t:1700000000:F>\n```\n" +
+		"<t:99999999999999999999> <t:-99999999999999> <t:1700000000:x> <t:abc>"},
+	{"spoilers", "a ||hidden|| b ||**bold** and *italic*|| ||unclosed"},
+	{"headers", "# big\n## medium\n### small\n#### not a header\n#no space\n-# subtext\ntext after"},
+	{"lists", "- one\n- two\n  - nested\n    - deeper\n- three\n\n1. first\n2. second\n   - mixed\n* star"},
+	{"links", "[site](https://example.com) [script](javascript:alert(1)) [data](data:text/html,x) " +
+		"[**bold**](https://example.com/a?b=c&d='e') [relative](/path) <https://example.com/bare>"},
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	s := &server{discord: state.New("Bot x"), URL: "https://dforum.example"}
+	for _, test := range markdownTests {
+		t.Run(test.name, func(t *testing.T) {
+			got := string(s.renderMarkdown(discord.Message{}, test.text))
+			golden := filepath.Join("testdata", test.name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("rendering %q:\ngot:\n%s\nwant:\n%s", test.text, got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/utils/httputil"
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/exp/slices"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// maxMediaSize is the size of the largest file the media proxy stores.
+	// Links to larger ones are redirected to Discord.
+	maxMediaSize = 25 << 20
+	// maxImagePixels is the size of the largest image thumbnails are made
+	// of, as decoding it takes 4 bytes per pixel.
+	maxImagePixels = 50_000_000
+	// mediaMaxAge is how long browsers may keep media. The contents of
+	// Discord's links don't change, as avatars and the like get new links
+	// when they are replaced.
+	mediaMaxAge = 30 * 24 * time.Hour
+	// maxMediaLoads is how much media is fetched at once, each of which
+	// may hold up to maxMediaSize in memory. Fetches beyond it wait.
+	maxMediaLoads = 8
+	// maxThumbnailDecodes is how many images are decoded into thumbnails
+	// at once, each of which takes up to 4*maxImagePixels bytes.
+	maxThumbnailDecodes = 2
+	// mediaMissingTTL is how long media that Discord doesn't have is
+	// remembered as missing, so that links to it aren't fetched every time.
+	mediaMissingTTL = time.Hour
+	// stickerFormatGIF is missing from arikawa.
+	stickerFormatGIF = 4
+)
+
+// mediaHosts are the hosts of Discord's CDN, which serve the same paths.
+var mediaHosts = map[string]bool{
+	"cdn.discordapp.com":   true,
+	"media.discordapp.net": true,
+}
+
+// mediaPrefixes are the paths on Discord's CDN that the media proxy serves.
+var mediaPrefixes = []string{
+	"attachments/",
+	"avatars/",
+	"embed/avatars/",
+	"emojis/",
+	"external/",
+	"guilds/",
+	"icons/",
+	"stickers/",
+}
+
+// mediaParams are the query parameters that are kept when proxying a link.
+// width and height ask for a thumbnail, and ex, is and hm sign links to
+// attachments. Links to images from other sites keep their whole query, as
+// it is part of the link to the image.
+var mediaParams = []string{"size", "width", "height", "ex", "is", "hm"}
+
+// mediaURLs turns links to Discord's CDN into links to the media proxy.
+type mediaURLs struct {
+	// base is the URL of the site, and key signs links so that the proxy
+	// only fetches what dforum links to. key is nil if the media proxy is
+	// disabled, in which case links are left alone.
+	base string
+	key  []byte
+}
+
+func newMediaURLs(config config) mediaURLs {
+	if config.MediaCacheDir == "" {
+		return mediaURLs{}
+	}
+	// derived from the token so that links stay valid across restarts
+	mac := hmac.New(sha256.New, []byte(config.BotToken))
+	mac.Write([]byte("dforum media proxy"))
+	return mediaURLs{
+		base: strings.TrimSuffix(config.SiteURL, "/"),
+		key:  mac.Sum(nil),
+	}
+}
+
+// URL returns the link to u through the media proxy, or u if the proxy is
+// disabled or doesn't serve it.
+func (m mediaURLs) URL(u string) string {
+	if m.key == nil {
+		return u
+	}
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Scheme != "https" || !mediaHosts[parsed.Host] {
+		return u
+	}
+	p := strings.TrimPrefix(parsed.Path, "/")
+	if !isMediaPath(p) {
+		return u
+	}
+	query := url.Values{}
+	for k, v := range parsed.Query() {
+		if isExternalMedia(p) || slices.Contains(mediaParams, k) {
+			query[k] = v
+		}
+	}
+	query.Set("sig", m.sign(p, query))
+	return m.base + "/media/" + p + "?" + query.Encode()
+}
+
+// sign returns the signature of the link to p with query, ignoring any
+// signature in it.
+func (m mediaURLs) sign(p string, query url.Values) string {
+	unsigned := url.Values{}
+	for k, v := range query {
+		if k != "sig" {
+			unsigned[k] = v
+		}
+	}
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write([]byte(p + "?" + unsigned.Encode()))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// verify reports whether the link to p with query was made by URL.
+func (m mediaURLs) verify(p string, query url.Values) bool {
+	return m.key != nil && isMediaPath(p) &&
+		hmac.Equal([]byte(query.Get("sig")), []byte(m.sign(p, query)))
+}
+
+func isMediaPath(p string) bool {
+	if path.Clean("/"+p) != "/"+p {
+		return false
+	}
+	for _, prefix := range mediaPrefixes {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isExternalMedia reports whether p is an image from another site, like the
+// thumbnail of an embed, which Discord's media proxy serves under external/.
+func isExternalMedia(p string) bool {
+	return strings.HasPrefix(p, "external/")
+}
+
+// mediaKey is what the media at p with query is cached as. It leaves out the
+// signatures of attachments, which change whenever they are refreshed.
+func mediaKey(p string, query url.Values) string {
+	key := url.Values{}
+	for k, v := range query {
+		if k != "sig" && (isExternalMedia(p) || k == "size" || k == "width" || k == "height") {
+			key[k] = v
+		}
+	}
+	return p + "?" + key.Encode()
+}
+
+// mediaProxy serves media from Discord's CDN through dforum, so that links
+// to attachments keep working after they expire and visitors don't load
+// anything from Discord. Thumbnails of images are made locally.
+type mediaProxy struct {
+	urls   mediaURLs
+	cache  *mediaCache
+	client *http.Client
+	// refresh returns a new link to the attachment at u, as the signature
+	// of links to attachments expires.
+	refresh func(ctx context.Context, u string) (string, error)
+
+	mu sync.Mutex
+	// fetching holds the media being fetched by key, so that it is only
+	// fetched once when it is requested several times at once.
+	fetching map[string]*mediaFetch
+	// missing holds when the media found missing may be fetched again, by
+	// key.
+	missing map[string]time.Time
+	// loads and decodes limit how many fetches and thumbnails are worked on
+	// at once, by holding one value for each.
+	loads   chan struct{}
+	decodes chan struct{}
+}
+
+type mediaFetch struct {
+	done chan struct{}
+	// redirect is set instead of caching media that is too large.
+	redirect string
+	err      error
+}
+
+// errNoMedia is returned when Discord doesn't have the media.
+var errNoMedia = errors.New("media not found")
+
+func newMediaProxy(urls mediaURLs, cache *mediaCache, refresh func(context.Context, string) (string, error)) *mediaProxy {
+	return &mediaProxy{
+		urls:     urls,
+		cache:    cache,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		refresh:  refresh,
+		fetching: make(map[string]*mediaFetch),
+		missing:  make(map[string]time.Time),
+		loads:    make(chan struct{}, maxMediaLoads),
+		decodes:  make(chan struct{}, maxThumbnailDecodes),
+	}
+}
+
+func (s *server) getMedia(w http.ResponseWriter, r *http.Request) {
+	p := chi.URLParam(r, "*")
+	query := r.URL.Query()
+	if !s.mediaProxy.urls.verify(p, query) {
+		s.displayErr(w, http.StatusNotFound, errors.New("No such media"))
+		return
+	}
+	key := mediaKey(p, query)
+	f, contentType, err := s.mediaProxy.cache.Open(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		var redirect string
+		redirect, err = s.mediaProxy.fetch(r.Context(), p, query)
+		if redirect != "" {
+			http.Redirect(w, r, redirect, http.StatusFound)
+			return
+		}
+		if err == nil {
+			f, contentType, err = s.mediaProxy.cache.Open(key)
+		}
+	}
+	switch {
+	case errors.Is(err, errNoMedia):
+		s.displayErr(w, http.StatusNotFound, err)
+		return
+	case err != nil:
+		s.displayErr(w, http.StatusBadGateway, err)
+		return
+	}
+	defer f.Close()
+	serveMedia(w, r, f, path.Base(p), contentType)
+}
+
+// serveMedia serves media, only letting browsers show the kinds that can't
+// run scripts on the site. Anything else is downloaded.
+func serveMedia(w http.ResponseWriter, r *http.Request, content io.ReadSeeker, name, contentType string) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(mediaMaxAge.Seconds())))
+	h.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	h.Set("X-Content-Type-Options", "nosniff")
+	switch mediaType {
+	case "image/png", "image/jpeg", "image/gif", "image/webp", "image/avif",
+		"video/mp4", "video/webm", "audio/mpeg", "audio/ogg", "audio/wav":
+	default:
+		h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	}
+	http.ServeContent(w, r, name, time.Time{}, content)
+}
+
+// fetch fetches the media at p with query into the cache, or returns the
+// link to redirect to if it's too large. It returns early when ctx is done,
+// but the media is still cached for next time.
+func (m *mediaProxy) fetch(ctx context.Context, p string, query url.Values) (string, error) {
+	key := mediaKey(p, query)
+	m.mu.Lock()
+	if until, ok := m.missing[key]; ok {
+		if time.Now().Before(until) {
+			m.mu.Unlock()
+			return "", errNoMedia
+		}
+		delete(m.missing, key)
+	}
+	f, ok := m.fetching[key]
+	if !ok {
+		f = &mediaFetch{done: make(chan struct{})}
+		m.fetching[key] = f
+		go func() {
+			m.loads <- struct{}{}
+			f.redirect, f.err = m.load(p, query)
+			<-m.loads
+			m.mu.Lock()
+			delete(m.fetching, key)
+			if errors.Is(f.err, errNoMedia) {
+				m.setMissing(key)
+			}
+			m.mu.Unlock()
+			close(f.done)
+		}()
+	}
+	m.mu.Unlock()
+	select {
+	case <-f.done:
+		return f.redirect, f.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// setMissing remembers that the media with key is missing for
+// mediaMissingTTL. m.mu must be held.
+func (m *mediaProxy) setMissing(key string) {
+	now := time.Now()
+	if len(m.missing) >= 1000 {
+		for k, until := range m.missing {
+			if now.After(until) {
+				delete(m.missing, k)
+			}
+		}
+	}
+	m.missing[key] = now.Add(mediaMissingTTL)
+}
+
+// load caches the media at p with query, making a thumbnail of the original
+// if query asks for one. The original is used as the thumbnail of what can't
+// be scaled.
+func (m *mediaProxy) load(p string, query url.Values) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	width, _ := strconv.Atoi(query.Get("width"))
+	height, _ := strconv.Atoi(query.Get("height"))
+	if width == 0 && height == 0 {
+		data, contentType, link, err := m.download(ctx, p, query)
+		if err != nil || data == nil {
+			return link, err
+		}
+		return m.put(mediaKey(p, query), contentType, data, link)
+	}
+
+	original := url.Values{}
+	for k, v := range query {
+		if k != "width" && k != "height" {
+			original[k] = v
+		}
+	}
+	var data []byte
+	var contentType string
+	link := upstreamMediaURL(p, original)
+	if f, ct, err := m.cache.Open(mediaKey(p, original)); err == nil {
+		data, err = io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		contentType = ct
+	} else {
+		data, contentType, link, err = m.download(ctx, p, original)
+		if err != nil || data == nil {
+			return link, err
+		}
+		if err := m.cache.Put(mediaKey(p, original), contentType, data); err != nil && !errors.Is(err, errMediaTooLarge) {
+			return "", err
+		}
+	}
+	m.decodes <- struct{}{}
+	thumb, thumbType, err := thumbnail(data, contentType, width, height)
+	<-m.decodes
+	if err != nil {
+		// not an image that can be scaled, like an SVG or one that is
+		// too large, so the original is its own thumbnail
+		thumb, thumbType = data, contentType
+	}
+	return m.put(mediaKey(p, query), thumbType, thumb, link)
+}
+
+// put caches data under key, or returns link to redirect to if it is too
+// large for the cache.
+func (m *mediaProxy) put(key, contentType string, data []byte, link string) (string, error) {
+	err := m.cache.Put(key, contentType, data)
+	if errors.Is(err, errMediaTooLarge) {
+		return link, nil
+	}
+	return "", err
+}
+
+// download fetches the media at p with query from Discord, refreshing the
+// link first if it is an attachment whose link expired, and returns it with
+// the link it was fetched from. Media larger than maxMediaSize isn't
+// downloaded, and only the link to it is returned.
+func (m *mediaProxy) download(ctx context.Context, p string, query url.Values) (data []byte, contentType, link string, err error) {
+	u := upstreamMediaURL(p, query)
+	resp, err := m.get(ctx, u)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer func() { resp.Body.Close() }()
+	if strings.HasPrefix(p, "attachments/") && resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		linkExpired(query, time.Now()) && m.refresh != nil {
+		resp.Body.Close()
+		if u, err = m.refresh(ctx, u); err != nil {
+			return nil, "", "", fmt.Errorf("refreshing link to %s: %w", p, err)
+		}
+		if resp, err = m.get(ctx, u); err != nil {
+			return nil, "", "", err
+		}
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden:
+		return nil, "", "", errNoMedia
+	case resp.StatusCode != http.StatusOK:
+		return nil, "", "", fmt.Errorf("fetching %s: %s", p, resp.Status)
+	case resp.ContentLength > maxMediaSize:
+		return nil, "", u, nil
+	}
+	data, err = io.ReadAll(io.LimitReader(resp.Body, maxMediaSize+1))
+	if err != nil {
+		return nil, "", "", fmt.Errorf("fetching %s: %w", p, err)
+	}
+	if len(data) > maxMediaSize {
+		return nil, "", u, nil
+	}
+	contentType = resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	return data, contentType, u, nil
+}
+
+// linkExpired reports whether the signature of a link to an attachment with
+// query expired by now. Links without one, from before attachment links were
+// signed, count as expired.
+func linkExpired(query url.Values, now time.Time) bool {
+	ex, err := strconv.ParseInt(query.Get("ex"), 16, 64)
+	if err != nil {
+		return true
+	}
+	return !now.Before(time.Unix(ex, 0))
+}
+
+func (m *mediaProxy) get(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		mediaFetches.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	mediaFetches.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+	return resp, nil
+}
+
+// upstreamMediaURL returns the link to the media at p with query on Discord.
+func upstreamMediaURL(p string, query url.Values) string {
+	host := "cdn.discordapp.com"
+	if isExternalMedia(p) || (strings.HasPrefix(p, "stickers/") && strings.HasSuffix(p, ".gif")) {
+		// images from other sites and GIF stickers are only on the
+		// media proxy
+		host = "media.discordapp.net"
+	}
+	upstream := url.Values{}
+	for k, v := range query {
+		switch {
+		case k == "sig" || k == "width" || k == "height":
+		case isExternalMedia(p) || k == "size" || k == "ex" || k == "is" || k == "hm":
+			upstream[k] = v
+		}
+	}
+	u := "https://" + host + "/" + p
+	if len(upstream) > 0 {
+		u += "?" + upstream.Encode()
+	}
+	return u
+}
+
+// refreshAttachmentURL asks Discord for a new link to the attachment at u.
+func (s *server) refreshAttachmentURL(ctx context.Context, u string) (string, error) {
+	var resp struct {
+		RefreshedURLs []struct {
+			Refreshed string `json:"refreshed"`
+		} `json:"refreshed_urls"`
+	}
+	err := s.discord.Client.WithContext(ctx).RequestJSON(&resp, http.MethodPost,
+		api.Endpoint+"attachments/refresh-urls",
+		httputil.WithJSONBody(struct {
+			URLs []string `json:"attachment_urls"`
+		}{[]string{u}}))
+	if err != nil {
+		return "", err
+	}
+	if len(resp.RefreshedURLs) == 0 || resp.RefreshedURLs[0].Refreshed == "" {
+		return "", errNoMedia
+	}
+	return resp.RefreshedURLs[0].Refreshed, nil
+}
+
+// thumbnail scales the image in data down to fit in width by height, which
+// are at most MaxThumbnailWidth by MaxThumbnailHeight. Images that already
+// fit are returned as they are, and so are GIFs so that they stay animated.
+func thumbnail(data []byte, contentType string, width, height int) ([]byte, string, error) {
+	if width <= 0 || width > MaxThumbnailWidth {
+		width = MaxThumbnailWidth
+	}
+	if height <= 0 || height > MaxThumbnailHeight {
+		height = MaxThumbnailHeight
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	w, h := fitThumbnail(config.Width, config.Height, width, height)
+	if (w == config.Width && h == config.Height) || format == "gif" {
+		return data, contentType, nil
+	}
+	if int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return nil, "", fmt.Errorf("image is too large: %dx%d", config.Width, config.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Over, nil)
+	var buf bytes.Buffer
+	if dst.Opaque() {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+		return buf.Bytes(), "image/jpeg", err
+	}
+	err = png.Encode(&buf, dst)
+	return buf.Bytes(), "image/png", err
+}
+
+// fitThumbnail scales w by h down to fit in maxW by maxH, keeping its aspect
+// ratio.
+func fitThumbnail(w, h, maxW, maxH int) (int, int) {
+	if w > maxW {
+		h = h * maxW / w
+		w = maxW
+	}
+	if h > maxH {
+		w = w * maxH / h
+		h = maxH
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return w, h
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mediaTouchInterval is how often the last use of a cached file is written to
+// disk, which is how the order of eviction survives restarts.
+const mediaTouchInterval = time.Hour
+
+// mediaCache stores media on disk up to a total size, evicting what was used
+// least recently when it grows beyond it.
+//
+// Files are stored under blobs/ by the hash of their contents, so that media
+// found under several keys, like an image that is its own thumbnail, is only
+// stored once. Keys are stored under keys/ by their hash, in files holding
+// the hash of their contents and its content type. The modification time of
+// those files is when they were last used.
+type mediaCache struct {
+	dir     string
+	maxSize int64
+
+	mu sync.Mutex
+	// lru holds the *mediaEntry of every key, from the most recently used.
+	lru     *list.List
+	entries map[string]*list.Element
+	blobs   map[string]*mediaBlob
+	size    int64
+}
+
+type mediaEntry struct {
+	key         string
+	blob        string
+	contentType string
+	used        time.Time
+	touched     time.Time
+}
+
+type mediaBlob struct {
+	size int64
+	// refs is how many keys have these contents.
+	refs int
+}
+
+// errMediaTooLarge is returned when storing media larger than the whole cache.
+var errMediaTooLarge = errors.New("media is too large to cache")
+
+// openMediaCache opens the cache in dir, creating it if needed, and removes
+// anything that is left over from being interrupted while writing to it.
+func openMediaCache(dir string, maxSize int64) (*mediaCache, error) {
+	c := &mediaCache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		blobs:   make(map[string]*mediaBlob),
+	}
+	for _, sub := range []string{"keys", "blobs"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	var entries []*mediaEntry
+	err := filepath.WalkDir(filepath.Join(dir, "keys"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if !isHash(d.Name()) {
+			os.Remove(path)
+			return nil
+		}
+		e, err := c.readEntry(path)
+		if err != nil {
+			// not worth failing over, it will be fetched again
+			os.Remove(path)
+			return nil
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading media cache: %w", err)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].used.After(entries[j].used)
+	})
+	for _, e := range entries {
+		b, ok := c.blobs[e.blob]
+		if !ok {
+			stat, err := os.Stat(c.blobPath(e.blob))
+			if err != nil {
+				os.Remove(c.keyPath(e.key))
+				continue
+			}
+			b = &mediaBlob{size: stat.Size()}
+			c.blobs[e.blob] = b
+			c.size += b.size
+		}
+		b.refs++
+		c.entries[e.key] = c.lru.PushBack(e)
+	}
+	err = filepath.WalkDir(filepath.Join(dir, "blobs"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if _, ok := c.blobs[d.Name()]; !ok {
+			os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading media cache: %w", err)
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	mediaCacheBytes.Set(float64(c.size))
+	return c, nil
+}
+
+// readEntry reads the key file at path.
+func (c *mediaCache) readEntry(path string) (*mediaEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	blob, contentType, ok := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+	if !ok || !isHash(blob) {
+		return nil, errors.New("malformed media cache entry")
+	}
+	return &mediaEntry{
+		key:         filepath.Base(path),
+		blob:        blob,
+		contentType: contentType,
+		used:        stat.ModTime(),
+		touched:     stat.ModTime(),
+	}, nil
+}
+
+func isHash(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func hashString(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *mediaCache) keyPath(keyHash string) string {
+	return filepath.Join(c.dir, "keys", keyHash[:2], keyHash)
+}
+
+func (c *mediaCache) blobPath(blob string) string {
+	return filepath.Join(c.dir, "blobs", blob[:2], blob)
+}
+
+// Open returns the contents stored under key and their content type, or
+// fs.ErrNotExist if there are none.
+func (c *mediaCache) Open(key string) (*os.File, string, error) {
+	keyHash := hashString([]byte(key))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[keyHash]
+	if !ok {
+		mediaCacheRequests.WithLabelValues("miss").Inc()
+		return nil, "", fs.ErrNotExist
+	}
+	e := el.Value.(*mediaEntry)
+	// opened while locked, so that it can't be evicted in between
+	f, err := os.Open(c.blobPath(e.blob))
+	if err != nil {
+		c.remove(el)
+		mediaCacheRequests.WithLabelValues("miss").Inc()
+		return nil, "", fs.ErrNotExist
+	}
+	mediaCacheRequests.WithLabelValues("hit").Inc()
+	c.lru.MoveToFront(el)
+	e.used = time.Now()
+	if e.used.Sub(e.touched) > mediaTouchInterval {
+		e.touched = e.used
+		os.Chtimes(c.keyPath(keyHash), e.used, e.used)
+	}
+	return f, e.contentType, nil
+}
+
+// Put stores data under key, or returns errMediaTooLarge if it could never
+// fit.
+func (c *mediaCache) Put(key, contentType string, data []byte) error {
+	if int64(len(data)) > c.maxSize {
+		return errMediaTooLarge
+	}
+	keyHash := hashString([]byte(key))
+	blob := hashString(data)
+	// The contents are written without holding c.mu, so that lookups don't
+	// wait for them, unless they are stored already.
+	for written := false; ; written = true {
+		c.mu.Lock()
+		if _, ok := c.blobs[blob]; ok || written {
+			break
+		}
+		c.mu.Unlock()
+		if err := writeMediaFile(c.blobPath(blob), data); err != nil {
+			return fmt.Errorf("caching media: %w", err)
+		}
+	}
+	defer c.mu.Unlock()
+	if _, ok := c.blobs[blob]; !ok {
+		c.blobs[blob] = &mediaBlob{size: int64(len(data))}
+		c.size += int64(len(data))
+	}
+	// referenced before the key's old entry is removed, so that the
+	// contents aren't removed if they are the same
+	c.blobs[blob].refs++
+	if el, ok := c.entries[keyHash]; ok {
+		c.remove(el)
+	}
+	e := &mediaEntry{
+		key:         keyHash,
+		blob:        blob,
+		contentType: contentType,
+		used:        time.Now(),
+		touched:     time.Now(),
+	}
+	c.entries[keyHash] = c.lru.PushFront(e)
+	if err := writeMediaFile(c.keyPath(keyHash), []byte(blob+" "+contentType+"\n")); err != nil {
+		c.remove(c.entries[keyHash])
+		return fmt.Errorf("caching media: %w", err)
+	}
+	c.evict()
+	mediaCacheBytes.Set(float64(c.size))
+	return nil
+}
+
+// evict removes the least recently used entries until the cache fits in its
+// size. c.mu must be held.
+func (c *mediaCache) evict() {
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+		mediaCacheEvictions.Inc()
+	}
+}
+
+// remove removes el, and its contents if no other key has them. c.mu must
+// be held.
+func (c *mediaCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*mediaEntry)
+	delete(c.entries, e.key)
+	os.Remove(c.keyPath(e.key))
+	b, ok := c.blobs[e.blob]
+	if !ok {
+		return
+	}
+	if b.refs--; b.refs <= 0 {
+		delete(c.blobs, e.blob)
+		c.size -= b.size
+		os.Remove(c.blobPath(e.blob))
+	}
+}
+
+// writeMediaFile writes data to name atomically, creating its directory.
+func writeMediaFile(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := createAtomic(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Abort()
+		return err
+	}
+	return f.Commit()
+}
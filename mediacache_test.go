@@ -0,0 +1,197 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestMediaCache(t *testing.T, dir string, maxSize int64) *mediaCache {
+	t.Helper()
+	c, err := openMediaCache(dir, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func putMedia(t *testing.T, c *mediaCache, key, data string) {
+	t.Helper()
+	if err := c.Put(key, "text/plain", []byte(data)); err != nil {
+		t.Fatalf("putting %s: %v", key, err)
+	}
+}
+
+// checkMedia checks that key holds want, or that it isn't cached if want is
+// empty.
+func checkMedia(t *testing.T, c *mediaCache, key, want string) {
+	t.Helper()
+	f, _, err := c.Open(key)
+	if want == "" {
+		if err == nil {
+			f.Close()
+			t.Errorf("%s is still cached", key)
+		} else if err != fs.ErrNotExist {
+			t.Errorf("opening %s: %v", key, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Errorf("opening %s: %v", key, err)
+		return
+	}
+	defer f.Close()
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("%s holds %q, want %q", key, got, want)
+	}
+}
+
+func TestMediaCacheEviction(t *testing.T) {
+	c := openTestMediaCache(t, t.TempDir(), 10)
+	putMedia(t, c, "a", "aaaa")
+	putMedia(t, c, "b", "bbbb")
+	// a is now used more recently than b
+	checkMedia(t, c, "a", "aaaa")
+	putMedia(t, c, "c", "cccc")
+	checkMedia(t, c, "b", "")
+	checkMedia(t, c, "a", "aaaa")
+	checkMedia(t, c, "c", "cccc")
+	if c.size != 8 {
+		t.Errorf("cache size is %d, want 8", c.size)
+	}
+	if err := c.Put("d", "text/plain", make([]byte, 11)); err != errMediaTooLarge {
+		t.Errorf("putting media larger than the cache: got %v, want errMediaTooLarge", err)
+	}
+}
+
+func TestMediaCacheSharedBlobs(t *testing.T) {
+	c := openTestMediaCache(t, t.TempDir(), 100)
+	putMedia(t, c, "image", "same")
+	putMedia(t, c, "thumbnail", "same")
+	blob := c.blobPath(hashString([]byte("same")))
+	if c.size != 4 || len(c.blobs) != 1 {
+		t.Errorf("cache holds %d blobs of %d bytes, want 1 of 4", len(c.blobs), c.size)
+	}
+	// replacing one key keeps the contents the other still has
+	putMedia(t, c, "image", "other")
+	checkMedia(t, c, "thumbnail", "same")
+	if _, err := os.Stat(blob); err != nil {
+		t.Errorf("shared blob was removed: %v", err)
+	}
+	putMedia(t, c, "thumbnail", "other")
+	if _, err := os.Stat(blob); !os.IsNotExist(err) {
+		t.Errorf("unused blob was kept: %v", err)
+	}
+	if c.size != 5 || len(c.blobs) != 1 {
+		t.Errorf("cache holds %d blobs of %d bytes, want 1 of 5", len(c.blobs), c.size)
+	}
+}
+
+func TestMediaCacheRestart(t *testing.T) {
+	dir := t.TempDir()
+	c := openTestMediaCache(t, dir, 100)
+	putMedia(t, c, "old", "1111")
+	putMedia(t, c, "new", "2222")
+	putMedia(t, c, "gone", "3333")
+	// when keys were last used is read from their files
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes(c.keyPath(hashString([]byte("old"))), past, past)
+	os.Remove(c.blobPath(hashString([]byte("3333"))))
+	// left over from being interrupted
+	orphan := c.blobPath(hashString([]byte("orphan")))
+	if err := writeMediaFile(orphan, []byte("orphan")); err != nil {
+		t.Fatal(err)
+	}
+	tmp := filepath.Join(dir, "keys", ".partial.tmp")
+	if err := os.WriteFile(tmp, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c = openTestMediaCache(t, dir, 4)
+	checkMedia(t, c, "old", "")
+	checkMedia(t, c, "gone", "")
+	checkMedia(t, c, "new", "2222")
+	for _, name := range []string{orphan, tmp} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s was kept: %v", name, err)
+		}
+	}
+	if c.size != 4 {
+		t.Errorf("cache size is %d, want 4", c.size)
+	}
+}
+
+func TestMediaURLsVerify(t *testing.T) {
+	m := mediaURLs{base: "https://dforum.example", key: []byte("key")}
+	link := m.URL("https://cdn.discordapp.com/attachments/1/2/a.png?ex=1&is=2&hm=3&width=10")
+	u, err := url.Parse(link)
+	if err != nil || !strings.HasPrefix(u.Path, "/media/") {
+		t.Fatalf("link through the media proxy is %q", link)
+	}
+	p := strings.TrimPrefix(u.Path, "/media/")
+	if !m.verify(p, u.Query()) {
+		t.Errorf("link %q isn't accepted", link)
+	}
+
+	tampered := u.Query()
+	tampered.Set("width", "20")
+	unsigned := u.Query()
+	unsigned.Del("sig")
+	for _, test := range []struct {
+		p     string
+		query url.Values
+	}{
+		{"attachments/1/2/b.png", u.Query()},
+		{p, tampered},
+		{p, unsigned},
+	} {
+		if m.verify(test.p, test.query) {
+			t.Errorf("%s?%s is accepted", test.p, test.query.Encode())
+		}
+	}
+	if (mediaURLs{}).verify(p, u.Query()) {
+		t.Error("link is accepted with the proxy disabled")
+	}
+
+	for _, p := range []string{
+		"attachments/../../etc/passwd",
+		"attachments/1/../2/a.png",
+		"../attachments/1/2/a.png",
+		"/attachments/1/2/a.png",
+		"attachments//a.png",
+		"banners/1/a.png",
+		"",
+	} {
+		if isMediaPath(p) {
+			t.Errorf("%q is a media path", p)
+		}
+		// even when signed
+		query := url.Values{}
+		query.Set("sig", m.sign(p, query))
+		if m.verify(p, query) {
+			t.Errorf("%q is accepted", p)
+		}
+	}
+	if m.URL("https://cdn.discordapp.com/attachments/../etc/passwd") != "https://cdn.discordapp.com/attachments/../etc/passwd" {
+		t.Error("link outside the media paths is proxied")
+	}
+}
+
+func TestMediaCachePutAgain(t *testing.T) {
+	c := openTestMediaCache(t, t.TempDir(), 100)
+	putMedia(t, c, "a", "same")
+	putMedia(t, c, "a", "same")
+	checkMedia(t, c, "a", "same")
+	if c.size != 4 || c.blobs[hashString([]byte("same"))].refs != 1 {
+		t.Errorf("cache holds %d bytes with %+v, want 4 with 1 reference", c.size, c.blobs)
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"html"
 	"html/template"
+	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/diamondburned/arikawa/v3/discord"
@@ -17,61 +20,87 @@ import (
 const (
 	MaxThumbnailWidth  = 600
 	MaxThumbnailHeight = 600
+	// ReplyPreviewLength is how many characters of a message are shown
+	// above the replies to it.
+	ReplyPreviewLength = 100
 )
 
 type MessageGroup struct {
-	Author
-	Messages []Message
+	Author   `json:"author"`
+	Messages []Message `json:"messages"`
+	// Hidden is set when the author's messages must not be shown, in which
+	// case Author and Messages only hold placeholders.
+	Hidden bool `json:"hidden,omitempty"`
 }
 
 type Message struct {
 	discord.Message
-	Role             string
-	RenderedContent  template.HTML
-	MediaPreviews    []MediaPreview
-	PlainAttachments []PlainAttachment
+	Role             string            `json:"role,omitempty"`
+	RenderedContent  template.HTML     `json:"rendered_content"`
+	MediaPreviews    []MediaPreview    `json:"media_previews"`
+	PlainAttachments []PlainAttachment `json:"plain_attachments"`
+	// RichEmbeds are the embeds that aren't among MediaPreviews.
+	RichEmbeds []Embed   `json:"rich_embeds,omitempty"`
+	Stickers   []Sticker `json:"stickers,omitempty"`
+	// Reply is set if the message is a reply.
+	Reply *Reply `json:"reply,omitempty"`
+}
+
+// Reply is the message that a message replies to, as it is shown above it.
+type Reply struct {
+	ID discord.MessageID `json:"id"`
+	// URL is the permalink of the message.
+	URL string `json:"url"`
+	// Author and Content are empty if the message couldn't be found, which
+	// is usually because it was deleted. Content is also empty if the
+	// author is hidden.
+	Author  string        `json:"author,omitempty"`
+	Content template.HTML `json:"content,omitempty"`
+	Hidden  bool          `json:"hidden,omitempty"`
 }
 
 type Author struct {
-	ID         discord.UserID
-	Name       string
-	Avatar     string
-	Bot        bool
-	Role       string
-	OtherRoles []*discord.Role
-	RoleColor  string
+	ID         discord.UserID  `json:"id"`
+	Name       string          `json:"name"`
+	Avatar     string          `json:"avatar"`
+	Bot        bool            `json:"bot"`
+	Role       string          `json:"role"`
+	OtherRoles []*discord.Role `json:"roles"`
+	RoleColor  string          `json:"role_color"`
 }
 
 type MediaPreview struct {
-	Thumbnail   template.URL
-	URL         template.URL
-	Description string
+	Thumbnail   template.URL `json:"thumbnail"`
+	URL         template.URL `json:"url"`
+	Description string       `json:"description,omitempty"`
+}
+
+// Sticker is a sticker sent with a message. URL is empty for animated
+// stickers that can't be shown as an image.
+type Sticker struct {
+	Name string       `json:"name"`
+	URL  template.URL `json:"url,omitempty"`
 }
 
 type PlainAttachment struct {
-	Name string
-	URL  template.URL
+	Name string       `json:"name"`
+	URL  template.URL `json:"url"`
 }
 
-func attachmentThumbnail(at discord.Attachment) template.URL {
-	w, h := at.Width, at.Height
-	if w > MaxThumbnailWidth {
-		h = h * MaxThumbnailWidth / w
-		w = MaxThumbnailWidth
-	}
-	if h > MaxThumbnailHeight {
-		w = w * MaxThumbnailHeight / h
-		h = MaxThumbnailHeight
-	}
+func attachmentThumbnail(at discord.Attachment) string {
+	w, h := fitThumbnail(int(at.Width), int(at.Height), MaxThumbnailWidth, MaxThumbnailHeight)
 
-	const urlprefixlen = len("https://cdn.discordapp.com/")
-	if len(at.URL) < urlprefixlen {
+	u, err := url.Parse(at.URL)
+	if err != nil || u.Host != "cdn.discordapp.com" {
 		return ""
 	}
-	return template.URL(fmt.Sprintf(
-		"https://media.discordapp.net/%s?width=%d&height=%d",
-		at.URL[urlprefixlen:], w, h,
-	))
+	// attachment links are signed in their query, which is kept
+	u.Host = "media.discordapp.net"
+	query := u.Query()
+	query.Set("width", strconv.Itoa(w))
+	query.Set("height", strconv.Itoa(h))
+	u.RawQuery = query.Encode()
+	return u.String()
 }
 
 // message massages a discord.Message into a Message for passing to templates
@@ -82,6 +111,10 @@ func (s *server) message(m discord.Message) Message {
 	}
 	var mediapreviews []MediaPreview
 	for _, e := range m.Embeds {
+		if isRichEmbed(e) {
+			msg.RichEmbeds = append(msg.RichEmbeds, s.embed(m, e))
+			continue
+		}
 		if e.Thumbnail == nil {
 			continue
 		}
@@ -94,14 +127,14 @@ func (s *server) message(m discord.Message) Message {
 				url = e.Video.URL
 			}
 		case e.Image != nil:
-			url = e.Image.Proxy
+			url = s.media.URL(e.Image.Proxy)
 		default:
 			url = e.Thumbnail.URL
 		}
 		mediapreviews = append(
 			mediapreviews,
 			MediaPreview{
-				Thumbnail: template.URL(e.Thumbnail.URL),
+				Thumbnail: s.proxiedURL(e.Thumbnail.Proxy, e.Thumbnail.URL),
 				URL:       template.URL(url),
 			},
 		)
@@ -112,21 +145,114 @@ func (s *server) message(m discord.Message) Message {
 			!strings.HasPrefix(att.ContentType, "image/") {
 			plainatt = append(plainatt, PlainAttachment{
 				att.Filename,
-				template.URL(att.URL),
+				template.URL(s.media.URL(att.URL)),
 			})
 			continue
 		}
 		mediapreviews = append(mediapreviews, MediaPreview{
-			Thumbnail:   attachmentThumbnail(att),
-			URL:         template.URL(att.URL),
+			Thumbnail:   template.URL(s.media.URL(attachmentThumbnail(att))),
+			URL:         template.URL(s.media.URL(att.URL)),
 			Description: att.Description,
 		})
 	}
+	for _, st := range m.Stickers {
+		sticker := Sticker{Name: st.Name}
+		switch st.FormatType {
+		case discord.StickerFormatPNG, discord.StickerFormatAPNG:
+			sticker.URL = template.URL(s.media.URL(st.StickerURLWithType(discord.PNGImage) + "?size=160"))
+		case stickerFormatGIF:
+			sticker.URL = template.URL(s.media.URL("https://media.discordapp.net/stickers/" + st.ID.String() + ".gif?size=160"))
+		}
+		msg.Stickers = append(msg.Stickers, sticker)
+	}
 	msg.MediaPreviews = mediapreviews
 	msg.PlainAttachments = plainatt
 	return msg
 }
 
+// referencedMessages returns the messages that the replies among msgs reply
+// to, by ID. Discord usually includes them in the replies, and otherwise they
+// are looked up among msgs and in the database.
+func (s *server) referencedMessages(ctx context.Context, msgs []discord.Message) (map[discord.MessageID]discord.Message, error) {
+	refs := make(map[discord.MessageID]discord.Message)
+	var missing []discord.MessageReference
+	for _, m := range msgs {
+		if m.Type != discord.InlinedReplyMessage || m.Reference == nil || !m.Reference.MessageID.IsValid() {
+			continue
+		}
+		if m.ReferencedMessage != nil {
+			refs[m.Reference.MessageID] = *m.ReferencedMessage
+			continue
+		}
+		ref := *m.Reference
+		if !ref.ChannelID.IsValid() {
+			ref.ChannelID = m.ChannelID
+		}
+		missing = append(missing, ref)
+	}
+	for _, m := range msgs {
+		if _, ok := refs[m.ID]; !ok {
+			for _, ref := range missing {
+				if ref.MessageID == m.ID {
+					refs[m.ID] = m
+					break
+				}
+			}
+		}
+	}
+	for _, ref := range missing {
+		if _, ok := refs[ref.MessageID]; ok {
+			continue
+		}
+		stored, _, err := s.db.MessagesAfter(ctx, ref.ChannelID, ref.MessageID-1, 1)
+		if err != nil {
+			return nil, fmt.Errorf("fetching replied to message: %w", err)
+		}
+		if len(stored) > 0 && stored[0].ID == ref.MessageID {
+			refs[ref.MessageID] = stored[0]
+		}
+	}
+	return refs, nil
+}
+
+// reply returns what is shown above m if it is a reply, given the messages
+// replies refer to and the authors that are hidden.
+func (s *server) reply(m discord.Message, refs map[discord.MessageID]discord.Message, hidden map[discord.UserID]bool) *Reply {
+	if m.Type != discord.InlinedReplyMessage || m.Reference == nil || !m.Reference.MessageID.IsValid() {
+		return nil
+	}
+	chID := m.Reference.ChannelID
+	if !chID.IsValid() {
+		chID = m.ChannelID
+	}
+	reply := &Reply{
+		ID:  m.Reference.MessageID,
+		URL: fmt.Sprintf("/%s/%s/%s", m.GuildID, chID, m.Reference.MessageID),
+	}
+	ref, ok := refs[reply.ID]
+	switch {
+	case !ok:
+	case hidden[ref.Author.ID]:
+		reply.Author = hiddenAuthor.Name
+		reply.Hidden = true
+	default:
+		reply.Author = ref.Author.Username
+		ref.GuildID = m.GuildID
+		ref.Content = shortenText(ref.Content, ReplyPreviewLength)
+		reply.Content = s.renderContent(ref)
+	}
+	return reply
+}
+
+// shortenText puts text on one line and cuts it to at most n characters.
+func shortenText(text string, n int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if r := []rune(text); len(r) > n {
+		return strings.TrimSpace(string(r[:n])) + "…"
+	}
+	return text
+}
+
 func (s *server) author(m discord.Message) Author {
 	auth := Author{
 		ID:   m.Author.ID,
@@ -139,11 +265,11 @@ func (s *server) author(m discord.Message) Author {
 	if err != nil {
 		// not a real error, just means the user is not in the guild
 		m.Author.Avatar = ""
-		auth.Avatar = m.Author.AvatarURL() + "?size=128"
+		auth.Avatar = s.media.URL(m.Author.AvatarURL() + "?size=128")
 		return auth
 	}
 	fmt.Println(mr.User.Avatar)
-	auth.Avatar = mr.User.AvatarURL() + "?size=128"
+	auth.Avatar = s.media.URL(mr.User.AvatarURL() + "?size=128")
 	auth.OtherRoles = make([]*discord.Role, 0)
 
 	for _, rid := range mr.RoleIDs {
@@ -167,15 +293,30 @@ func (s *server) renderContent(m discord.Message) template.HTML {
 		(len(m.Embeds) == 1 && m.Embeds[0].Type == discord.ImageEmbed && m.Embeds[0].URL == m.Content) {
 		return ""
 	}
+	return s.renderMarkdown(m, m.Content)
+}
+
+// renderMarkdown renders text that is part of m, like its content or the
+// description of one of its embeds, as Discord's flavor of markdown.
+func (s *server) renderMarkdown(m discord.Message, text string) template.HTML {
+	if text == "" {
+		return ""
+	}
 	var sb strings.Builder
-	src := []byte(m.Content)
-	ast := discordmd.ParseWithMessage(src, *s.discord.Cabinet, &m, true)
+	src := []byte(text)
+	ast := discordmd.ParseWithMessage(src, *s.discord.Cabinet, &m, false)
+	transformMarkdown(ast, src)
 	renderer := renderer.NewRenderer(
 		renderer.WithNodeRenderers(
-			util.Prioritized(mdhtml.NewRenderer(), 0),
+			// lower values take precedence, so the default renderer
+			// only renders what the others don't
+			util.Prioritized(mdhtml.NewRenderer(), 1000),
 			util.Prioritized(mentionRenderer{}, 0),
-			util.Prioritized(emoteRenderer{}, 0),
+			util.Prioritized(emoteRenderer{s.media}, 0),
 			util.Prioritized(inlineRenderer{}, 0),
+			util.Prioritized(codeBlockRenderer{}, 0),
+			util.Prioritized(timestampRenderer{}, 0),
+			util.Prioritized(linkRenderer{}, 0),
 		),
 	)
 	renderer.Render(&sb, src, ast)
@@ -207,7 +348,9 @@ func (r mentionRenderer) render(writer util.BufWriter, source []byte, n ast.Node
 	return ast.WalkContinue, nil
 }
 
-type emoteRenderer struct{}
+type emoteRenderer struct {
+	media mediaURLs
+}
 
 func (r emoteRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
 	reg.Register(discordmd.KindEmoji, r.render)
@@ -216,7 +359,8 @@ func (r emoteRenderer) render(writer util.BufWriter, source []byte, n ast.Node,
 	if entering {
 		e, ok := n.(*discordmd.Emoji)
 		if ok {
-			writer.WriteString(`<img src='https://cdn.discordapp.com/emojis/` + e.ID + `.webp?size=40'></img>`)
+			src := r.media.URL("https://cdn.discordapp.com/emojis/" + e.ID + ".webp?size=40")
+			writer.WriteString(`<img src='` + html.EscapeString(src) + `'></img>`)
 		}
 	}
 	return ast.WalkContinue, nil
@@ -231,12 +375,16 @@ func (r inlineRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
 var attrElements = []struct {
 	Attr    discordmd.Attribute
 	Element string
+	// Attrs are the attributes of the opening tag.
+	Attrs string
 }{
-	{discordmd.AttrBold, "strong"},
-	{discordmd.AttrUnderline, "u"},
-	{discordmd.AttrItalics, "em"},
-	{discordmd.AttrStrikethrough, "del"},
-	{discordmd.AttrMonospace, "code"},
+	{discordmd.AttrBold, "strong", ""},
+	{discordmd.AttrUnderline, "u", ""},
+	{discordmd.AttrItalics, "em", ""},
+	{discordmd.AttrStrikethrough, "del", ""},
+	{discordmd.AttrMonospace, "code", ""},
+	// revealed by clicking, see static/spoiler.js
+	{discordmd.AttrSpoiler, "span", " class='spoiler' tabindex='0'"},
 }
 
 func (r inlineRenderer) render(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
@@ -246,6 +394,7 @@ func (r inlineRenderer) render(w util.BufWriter, source []byte, n ast.Node, ente
 			if i.Attr.Has(at.Attr) {
 				w.WriteString("<")
 				w.WriteString(at.Element)
+				w.WriteString(at.Attrs)
 				w.WriteString(">")
 			}
 		}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/IoIxD/dforum/database"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/state"
+)
+
+func TestMessageGroupsHideReferencedAuthors(t *testing.T) {
+	ctx := context.Background()
+	db := database.NewMemory()
+	s := &server{discord: state.New("Bot x"), db: db, URL: "https://dforum.example"}
+	hidden := discord.User{ID: 5, Username: "secret", Avatar: "secretavatar"}
+	shown := discord.User{ID: 6, Username: "visible"}
+	if err := db.SetOptOut(ctx, hidden.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	original := discord.Message{ID: 10, ChannelID: 2, Author: hidden, Content: "secret content"}
+	msgs := []discord.Message{{
+		ID:                11,
+		ChannelID:         2,
+		Type:              discord.InlinedReplyMessage,
+		Author:            shown,
+		Content:           "replying to <@5>",
+		Reference:         &discord.MessageReference{MessageID: 10, ChannelID: 2},
+		ReferencedMessage: &original,
+		Mentions:          []discord.GuildUser{{User: hidden}},
+	}}
+	grps, err := s.messageGroups(ctx, 1, msgs, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(grps) != 1 || len(grps[0].Messages) != 1 {
+		t.Fatalf("got %d groups, want 1 with 1 message", len(grps))
+	}
+	msg := grps[0].Messages[0]
+	if msg.Reply == nil || !msg.Reply.Hidden || msg.Reply.Content != "" {
+		t.Errorf("reply to hidden author is %+v, want hidden without content", msg.Reply)
+	}
+	b, err := json.Marshal(grps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, leak := range []string{original.Content, hidden.Username, string(hidden.Avatar)} {
+		if strings.Contains(string(b), leak) {
+			t.Errorf("served message contains %q:\n%s", leak, b)
+		}
+	}
+	if strings.Contains(string(msg.RenderedContent), hidden.Username) {
+		t.Errorf("rendered content %q names the hidden author", msg.RenderedContent)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IoIxD/dforum/database"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dforum_http_requests_total",
+		Help: "HTTP requests served, by route and status code.",
+	}, []string{"route", "method", "status"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dforum_http_request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests, by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+
+	discordRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dforum_discord_requests_total",
+		Help: "Requests made to the Discord REST API, by path and status code.",
+	}, []string{"path", "status"})
+	discordDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dforum_discord_request_duration_seconds",
+		Help:    "Latency of requests to the Discord REST API, by path.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"path"})
+
+	messageCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dforum_message_cache_requests_total",
+		Help: "Requests for a post's messages, by whether they were served from the database (hit) or had to wait for Discord (miss).",
+	}, []string{"result"})
+	messageLoads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dforum_message_loads_total",
+		Help: "Live fetches of a post's messages from Discord.",
+	})
+
+	dbDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dforum_database_query_duration_seconds",
+		Help:    "Latency of database queries, by method.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"method"})
+	dbErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dforum_database_errors_total",
+		Help: "Database queries that failed, by method.",
+	}, []string{"method"})
+
+	indexNowURLs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dforum_indexnow_urls_total",
+		Help: "URLs submitted to IndexNow, by whether the submission succeeded.",
+	}, []string{"result"})
+
+	crawlerPosts = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dforum_crawler_posts",
+		Help: "Posts in the current crawler pass (total), and how many have been checked (done).",
+	}, []string{"state"})
+	crawlerErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dforum_crawler_errors_total",
+		Help: "Posts whose messages the crawler failed to load.",
+	})
+
+	gatewayEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dforum_gateway_events_total",
+		Help: "Gateway events handled, by type.",
+	}, []string{"event"})
+
+	sitemapDuration = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dforum_sitemap_generation_seconds",
+		Help: "Time taken by the last sitemap generation.",
+	})
+	sitemapURLCount = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dforum_sitemap_urls",
+		Help: "Number of URLs in the last generated sitemap.",
+	})
+
+	mediaCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dforum_media_cache_requests_total",
+		Help: "Lookups in the media cache, by whether the media was cached (hit) or not (miss).",
+	}, []string{"result"})
+	mediaCacheBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dforum_media_cache_bytes",
+		Help: "Total size of the files in the media cache.",
+	})
+	mediaCacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dforum_media_cache_evictions_total",
+		Help: "Entries removed from the media cache to keep it within its size.",
+	})
+	mediaFetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dforum_media_fetches_total",
+		Help: "Media fetched from Discord by the media proxy, by status code.",
+	}, []string{"status"})
+)
+
+// instrument is middleware recording metrics about the requests it serves.
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+		next.ServeHTTP(ww, r)
+		route := chi.RouteContext(r.Context()).RoutePattern()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequests.WithLabelValues(route, metricsMethod(r.Method), strconv.Itoa(status)).Inc()
+		httpDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// metricsMethod returns method as a label. Methods other than those routes
+// are registered for are counted together, so that requests with made up
+// methods can't create new series.
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost:
+		return method
+	}
+	return "other"
+}
+
+var endpointSegment = regexp.MustCompile(`^@?[a-z][a-z-_]*$`)
+
+// discordPath returns the path of a Discord REST request with IDs, tokens and
+// other variable segments taken out, so that it can be used as a label.
+func discordPath(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) >= 2 && segments[0] == "api" {
+		segments = segments[2:]
+	}
+	for i, seg := range segments {
+		if !endpointSegment.MatchString(seg) {
+			segments[i] = "{id}"
+		}
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// observeDB records the latency of a database query started at start.
+func observeDB(method string, start time.Time, err error) {
+	dbDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		dbErrors.WithLabelValues(method).Inc()
+	}
+}
+
+// gatewayEventName returns the name of a gateway event type, such as
+// "MessageCreate" for *gateway.MessageCreateEvent.
+func gatewayEventName(ev interface{}) string {
+	name := fmt.Sprintf("%T", ev)
+	name = name[strings.LastIndexByte(name, '.')+1:]
+	return strings.TrimSuffix(name, "Event")
+}
+
+// metricsDB records query latencies of the database it wraps.
+type metricsDB struct {
+	database.Database
+}
+
+func (db metricsDB) SchemaVersion(ctx context.Context) (version int, err error) {
+	defer func(start time.Time) { observeDB("SchemaVersion", start, err) }(time.Now())
+	return db.Database.SchemaVersion(ctx)
+}
+
+func (db metricsDB) SetUpdatedAt(ctx context.Context, post discord.ChannelID, t time.Time) (err error) {
+	defer func(start time.Time) { observeDB("SetUpdatedAt", start, err) }(time.Now())
+	return db.Database.SetUpdatedAt(ctx, post, t)
+}
+
+func (db metricsDB) UpdatedAt(ctx context.Context, post discord.ChannelID) (t time.Time, err error) {
+	defer func(start time.Time) { observeDB("UpdatedAt", start, err) }(time.Now())
+	return db.Database.UpdatedAt(ctx, post)
+}
+
+func (db metricsDB) UpdateMessages(ctx context.Context, post discord.ChannelID, msgs []discord.Message) (err error) {
+	defer func(start time.Time) { observeDB("UpdateMessages", start, err) }(time.Now())
+	return db.Database.UpdateMessages(ctx, post, msgs)
+}
+
+func (db metricsDB) InsertMessage(ctx context.Context, msg discord.Message) (err error) {
+	defer func(start time.Time) { observeDB("InsertMessage", start, err) }(time.Now())
+	return db.Database.InsertMessage(ctx, msg)
+}
+
+func (db metricsDB) UpdateMessage(ctx context.Context, msg discord.Message) (err error) {
+	defer func(start time.Time) { observeDB("UpdateMessage", start, err) }(time.Now())
+	return db.Database.UpdateMessage(ctx, msg)
+}
+
+func (db metricsDB) DeleteMessage(ctx context.Context, msg discord.MessageID) (err error) {
+	defer func(start time.Time) { observeDB("DeleteMessage", start, err) }(time.Now())
+	return db.Database.DeleteMessage(ctx, msg)
+}
+
+func (db metricsDB) DeleteChannel(ctx context.Context, post discord.ChannelID) (err error) {
+	defer func(start time.Time) { observeDB("DeleteChannel", start, err) }(time.Now())
+	return db.Database.DeleteChannel(ctx, post)
+}
+
+func (db metricsDB) MessagesAfter(ctx context.Context, post discord.ChannelID, after discord.MessageID, limit uint) (msgs []discord.Message, hasbefore bool, err error) {
+	defer func(start time.Time) { observeDB("MessagesAfter", start, err) }(time.Now())
+	return db.Database.MessagesAfter(ctx, post, after, limit)
+}
+
+func (db metricsDB) MessagesBefore(ctx context.Context, post discord.ChannelID, before discord.MessageID, limit uint) (msgs []discord.Message, hasafter bool, err error) {
+	defer func(start time.Time) { observeDB("MessagesBefore", start, err) }(time.Now())
+	return db.Database.MessagesBefore(ctx, post, before, limit)
+}
+
+func (db metricsDB) MessageIndex(ctx context.Context, post discord.ChannelID, msg discord.MessageID) (index uint, found bool, err error) {
+	defer func(start time.Time) { observeDB("MessageIndex", start, err) }(time.Now())
+	return db.Database.MessageIndex(ctx, post, msg)
+}
+
+func (db metricsDB) SearchMessages(ctx context.Context, query string, posts []discord.ChannelID, limit, offset uint) (results []database.SearchResult, err error) {
+	defer func(start time.Time) { observeDB("SearchMessages", start, err) }(time.Now())
+	return db.Database.SearchMessages(ctx, query, posts, limit, offset)
+}
+
+func (db metricsDB) SetOptOut(ctx context.Context, user discord.UserID, optout bool) (err error) {
+	defer func(start time.Time) { observeDB("SetOptOut", start, err) }(time.Now())
+	return db.Database.SetOptOut(ctx, user, optout)
+}
+
+func (db metricsDB) OptedOut(ctx context.Context, users []discord.UserID) (optedout []discord.UserID, err error) {
+	defer func(start time.Time) { observeDB("OptedOut", start, err) }(time.Now())
+	return db.Database.OptedOut(ctx, users)
+}
+
+func (db metricsDB) SetGuild(ctx context.Context, guild discord.Guild) (err error) {
+	defer func(start time.Time) { observeDB("SetGuild", start, err) }(time.Now())
+	return db.Database.SetGuild(ctx, guild)
+}
+
+func (db metricsDB) Guilds(ctx context.Context) (guilds []discord.Guild, err error) {
+	defer func(start time.Time) { observeDB("Guilds", start, err) }(time.Now())
+	return db.Database.Guilds(ctx)
+}
+
+func (db metricsDB) DeleteGuild(ctx context.Context, guild discord.GuildID) (err error) {
+	defer func(start time.Time) { observeDB("DeleteGuild", start, err) }(time.Now())
+	return db.Database.DeleteGuild(ctx, guild)
+}
+
+func (db metricsDB) SetRole(ctx context.Context, guild discord.GuildID, role discord.Role) (err error) {
+	defer func(start time.Time) { observeDB("SetRole", start, err) }(time.Now())
+	return db.Database.SetRole(ctx, guild, role)
+}
+
+func (db metricsDB) DeleteRole(ctx context.Context, guild discord.GuildID, role discord.RoleID) (err error) {
+	defer func(start time.Time) { observeDB("DeleteRole", start, err) }(time.Now())
+	return db.Database.DeleteRole(ctx, guild, role)
+}
+
+func (db metricsDB) Roles(ctx context.Context, guild discord.GuildID) (roles []discord.Role, err error) {
+	defer func(start time.Time) { observeDB("Roles", start, err) }(time.Now())
+	return db.Database.Roles(ctx, guild)
+}
+
+func (db metricsDB) SetChannel(ctx context.Context, ch discord.Channel) (err error) {
+	defer func(start time.Time) { observeDB("SetChannel", start, err) }(time.Now())
+	return db.Database.SetChannel(ctx, ch)
+}
+
+func (db metricsDB) Channels(ctx context.Context, guild discord.GuildID) (channels []discord.Channel, err error) {
+	defer func(start time.Time) { observeDB("Channels", start, err) }(time.Now())
+	return db.Database.Channels(ctx, guild)
+}
+
+func (db metricsDB) SetThreadsFetchedAt(ctx context.Context, forum discord.ChannelID, t time.Time) (err error) {
+	defer func(start time.Time) { observeDB("SetThreadsFetchedAt", start, err) }(time.Now())
+	return db.Database.SetThreadsFetchedAt(ctx, forum, t)
+}
+
+func (db metricsDB) ThreadsFetchedAt(ctx context.Context, forum discord.ChannelID) (t time.Time, err error) {
+	defer func(start time.Time) { observeDB("ThreadsFetchedAt", start, err) }(time.Now())
+	return db.Database.ThreadsFetchedAt(ctx, forum)
+}
+
+func (db metricsDB) SetMember(ctx context.Context, guild discord.GuildID, member discord.Member) (err error) {
+	defer func(start time.Time) { observeDB("SetMember", start, err) }(time.Now())
+	return db.Database.SetMember(ctx, guild, member)
+}
+
+func (db metricsDB) DeleteMember(ctx context.Context, guild discord.GuildID, user discord.UserID) (err error) {
+	defer func(start time.Time) { observeDB("DeleteMember", start, err) }(time.Now())
+	return db.Database.DeleteMember(ctx, guild, user)
+}
+
+func (db metricsDB) Members(ctx context.Context, guild discord.GuildID) (members []discord.Member, err error) {
+	defer func(start time.Time) { observeDB("Members", start, err) }(time.Now())
+	return db.Database.Members(ctx, guild)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+)
+
+var commands = []api.CreateCommandData{{
+	Name:        "dforum",
+	Description: "Choose whether dforum shows your messages on the web",
+	Options: discord.CommandOptions{
+		&discord.SubcommandOption{
+			OptionName:  "optout",
+			Description: "Hide your messages and avatar on the web",
+		},
+		&discord.SubcommandOption{
+			OptionName:  "optin",
+			Description: "Show your messages and avatar on the web again",
+		},
+	},
+}}
+
+// registerCommands registers the bot's slash commands, replacing any that
+// are left over from before.
+func (s *server) registerCommands() error {
+	app := s.discord.Ready().Application
+	_, err := s.discord.BulkOverwriteCommands(app.ID, commands)
+	return err
+}
+
+func (s *server) handleInteraction(ev *gateway.InteractionCreateEvent) {
+	data, ok := ev.Data.(*discord.CommandInteraction)
+	if !ok || data.Name != "dforum" || len(data.Options) == 0 {
+		return
+	}
+	user := ev.Sender()
+	if user == nil {
+		return
+	}
+	var optout bool
+	var reply string
+	switch data.Options[0].Name {
+	case "optout":
+		optout = true
+		reply = "Your messages and avatar will no longer be shown on the web."
+	case "optin":
+		reply = "Your messages and avatar will be shown on the web again."
+	default:
+		return
+	}
+	if err := s.db.SetOptOut(context.Background(), user.ID, optout); err != nil {
+		log.Printf("setting opt-out of %s: %v", user.ID, err)
+		reply = "Something went wrong, please try again later."
+	}
+	err := s.discord.RespondInteraction(ev.ID, ev.Token, api.InteractionResponse{
+		Type: api.MessageInteractionWithSource,
+		Data: &api.InteractionResponseData{
+			Content: option.NewNullableString(reply),
+			Flags:   discord.EphemeralMessage,
+		},
+	})
+	if err != nil {
+		log.Printf("responding to interaction: %v", err)
+	}
+}
+
+// hiddenAuthors returns the authors of msgs whose messages must not be shown:
+// those that opted out, and those without consentRole if it is set.
+func (s *server) hiddenAuthors(ctx context.Context, guildID discord.GuildID, msgs []discord.Message, consentRole discord.RoleID) (map[discord.UserID]bool, error) {
+	var users []discord.UserID
+	hidden := make(map[discord.UserID]bool)
+	for _, m := range msgs {
+		if _, ok := hidden[m.Author.ID]; !ok {
+			hidden[m.Author.ID] = false
+			users = append(users, m.Author.ID)
+		}
+	}
+	optedout, err := s.db.OptedOut(ctx, users)
+	if err != nil {
+		return nil, fmt.Errorf("fetching opted out users: %w", err)
+	}
+	for _, user := range optedout {
+		hidden[user] = true
+	}
+	if consentRole.IsValid() {
+		for _, user := range users {
+			if !hidden[user] && !s.memberHasRole(guildID, user, consentRole) {
+				hidden[user] = true
+			}
+		}
+	}
+	return hidden, nil
+}
+
+func (s *server) memberHasRole(guildID discord.GuildID, user discord.UserID, role discord.RoleID) bool {
+	member, err := s.discord.Cabinet.Member(guildID, user)
+	if err != nil {
+		return false
+	}
+	for _, id := range member.RoleIDs {
+		if id == role {
+			return true
+		}
+	}
+	return false
+}
+
+// hiddenAuthor stands in for the author of hidden messages.
+var hiddenAuthor = Author{
+	Name:   "Hidden user",
+	Avatar: "https://cdn.discordapp.com/embed/avatars/0.png?size=128",
+}
+
+// hiddenMessage returns m with everything but its place in the post removed.
+func hiddenMessage(m discord.Message) Message {
+	return Message{Message: discord.Message{
+		ID:        m.ID,
+		ChannelID: m.ChannelID,
+		GuildID:   m.GuildID,
+		Timestamp: m.Timestamp,
+	}}
+}
+
+// hideMentions returns mentions with the users in hidden replaced by
+// hiddenAuthor, so that neither their names nor their avatars are shown.
+func hideMentions(mentions []discord.GuildUser, hidden map[discord.UserID]bool) []discord.GuildUser {
+	var shown []discord.GuildUser
+	for _, user := range mentions {
+		if hidden[user.ID] {
+			user = discord.GuildUser{User: discord.User{ID: user.ID, Username: hiddenAuthor.Name}}
+		}
+		shown = append(shown, user)
+	}
+	return shown
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/IoIxD/dforum/database"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/state"
+	"github.com/diamondburned/arikawa/v3/state/store"
+)
+
+// persistTimeout is how long a query persisting the state may take.
+const persistTimeout = 30 * time.Second
+
+// persistState makes the state save guilds, roles, forums, posts and members
+// to db as they arrive from the gateway, and load them back whenever it is
+// reset, which it is on every Ready. Pages can then be served without asking
+// Discord for everything again after a restart.
+//
+// Removing a guild or channel from the state doesn't delete it from db, as
+// that also happens when a guild becomes unavailable; purgeGuild and
+// purgeChannels take care of that, after flushing the returned queue.
+func persistState(st *state.State, db database.Database) *persistQueue {
+	q := newPersistQueue()
+	st.Cabinet.GuildStore = persistedGuilds{st.Cabinet.GuildStore, db, q}
+	st.Cabinet.RoleStore = persistedRoles{st.Cabinet.RoleStore, db, q}
+	st.Cabinet.ChannelStore = persistedChannels{st.Cabinet.ChannelStore, db, q}
+	st.Cabinet.MemberStore = persistedMembers{st.Cabinet.MemberStore, db, q}
+	return q
+}
+
+// persistQueue writes the state to the database in the background, so that
+// gateway events don't wait for the database. The writes queued while others
+// are made are made together next, and only the latest write to a row is
+// kept.
+type persistQueue struct {
+	mu sync.Mutex
+	// idle is signaled when the queue runs empty.
+	idle    *sync.Cond
+	running bool
+	// pending holds the writes to make by the row they write to, in the
+	// order of keys.
+	pending map[string]func(ctx context.Context) error
+	keys    []string
+}
+
+func newPersistQueue() *persistQueue {
+	q := &persistQueue{pending: make(map[string]func(ctx context.Context) error)}
+	q.idle = sync.NewCond(&q.mu)
+	return q
+}
+
+// Add queues write, replacing the queued write with the same key.
+func (q *persistQueue) Add(key string, write func(ctx context.Context) error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.pending[key]; !ok {
+		q.keys = append(q.keys, key)
+	}
+	q.pending[key] = write
+	if !q.running {
+		q.running = true
+		go q.run()
+	}
+}
+
+func (q *persistQueue) run() {
+	for {
+		q.mu.Lock()
+		if len(q.keys) == 0 {
+			q.running = false
+			q.idle.Broadcast()
+			q.mu.Unlock()
+			return
+		}
+		keys, pending := q.keys, q.pending
+		q.keys, q.pending = nil, make(map[string]func(ctx context.Context) error)
+		q.mu.Unlock()
+		for _, key := range keys {
+			ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+			if err := pending[key](ctx); err != nil {
+				log.Printf("persisting %s: %v", key, err)
+			}
+			cancel()
+		}
+	}
+}
+
+// Flush waits until the queued writes are made.
+func (q *persistQueue) Flush() {
+	q.mu.Lock()
+	for q.running {
+		q.idle.Wait()
+	}
+	q.mu.Unlock()
+}
+
+type persistedGuilds struct {
+	store.GuildStore
+	db    database.Database
+	queue *persistQueue
+}
+
+func (s persistedGuilds) Reset() error {
+	if err := s.GuildStore.Reset(); err != nil {
+		return err
+	}
+	s.queue.Flush()
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	guilds, err := s.db.Guilds(ctx)
+	if err != nil {
+		return fmt.Errorf("loading guilds: %w", err)
+	}
+	for i := range guilds {
+		if err := s.GuildStore.GuildSet(&guilds[i], false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s persistedGuilds) GuildSet(g *discord.Guild, update bool) error {
+	if err := s.GuildStore.GuildSet(g, update); err != nil {
+		return err
+	}
+	guild := *g
+	s.queue.Add("guild "+g.ID.String(), func(ctx context.Context) error {
+		return s.db.SetGuild(ctx, guild)
+	})
+	return nil
+}
+
+type persistedRoles struct {
+	store.RoleStore
+	db    database.Database
+	queue *persistQueue
+}
+
+func (s persistedRoles) Reset() error {
+	if err := s.RoleStore.Reset(); err != nil {
+		return err
+	}
+	s.queue.Flush()
+	return forEachGuild(s.db, func(ctx context.Context, guild discord.GuildID) error {
+		roles, err := s.db.Roles(ctx, guild)
+		if err != nil {
+			return fmt.Errorf("loading roles: %w", err)
+		}
+		for i := range roles {
+			if err := s.RoleStore.RoleSet(guild, &roles[i], false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s persistedRoles) RoleSet(guild discord.GuildID, r *discord.Role, update bool) error {
+	if err := s.RoleStore.RoleSet(guild, r, update); err != nil {
+		return err
+	}
+	role := *r
+	s.queue.Add("role "+r.ID.String(), func(ctx context.Context) error {
+		return s.db.SetRole(ctx, guild, role)
+	})
+	return nil
+}
+
+func (s persistedRoles) RoleRemove(guild discord.GuildID, role discord.RoleID) error {
+	if err := s.RoleStore.RoleRemove(guild, role); err != nil {
+		return err
+	}
+	s.queue.Add("role "+role.String(), func(ctx context.Context) error {
+		return s.db.DeleteRole(ctx, guild, role)
+	})
+	return nil
+}
+
+type persistedChannels struct {
+	store.ChannelStore
+	db    database.Database
+	queue *persistQueue
+}
+
+func (s persistedChannels) Reset() error {
+	if err := s.ChannelStore.Reset(); err != nil {
+		return err
+	}
+	s.queue.Flush()
+	return forEachGuild(s.db, func(ctx context.Context, guild discord.GuildID) error {
+		channels, err := s.db.Channels(ctx, guild)
+		if err != nil {
+			return fmt.Errorf("loading channels: %w", err)
+		}
+		for i := range channels {
+			if err := s.ChannelStore.ChannelSet(&channels[i], false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s persistedChannels) ChannelSet(ch *discord.Channel, update bool) error {
+	if err := s.ChannelStore.ChannelSet(ch, update); err != nil {
+		return err
+	}
+	channel := *ch
+	s.queue.Add("channel "+ch.ID.String(), func(ctx context.Context) error {
+		return s.db.SetChannel(ctx, channel)
+	})
+	return nil
+}
+
+type persistedMembers struct {
+	store.MemberStore
+	db    database.Database
+	queue *persistQueue
+}
+
+func (s persistedMembers) Reset() error {
+	if err := s.MemberStore.Reset(); err != nil {
+		return err
+	}
+	s.queue.Flush()
+	return forEachGuild(s.db, func(ctx context.Context, guild discord.GuildID) error {
+		members, err := s.db.Members(ctx, guild)
+		if err != nil {
+			return fmt.Errorf("loading members: %w", err)
+		}
+		for i := range members {
+			if err := s.MemberStore.MemberSet(guild, &members[i], false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s persistedMembers) MemberSet(guild discord.GuildID, m *discord.Member, update bool) error {
+	if err := s.MemberStore.MemberSet(guild, m, update); err != nil {
+		return err
+	}
+	member := *m
+	s.queue.Add("member "+guild.String()+" "+m.User.ID.String(), func(ctx context.Context) error {
+		return s.db.SetMember(ctx, guild, member)
+	})
+	return nil
+}
+
+func (s persistedMembers) MemberRemove(guild discord.GuildID, user discord.UserID) error {
+	if err := s.MemberStore.MemberRemove(guild, user); err != nil {
+		return err
+	}
+	s.queue.Add("member "+guild.String()+" "+user.String(), func(ctx context.Context) error {
+		return s.db.DeleteMember(ctx, guild, user)
+	})
+	return nil
+}
+
+// forEachGuild calls fn with every guild stored in db, giving each call
+// persistTimeout.
+func forEachGuild(db database.Database, fn func(ctx context.Context, guild discord.GuildID) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	guilds, err := db.Guilds(ctx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("loading guilds: %w", err)
+	}
+	for _, guild := range guilds {
+		ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+		err := fn(ctx, guild.ID)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
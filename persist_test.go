@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestPersistQueue(t *testing.T) {
+	q := newPersistQueue()
+	var mu sync.Mutex
+	var written []string
+	write := func(key, value string) {
+		q.Add(key, func(ctx context.Context) error {
+			mu.Lock()
+			written = append(written, value)
+			mu.Unlock()
+			return nil
+		})
+	}
+	// held up until everything is queued
+	block := make(chan struct{})
+	q.Add("block", func(ctx context.Context) error {
+		<-block
+		return nil
+	})
+	write("a", "a1")
+	write("b", "b1")
+	write("a", "a2")
+	close(block)
+	q.Flush()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(written) != 2 || written[0] != "a2" || written[1] != "b1" {
+		t.Errorf("wrote %v, want [a2 b1]", written)
+	}
+}
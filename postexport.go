@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/go-chi/chi/v5"
+)
+
+// postExport is a whole post, as it is downloaded from the export endpoints.
+type postExport struct {
+	Guild struct {
+		ID   discord.GuildID `json:"id"`
+		Name string          `json:"name"`
+	} `json:"guild"`
+	Forum         *discord.Channel `json:"forum"`
+	Post          Post             `json:"post"`
+	URL           string           `json:"url"`
+	Exported      time.Time        `json:"exported"`
+	MessageGroups []MessageGroup   `json:"message_groups"`
+	// CodeCSS highlights code blocks in the HTML file, which has to stand
+	// on its own.
+	CodeCSS template.CSS `json:"-"`
+}
+
+// getPostExport serves every message of a post as a Markdown, HTML or JSON
+// file to download. Hidden authors are left out like on the post page.
+func (s *server) getPostExport(w http.ResponseWriter, r *http.Request) {
+	guild, ok := s.guildFromReq(w, r)
+	if !ok {
+		return
+	}
+	forum, ok := s.forumFromReq(w, r)
+	if !ok {
+		return
+	}
+	post, ok := s.postFromReq(w, r)
+	if !ok {
+		return
+	}
+	if forum.Type != discord.GuildForum || post.ParentID != forum.ID {
+		s.displayErr(w, http.StatusNotFound, nil)
+		return
+	}
+	msgs, err := s.allMessages(r.Context(), post.ID)
+	if err != nil {
+		s.displayErr(w, http.StatusInternalServerError,
+			fmt.Errorf("fetching post's messages: %w", err))
+		return
+	}
+	if err := s.ensureMembers(r.Context(), *post, msgs); err != nil {
+		s.displayErr(w, http.StatusInternalServerError,
+			fmt.Errorf("fetching post's members: %w", err))
+		return
+	}
+	consentRole, err := s.consentRole(forum)
+	if err != nil {
+		s.displayErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	msgrps, err := s.messageGroups(r.Context(), guild.ID, msgs, consentRole)
+	if err != nil {
+		s.displayErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	if msgrps == nil {
+		msgrps = []MessageGroup{}
+	}
+	export := postExport{
+		Forum:         forum,
+		Post:          newPost(forum, *post),
+		URL:           fmt.Sprintf("%s/%s/%s/%s", s.URL, guild.ID, forum.ID, post.ID),
+		Exported:      time.Now().UTC(),
+		MessageGroups: msgrps,
+	}
+	export.Guild.ID = guild.ID
+	export.Guild.Name = guild.Name
+
+	var buf bytes.Buffer
+	var contentType string
+	switch format := chi.URLParam(r, "format"); format {
+	case "md":
+		contentType = "text/markdown; charset=utf-8"
+		s.writePostMarkdown(&buf, export)
+	case "html":
+		contentType = "text/html; charset=utf-8"
+		if css, err := fs.ReadFile(s.fsys, "static/code.css"); err == nil {
+			export.CodeCSS = template.CSS(css)
+		}
+		if err := s.executeTemplateFn(&buf, "postexport.gohtml", export); err != nil {
+			s.displayErr(w, http.StatusInternalServerError, err)
+			return
+		}
+	case "json":
+		contentType = "application/json"
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(export); err != nil {
+			s.displayErr(w, http.StatusInternalServerError, err)
+			return
+		}
+	default:
+		s.displayErr(w, http.StatusNotFound, nil)
+		return
+	}
+	name := fmt.Sprintf("dforum-%s.%s", post.ID, chi.URLParam(r, "format"))
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(buf.Bytes()))
+}
+
+// allMessages returns every message in a post, oldest first.
+func (s *server) allMessages(ctx context.Context, post discord.ChannelID) ([]discord.Message, error) {
+	var all []discord.Message
+	var after discord.MessageID
+	for {
+		msgs, _, hasafter, err := s.messageCache.MessagesAfter(ctx, post, after, 100)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, msgs...)
+		if !hasafter || len(msgs) == 0 {
+			return all, nil
+		}
+		after = msgs[len(msgs)-1].ID
+	}
+}
+
+const exportTimeFormat = "January 2, 2006 3:04 PM MST"
+
+// writePostMarkdown writes export as Markdown. Message contents are already
+// Markdown, so they are kept as they are apart from mentions.
+func (s *server) writePostMarkdown(buf *bytes.Buffer, export postExport) {
+	fmt.Fprintf(buf, "# %s\n\n", export.Post.Name)
+	fmt.Fprintf(buf, "%s › %s — <%s>\n\n", export.Guild.Name, export.Forum.Name, export.URL)
+	fmt.Fprintf(buf, "Exported %s\n", export.Exported.Format(exportTimeFormat))
+	for _, grp := range export.MessageGroups {
+		buf.WriteString("\n---\n\n")
+		fmt.Fprintf(buf, "### %s", grp.Author.Name)
+		if grp.Author.Role != "" {
+			fmt.Fprintf(buf, " (%s)", grp.Author.Role)
+		}
+		if grp.Author.Bot {
+			buf.WriteString(" [BOT]")
+		}
+		buf.WriteString("\n\n")
+		if grp.Hidden {
+			buf.WriteString("*This user's messages are hidden.*\n\n")
+		}
+		for _, msg := range grp.Messages {
+			fmt.Fprintf(buf, "*%s", msg.ID.Time().UTC().Format(exportTimeFormat))
+			if msg.EditedTimestamp.IsValid() {
+				buf.WriteString(" (edited)")
+			}
+			buf.WriteString("*\n\n")
+			if msg.Reply != nil {
+				to := msg.Reply.Author
+				if to == "" {
+					to = "a message that could not be loaded"
+				}
+				fmt.Fprintf(buf, "> ↪ Replying to %s\n\n", to)
+			}
+			if content := s.plainMentions(msg.Message); content != "" {
+				buf.WriteString(content)
+				buf.WriteString("\n\n")
+			}
+			var items []string
+			for _, att := range msg.Attachments {
+				items = append(items, fmt.Sprintf("Attachment: [%s](<%s>)", att.Filename, s.media.URL(att.URL)))
+			}
+			for _, e := range msg.Embeds {
+				if e.URL != "" && e.Type != discord.ImageEmbed && e.Type != discord.GIFVEmbed {
+					items = append(items, fmt.Sprintf("Link: [%s](<%s>)", e.Title, e.URL))
+				}
+			}
+			if len(msg.Reactions) > 0 {
+				var reactions []string
+				for _, re := range msg.Reactions {
+					name := re.Emoji.Name
+					if re.Emoji.IsCustom() {
+						name = ":" + name + ":"
+					}
+					reactions = append(reactions, fmt.Sprintf("%s %d", name, re.Count))
+				}
+				items = append(items, "Reactions: "+strings.Join(reactions, ", "))
+			}
+			for _, item := range items {
+				fmt.Fprintf(buf, "- %s\n", item)
+			}
+			if len(items) > 0 {
+				buf.WriteString("\n")
+			}
+		}
+	}
+}
+
+var mentionPattern = regexp.MustCompile(`<(@!?|@&|#)(\d+)>`)
+
+// plainMentions returns the content of m with mentions replaced by the names
+// they stand for, where they are known.
+func (s *server) plainMentions(m discord.Message) string {
+	return mentionPattern.ReplaceAllStringFunc(m.Content, func(mention string) string {
+		match := mentionPattern.FindStringSubmatch(mention)
+		sf, err := discord.ParseSnowflake(match[2])
+		if err != nil {
+			return mention
+		}
+		switch match[1] {
+		case "@", "@!":
+			for _, user := range m.Mentions {
+				if discord.Snowflake(user.ID) == sf {
+					return "@" + user.Username
+				}
+			}
+		case "@&":
+			if role, err := s.discord.Cabinet.Role(m.GuildID, discord.RoleID(sf)); err == nil {
+				return "@" + role.Name
+			}
+		case "#":
+			if ch, err := s.discord.Cabinet.Channel(discord.ChannelID(sf)); err == nil {
+				return "#" + ch.Name
+			}
+		}
+		return mention
+	})
+}
@@ -0,0 +1,17 @@
+// Shows a button to copy every code block to the clipboard.
+document.querySelectorAll(".codeblock").forEach(function (block) {
+    var button = block.querySelector(".copy-code");
+    var code = block.querySelector("code");
+    if (!button || !code || !navigator.clipboard) {
+        return;
+    }
+    button.hidden = false;
+    button.addEventListener("click", function () {
+        navigator.clipboard.writeText(code.innerText).then(function () {
+            button.textContent = "Copied";
+            setTimeout(function () {
+                button.textContent = "Copy";
+            }, 2000);
+        });
+    });
+});
@@ -0,0 +1,13 @@
+// Reveals spoilers for good once they are clicked, rather than only while
+// they are focused.
+document.querySelectorAll(".spoiler").forEach(function (spoiler) {
+    spoiler.addEventListener("click", function () {
+        spoiler.classList.add("revealed");
+    });
+    spoiler.addEventListener("keydown", function (e) {
+        if (e.key === "Enter" || e.key === " ") {
+            e.preventDefault();
+            spoiler.classList.add("revealed");
+        }
+    });
+});
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/IoIxD/dforum/database"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/go-chi/chi/v5"
+)
+
+// MessageResult is a message matching a search query.
+type MessageResult struct {
+	Post    discord.Channel
+	Message discord.Message
+	Snippet template.HTML
+	URL     string
+}
+
+// searchBatch is how many results searchMessages fetches at once.
+const searchBatch = 100
+
+// searchMessages searches the cached content of posts, returning the given
+// page of results and whether there is a next page. Results by hidden
+// authors are left out before paging, so that every page but the last is
+// full.
+func (s *server) searchMessages(ctx context.Context, posts []discord.Channel, query string, page int) ([]MessageResult, bool, error) {
+	ids := make([]discord.ChannelID, len(posts))
+	byID := make(map[discord.ChannelID]discord.Channel, len(posts))
+	for i, post := range posts {
+		ids[i] = post.ID
+		byID[post.ID] = post
+	}
+	skip := (page - 1) * 25
+	var msgresults []MessageResult
+	consentRoles := make(map[discord.ChannelID]discord.RoleID)
+	for offset := uint(0); ; {
+		results, err := s.db.SearchMessages(ctx, query, ids, searchBatch, offset)
+		if err != nil {
+			return nil, false, fmt.Errorf("searching messages: %w", err)
+		}
+		hidden, err := s.hiddenResults(ctx, byID, results, consentRoles)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, result := range results {
+			post := byID[result.Message.ChannelID]
+			if hidden[result.Message.ID] {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			msgresults = append(msgresults, MessageResult{
+				Post:    post,
+				Message: result.Message,
+				Snippet: highlightSnippet(result.Snippet),
+				URL:     messageURL(post, result.Message.ID),
+			})
+			if len(msgresults) > 25 {
+				return msgresults[:25], true, nil
+			}
+		}
+		if len(results) < searchBatch {
+			return msgresults, false, nil
+		}
+		offset += uint(len(results))
+	}
+}
+
+// hiddenResults returns which of results are by hidden authors, by message
+// ID. The results are grouped by the guild and consent role of their posts,
+// so that each group is checked at once. consentRoles caches the consent
+// roles of forums across calls.
+func (s *server) hiddenResults(ctx context.Context, byID map[discord.ChannelID]discord.Channel, results []database.SearchResult, consentRoles map[discord.ChannelID]discord.RoleID) (map[discord.MessageID]bool, error) {
+	type group struct {
+		guildID discord.GuildID
+		role    discord.RoleID
+	}
+	groups := make(map[group][]discord.Message)
+	for _, result := range results {
+		post := byID[result.Message.ChannelID]
+		role, ok := consentRoles[post.ParentID]
+		if !ok {
+			if forum, err := s.channel(post.ParentID); err == nil {
+				role, _ = s.consentRole(forum)
+			}
+			consentRoles[post.ParentID] = role
+		}
+		grp := group{post.GuildID, role}
+		groups[grp] = append(groups[grp], result.Message)
+	}
+	hidden := make(map[discord.MessageID]bool)
+	for grp, msgs := range groups {
+		if grp.role.IsValid() {
+			// whether authors have the role is only known if they are cached
+			byPost := make(map[discord.ChannelID][]discord.Message)
+			for _, m := range msgs {
+				byPost[m.ChannelID] = append(byPost[m.ChannelID], m)
+			}
+			for id, postMsgs := range byPost {
+				if err := s.ensureMembers(ctx, byID[id], postMsgs); err != nil {
+					return nil, fmt.Errorf("fetching post's members: %w", err)
+				}
+			}
+		}
+		authors, err := s.hiddenAuthors(ctx, grp.guildID, msgs, grp.role)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			hidden[m.ID] = authors[m.Author.ID]
+		}
+	}
+	return hidden, nil
+}
+
+// highlightSnippet escapes a search snippet and marks up its highlighted
+// terms.
+func highlightSnippet(snippet string) template.HTML {
+	escaped := html.EscapeString(snippet)
+	escaped = strings.ReplaceAll(escaped, database.HighlightStart, "<mark>")
+	escaped = strings.ReplaceAll(escaped, database.HighlightEnd, "</mark>")
+	return template.HTML(escaped)
+}
+
+// matchPosts returns the threads in forum whose titles contain the query or,
+// failing that, any of its words. Titles containing the whole query come
+// first.
+func matchPosts(forum *discord.Channel, threads []discord.Channel, query string) []Post {
+	query = strings.ToLower(query)
+	words := strings.Fields(query)
+	var posts []Post
+	titles := make(map[string]struct{})
+	for _, thread := range threads {
+		name := strings.ToLower(thread.Name)
+		if _, ok := titles[name]; ok {
+			continue
+		}
+		matched := strings.Contains(name, query)
+		for _, word := range words {
+			if matched {
+				break
+			}
+			matched = len(word) > 1 && strings.Contains(name, word)
+		}
+		if matched {
+			posts = append(posts, newPost(forum, thread))
+			titles[name] = struct{}{}
+		}
+	}
+	sortByExactMatch(posts, query)
+	return posts
+}
+
+func sortByExactMatch(posts []Post, query string) {
+	query = strings.ToLower(query)
+	sort.SliceStable(posts, func(i, j int) bool {
+		return strings.Contains(strings.ToLower(posts[i].Name), query) &&
+			!strings.Contains(strings.ToLower(posts[j].Name), query)
+	})
+}
+
+// ForumResults are the search results from a single forum.
+type ForumResults struct {
+	Forum    discord.Channel
+	Posts    []Post
+	Messages []MessageResult
+}
+
+func (s *server) searchGuild(w http.ResponseWriter, r *http.Request) {
+	guild, ok := s.guildFromReq(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query().Get("q")
+	ctx := struct {
+		Guild       *discord.Guild
+		Forums      []ForumResults
+		Prev        int
+		Next        int
+		URL         string
+		Query       string
+		AppendedStr string
+	}{Guild: guild,
+		URL:         s.URL,
+		Query:       query,
+		AppendedStr: "/search?q=" + url.QueryEscape(query),
+	}
+	if query == "" {
+		s.executeTemplate(w, r, "searchguild.gohtml", ctx)
+		return
+	}
+	channels, err := s.channels(guild.ID)
+	if err != nil {
+		s.displayErr(w, http.StatusInternalServerError,
+			fmt.Errorf("fetching guild threads: %w", err))
+		return
+	}
+	forums, err := s.visibleForums(guild, channels)
+	if err != nil {
+		s.displayErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	var posts []Post
+	var threads []discord.Channel
+	for i, forum := range forums {
+		if forum.NSFW {
+			continue
+		}
+		forumthreads := forumThreads(forum.ID, channels)
+		threads = append(threads, forumthreads...)
+		posts = append(posts, matchPosts(&forums[i], forumthreads, query)...)
+	}
+	sortByExactMatch(posts, query)
+	page, err := strconv.Atoi(chi.URLParam(r, "page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	posts, ctx.Prev, ctx.Next = paginate(posts, page)
+	msgs, more, err := s.searchMessages(r.Context(), threads, query, page)
+	if err != nil {
+		s.displayErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	if more {
+		ctx.Next = page + 1
+	}
+
+	results := make(map[discord.ChannelID]*ForumResults)
+	for _, forum := range forums {
+		results[forum.ID] = &ForumResults{Forum: forum}
+	}
+	for _, post := range posts {
+		results[post.ParentID].Posts = append(results[post.ParentID].Posts, post)
+	}
+	for _, msg := range msgs {
+		results[msg.Post.ParentID].Messages = append(results[msg.Post.ParentID].Messages, msg)
+	}
+	for _, forum := range forums {
+		if res := results[forum.ID]; len(res.Posts) > 0 || len(res.Messages) > 0 {
+			ctx.Forums = append(ctx.Forums, *res)
+		}
+	}
+	s.executeTemplate(w, r, "searchguild.gohtml", ctx)
+}
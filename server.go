@@ -10,8 +10,7 @@ import (
 	"io/fs"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
+	"net/url"
 	"regexp"
 	"sort"
 	"strconv"
@@ -23,17 +22,21 @@ import (
 	"github.com/diamondburned/arikawa/v3/discord"
 	"github.com/diamondburned/arikawa/v3/gateway"
 	"github.com/diamondburned/arikawa/v3/state"
+	"github.com/diamondburned/arikawa/v3/utils/handler"
 	"github.com/diamondburned/arikawa/v3/utils/httputil"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"golang.org/x/exp/slices"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type server struct {
 	r *chi.Mux
 
 	discord      *state.State
+	db           database.Database
 	messageCache *messageCache
+	// fsys holds the static files and templates.
+	fsys fs.FS
 
 	fetchedInactiveMu sync.Mutex
 	fetchedInactive   map[discord.ChannelID]struct{}
@@ -41,14 +44,40 @@ type server struct {
 	requestMembers sync.Mutex
 	membersGot     map[discord.ChannelID]struct{}
 
-	sitemapMu     sync.Mutex
+	sitemapMu sync.Mutex
+	// sitemaps holds the files last written for each guild, and
+	// sitemapDirty the guilds that changed since.
+	sitemaps      map[discord.GuildID][]sitemapFile
+	sitemapDirty  map[discord.GuildID]struct{}
 	updateSitemap chan struct{}
 
+	gatewayMu        sync.Mutex
+	gatewayConnected bool
+	gatewayChanged   time.Time
+	gatewayErr       error
+
+	startedAt time.Time
+
+	crawlMu sync.Mutex
+	crawl   crawlProgress
+
+	// persisted writes the state to db.
+	persisted *persistQueue
+
+	// indexNow is nil unless IndexNow is enabled.
+	indexNow *indexNow
+
+	media mediaURLs
+	// mediaProxy is nil unless the media proxy is enabled.
+	mediaProxy *mediaProxy
+
 	// configuration options
 	URL               string
 	ServiceName       string
 	ServerHostedIn    string
 	SitemapDir        string
+	crawlWorkers      int
+	crawlRate         float64
 	executeTemplateFn ExecuteTemplateFunc
 
 	buffers *sync.Pool
@@ -65,14 +94,47 @@ func newServer(st *state.State, fsys fs.FS, db database.Database, config config)
 	}
 	srv := &server{
 		fetchedInactive: make(map[discord.ChannelID]struct{}),
+		sitemapDirty:    make(map[discord.GuildID]struct{}),
 		discord:         st,
+		db:              db,
 		messageCache:    newMessageCache(st, db),
+		fsys:            fsys,
 		buffers:         &sync.Pool{New: func() interface{} { return new(bytes.Buffer) }},
 		URL:             config.SiteURL,
 		ServiceName:     config.ServiceName,
 		ServerHostedIn:  config.ServerHostedIn,
 		optionsRegex:    optionsRegex,
 		SitemapDir:      config.SitemapDir,
+		gatewayChanged:  time.Now(),
+		startedAt:       time.Now(),
+		crawlWorkers:    config.CrawlWorkers,
+		crawlRate:       config.CrawlRequestsPerSecond,
+		media:           newMediaURLs(config),
+	}
+	st.AddHandler(func(ev interface{}) {
+		gatewayEvents.WithLabelValues(gatewayEventName(ev)).Inc()
+	})
+	st.AddHandler(srv.handleGatewayStatus)
+	if config.SitemapDir != "" {
+		srv.sitemaps, err = readSitemaps(config.SitemapDir)
+		if err != nil {
+			return nil, fmt.Errorf("reading sitemaps: %w", err)
+		}
+	}
+	st.AddHandler(srv.handleSitemapChange)
+	if config.IndexNowKey != "" {
+		srv.indexNow, err = newIndexNow(config.IndexNowEndpoint, config.IndexNowKey, config.SiteURL)
+		if err != nil {
+			return nil, err
+		}
+		st.AddHandler(srv.handleIndexNow)
+	}
+	if config.MediaCacheDir != "" {
+		cache, err := openMediaCache(config.MediaCacheDir, config.MediaCacheSize<<20)
+		if err != nil {
+			return nil, err
+		}
+		srv.mediaProxy = newMediaProxy(srv.media, cache, srv.refreshAttachmentURL)
 	}
 	st.AddHandler(func(m *gateway.MessageCreateEvent) {
 		srv.messageCache.Set(context.Background(), m.Message, false)
@@ -86,24 +148,73 @@ func newServer(st *state.State, fsys fs.FS, db database.Database, config config)
 	st.AddHandler(func(m *gateway.ThreadUpdateEvent) {
 		srv.messageCache.HandleThreadUpdateEvent(m)
 	})
+	st.AddHandler(func(m *gateway.MessageDeleteBulkEvent) {
+		for _, id := range m.IDs {
+			srv.messageCache.Remove(context.Background(), m.ChannelID, id)
+		}
+	})
+	st.AddHandler(func(m *gateway.ThreadDeleteEvent) {
+		srv.purgeChannels(m.ID)
+	})
+	st.AddHandler(srv.handleChannelDelete)
+	st.AddHandler(srv.handleThreadListSync)
+	st.AddHandler(srv.handleInteraction)
+	// The state forgets a guild's channels as soon as it's deleted, so they
+	// have to be collected beforehand.
+	if st.PreHandler == nil {
+		st.PreHandler = handler.New()
+	}
+	st.PreHandler.AddSyncHandler(srv.handleGuildDelete)
+	// These run before any later event changes the state again.
+	st.AddSyncHandler(srv.handleReady)
+	st.AddSyncHandler(srv.handleGuildCreate)
+	srv.persisted = persistState(st, db)
 	r := chi.NewRouter()
 	srv.r = r
 	srv.updateSitemap = make(chan struct{}, 1)
 	r.Use(middleware.Logger)
+	r.Use(instrument)
+	if !config.DisableMetrics && config.MetricsListenAddr == "" {
+		getHead(r, "/metrics", promhttp.Handler().ServeHTTP)
+	}
+	getHead(r, "/healthz", srv.getHealthz)
+	getHead(r, "/readyz", srv.getReadyz)
 	getHead(r, `/sitemap/*`, srv.getSitemap)
 	getHead(r, `/sitemap.xml`, srv.getSitemap)
+	if srv.indexNow != nil {
+		getHead(r, indexNowKeyPath(config.IndexNowKey), srv.indexNow.serveKey)
+	}
+	if srv.mediaProxy != nil {
+		getHead(r, "/media/*", srv.getMedia)
+	}
 	getHead(r, "/", srv.getIndex)
+	r.Route("/api/v1", srv.apiRoutes)
 	r.Route("/{guildID:\\d+}", func(r chi.Router) {
 		getHead(r, "/", srv.getGuild)
+		getHead(r, "/search", srv.searchGuild)
+		getHead(r, "/feed.atom", srv.getGuildFeed)
+		getHead(r, "/feed.rss", srv.getGuildFeed)
+		getHead(r, "/page/{page:\\d+}/search", srv.searchGuild)
 		r.Route("/{forumID:\\d+}", func(r chi.Router) {
 			getHead(r, "/", srv.getForum)
 			getHead(r, "/search", srv.searchForum)
+			getHead(r, "/feed.atom", srv.getForumFeed)
+			getHead(r, "/feed.rss", srv.getForumFeed)
 			r.Route("/page/{page:\\d+}", func(r chi.Router) {
 				getHead(r, "/", srv.getForum)
 				getHead(r, "/search", srv.searchForum)
 			})
+			r.Route("/tag/{tagID:\\d+}", func(r chi.Router) {
+				getHead(r, "/", srv.getForum)
+				getHead(r, "/page/{page:\\d+}", srv.getForum)
+				getHead(r, "/feed.atom", srv.getForumFeed)
+				getHead(r, "/feed.rss", srv.getForumFeed)
+			})
 			r.Route("/{postID:\\d+}", func(r chi.Router) {
 				getHead(r, "/", srv.getPost)
+				getHead(r, "/feed.atom", srv.getPostFeed)
+				getHead(r, "/feed.rss", srv.getPostFeed)
+				getHead(r, "/export.{format:md|html|json}", srv.getPostExport)
 			})
 		})
 	})
@@ -117,28 +228,15 @@ func newServer(st *state.State, fsys fs.FS, db database.Database, config config)
 	return srv, nil
 }
 
+// UpdateSitemap keeps the sitemap up to date, rewriting the sitemaps of the
+// guilds that changed every sitemapInterval or when asked to.
 func (s *server) UpdateSitemap() {
-	first := true
-	ticker := time.NewTicker(6 * time.Hour)
+	log.Println("Waiting 60 seconds before generating sitemap.")
+	time.Sleep(60 * time.Second)
+	ticker := time.NewTicker(sitemapInterval)
 	for {
-		index := filepath.Join(s.SitemapDir, "sitemap.xml")
-		stat, err := os.Stat(index)
-		if err != nil && !errors.Is(err, os.ErrNotExist) {
-			log.Println("Error occured while reading sitemap last modified time:", err)
-			continue
-		}
-		if err == nil && time.Since(stat.ModTime()) < 6*time.Hour {
-			continue
-		} else {
-			if first {
-				log.Println("Waiting 60 seconds before generating sitemap.")
-				time.Sleep(60 * time.Second)
-				first = false
-			}
-			err = s.writeSitemap()
-			if err != nil {
-				log.Println("Error occured while writing sitemap:", err)
-			}
+		if err := s.writeSitemap(); err != nil {
+			log.Println("Error occured while writing sitemap:", err)
 		}
 		select {
 		case <-ticker.C:
@@ -147,6 +245,15 @@ func (s *server) UpdateSitemap() {
 	}
 }
 
+// requestSitemapUpdate asks for the sitemap to be rebuilt, unless a rebuild
+// is already pending.
+func (s *server) requestSitemapUpdate() {
+	select {
+	case s.updateSitemap <- struct{}{}:
+	default:
+	}
+}
+
 func getHead(r chi.Router, path string, handler http.HandlerFunc) {
 	r.Get(path, handler)
 	r.Head(path, handler)
@@ -172,12 +279,15 @@ func (s *server) executeTemplate(w http.ResponseWriter, r *http.Request,
 	s.buffers.Put(buf)
 }
 
+// errorPage is what error.gohtml is executed with.
+type errorPage struct {
+	Error      error
+	StatusText string
+	StatusCode int
+}
+
 func (s *server) displayErr(w http.ResponseWriter, status int, err error) {
-	ctx := struct {
-		Error      error
-		StatusText string
-		StatusCode int
-	}{err, http.StatusText(status), status}
+	ctx := errorPage{err, http.StatusText(status), status}
 	w.WriteHeader(status)
 	s.executeTemplateFn(w, "error.gohtml", ctx)
 }
@@ -235,9 +345,16 @@ func (s *server) getIndex(w http.ResponseWriter, r *http.Request) {
 
 type ForumChannel struct {
 	discord.Channel
-	Posts             []discord.Channel
-	TotalMessageCount int
-	LastActive        time.Time
+	Posts             []discord.Channel `json:"-"`
+	TotalMessageCount int               `json:"total_message_count"`
+	LastActive        time.Time         `json:"last_active"`
+}
+
+// guildPage is what guild.gohtml is executed with.
+type guildPage struct {
+	Guild         *discord.Guild
+	ForumChannels []ForumChannel
+	URL           string
 }
 
 func (s *server) getGuild(w http.ResponseWriter, r *http.Request) {
@@ -245,11 +362,7 @@ func (s *server) getGuild(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		return
 	}
-	ctx := struct {
-		Guild         *discord.Guild
-		ForumChannels []ForumChannel
-		URL           string
-	}{Guild: guild, URL: s.URL}
+	ctx := guildPage{Guild: guild, URL: s.URL}
 
 	channels, err := s.channels(guild.ID)
 	if err != nil {
@@ -257,30 +370,24 @@ func (s *server) getGuild(w http.ResponseWriter, r *http.Request) {
 			fmt.Errorf("fetching guild channels: %s", err))
 		return
 	}
-	me, _ := s.discord.Cabinet.Me()
-	selfMember, err := s.discord.Member(guild.ID, me.ID)
+	ctx.ForumChannels, err = s.forumChannels(guild, channels)
 	if err != nil {
-		s.displayErr(w, http.StatusInternalServerError,
-			fmt.Errorf("error fetching self as member: %s", err))
+		s.displayErr(w, http.StatusInternalServerError, err)
 		return
 	}
-	for _, forum := range channels {
-		if forum.Type != discord.GuildForum {
-			continue
-		}
-		perms := discord.CalcOverwrites(*guild, forum, *selfMember)
-		if !perms.Has(0 |
-			discord.PermissionReadMessageHistory |
-			discord.PermissionViewChannel) {
-			continue
-		}
-		var posts []discord.Channel
-		for _, t := range channels {
-			if t.ParentID == forum.ID &&
-				t.Type == discord.GuildPublicThread {
-				posts = append(posts, t)
-			}
-		}
+	s.executeTemplate(w, r, "guild.gohtml", ctx)
+}
+
+// forumChannels returns the visible forums in channels with their posts,
+// most recently active first.
+func (s *server) forumChannels(guild *discord.Guild, channels []discord.Channel) ([]ForumChannel, error) {
+	forums, err := s.visibleForums(guild, channels)
+	if err != nil {
+		return nil, err
+	}
+	var forumchannels []ForumChannel
+	for _, forum := range forums {
+		posts := forumThreads(forum.ID, channels)
 		var msgcount int
 		for _, post := range posts {
 			msgcount += post.MessageCount
@@ -294,18 +401,37 @@ func (s *server) getGuild(w http.ResponseWriter, r *http.Request) {
 				lastactive = post.LastMessageID.Time()
 			}
 		}
-		ctx.ForumChannels = append(ctx.ForumChannels, ForumChannel{
+		forumchannels = append(forumchannels, ForumChannel{
 			forum, posts, msgcount, lastactive,
 		})
 	}
-	sort.SliceStable(ctx.ForumChannels, func(i, j int) bool {
-		return ctx.ForumChannels[i].LastActive.After(ctx.ForumChannels[j].LastActive)
+	sort.SliceStable(forumchannels, func(i, j int) bool {
+		return forumchannels[i].LastActive.After(forumchannels[j].LastActive)
 	})
-	s.executeTemplate(w, r, "guild.gohtml", ctx)
+	return forumchannels, nil
 }
 
-func (s *server) searchGuild(w http.ResponseWriter, r *http.Request) {
-	s.executeTemplate(w, r, "searchguild.gohtml", nil)
+// visibleForums returns the forum channels in channels that the bot can read.
+func (s *server) visibleForums(guild *discord.Guild, channels []discord.Channel) ([]discord.Channel, error) {
+	me, _ := s.discord.Cabinet.Me()
+	selfMember, err := s.discord.Member(guild.ID, me.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching self as member: %s", err)
+	}
+	var forums []discord.Channel
+	for _, forum := range channels {
+		if forum.Type != discord.GuildForum {
+			continue
+		}
+		perms := discord.CalcOverwrites(*guild, forum, *selfMember)
+		if !perms.Has(0 |
+			discord.PermissionReadMessageHistory |
+			discord.PermissionViewChannel) {
+			continue
+		}
+		forums = append(forums, forum)
+	}
+	return forums, nil
 }
 
 func (s *server) searchForum(w http.ResponseWriter, r *http.Request) {
@@ -324,21 +450,33 @@ func (s *server) searchForum(w http.ResponseWriter, r *http.Request) {
 		s.getForum(w, r)
 		return
 	}
+	filter, ok := s.tagFilterFromReq(w, r, forum)
+	if !ok {
+		return
+	}
 
 	ctx := struct {
 		Guild       *discord.Guild
 		Forum       *discord.Channel
+		Filter      tagFilter
 		Posts       []Post
+		Messages    []MessageResult
 		Prev        int
 		Next        int
 		URL         string
+		PageBase    string
 		Query       string
 		AppendedStr string
 	}{Guild: guild,
 		Forum:       forum,
+		Filter:      filter,
 		URL:         s.URL,
+		PageBase:    fmt.Sprintf("/%s/%s", guild.ID, forum.ID),
 		Query:       query,
-		AppendedStr: "/search?q=" + query,
+		AppendedStr: "/search?q=" + url.QueryEscape(query),
+	}
+	if q := filter.Query(); q != "" {
+		ctx.AppendedStr += "&" + q
 	}
 	channels, err := s.channels(guild.ID)
 	if err != nil {
@@ -346,77 +484,107 @@ func (s *server) searchForum(w http.ResponseWriter, r *http.Request) {
 			fmt.Errorf("fetching guild threads: %w", err))
 		return
 	}
-	arr := strings.Split(query, " ")
-
-	if query == "" {
-		// Show blank page.
-		s.executeTemplate(w, r, "searchforum.gohtml", ctx)
-		return
-	}
-	var posts []Post
-	titles := []string{}
-	for _, thread := range channels {
-		if thread.ParentID != forum.ID ||
-			thread.Type != discord.GuildPublicThread {
-			continue
-		}
-		post := Post{Channel: thread}
-		for _, tag := range thread.AppliedTags {
-			for _, availtag := range forum.AvailableTags {
-				if availtag.ID == tag {
-					post.Tags = append(post.Tags, availtag)
-				}
-			}
-		}
-		if slices.Contains(titles, post.Channel.Name) {
-			continue
-		}
-		if strings.Contains(strings.ToLower(post.Channel.Name), query) {
-			posts = append(posts, post)
-			titles = append(titles, post.Channel.Name)
-		} else {
-			for _, str := range arr {
-				if len(str) <= 1 {
-					continue
-				}
-				if strings.Contains(strings.ToLower(post.Channel.Name), strings.ToLower(str)) {
-					posts = append(posts, post)
-					titles = append(titles, post.Channel.Name)
-				}
-			}
+	var threads []discord.Channel
+	for _, thread := range forumThreads(forum.ID, channels) {
+		if filter.Match(thread) {
+			threads = append(threads, thread)
 		}
 	}
-	sort.SliceStable(posts, func(i, j int) bool {
-		return strings.Contains(strings.ToLower(posts[i].Channel.Name), strings.ToLower(query))
-	})
 	page, err := strconv.Atoi(chi.URLParam(r, "page"))
 	if err != nil || page < 1 {
 		page = 1
 	}
-	if page > 1 {
-		ctx.Prev = page - 1
+	ctx.Posts, ctx.Prev, ctx.Next = paginate(matchPosts(forum, threads, query), page)
+	msgs, more, err := s.searchMessages(r.Context(), threads, query, page)
+	if err != nil {
+		s.displayErr(w, http.StatusInternalServerError, err)
+		return
 	}
-	if len(posts) > page*25 {
+	if more {
 		ctx.Next = page + 1
-		posts = posts[(page-1)*25 : page*25]
-	} else if len(posts) >= (page-1)*25 {
-		posts = posts[(page-1)*25:]
-	} else {
-		posts = nil
 	}
-	ctx.Posts = posts
+	ctx.Messages = msgs
 	s.executeTemplate(w, r, "searchforum.gohtml", ctx)
 }
 
 type Post struct {
 	discord.Channel
-	Tags []discord.Tag
+	Tags []discord.Tag `json:"tags"`
 }
 
 func (p Post) IsPinned() bool {
 	return p.Channel.Flags&discord.PinnedThread != 0
 }
 
+// newPost returns thread as a Post, resolving its applied tags against the
+// ones available in forum.
+func newPost(forum *discord.Channel, thread discord.Channel) Post {
+	post := Post{Channel: thread}
+	for _, tag := range thread.AppliedTags {
+		for _, availtag := range forum.AvailableTags {
+			if availtag.ID == tag {
+				post.Tags = append(post.Tags, availtag)
+			}
+		}
+	}
+	return post
+}
+
+// messageURL returns the permalink of msg in post, which redirectToMessage
+// redirects to the page of post that shows it.
+func messageURL(post discord.Channel, msg discord.MessageID) string {
+	return fmt.Sprintf("/%s/%s/%s", post.GuildID, post.ID, msg)
+}
+
+// forumThreads returns the public threads in channels that belong to forum.
+func forumThreads(forum discord.ChannelID, channels []discord.Channel) []discord.Channel {
+	var threads []discord.Channel
+	for _, thread := range channels {
+		if thread.ParentID == forum &&
+			thread.Type == discord.GuildPublicThread {
+			threads = append(threads, thread)
+		}
+	}
+	return threads
+}
+
+// paginate returns the given page of items, 25 per page, along with the
+// numbers of the previous and next pages, which are 0 if there are none.
+func paginate[T any](items []T, page int) (paged []T, prev, next int) {
+	if page > 1 {
+		prev = page - 1
+	}
+	if len(items) > page*25 {
+		next = page + 1
+		return items[(page-1)*25 : page*25], prev, next
+	} else if len(items) >= (page-1)*25 {
+		return items[(page-1)*25:], prev, next
+	}
+	return nil, prev, next
+}
+
+// forumPosts returns the posts in forum that match filter, pinned posts first
+// and then by last activity.
+func forumPosts(forum *discord.Channel, channels []discord.Channel, filter tagFilter) []Post {
+	if forum.Type != discord.GuildForum {
+		return nil
+	}
+	var posts []Post
+	for _, thread := range forumThreads(forum.ID, channels) {
+		if !filter.Match(thread) {
+			continue
+		}
+		posts = append(posts, newPost(forum, thread))
+	}
+	sort.SliceStable(posts, func(i, j int) bool {
+		if posts[i].Flags^posts[j].Flags&discord.PinnedThread != 0 {
+			return posts[i].Flags&discord.PinnedThread != 0
+		}
+		return posts[i].LastMessageID.Time().After(posts[j].LastMessageID.Time())
+	})
+	return posts
+}
+
 func (s *server) getForum(w http.ResponseWriter, r *http.Request) {
 	guild, ok := s.guildFromReq(w, r)
 	if !ok {
@@ -426,77 +594,54 @@ func (s *server) getForum(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		return
 	}
-
-	ctx := struct {
-		Guild       *discord.Guild
-		Forum       *discord.Channel
-		Posts       []Post
-		Prev        int
-		Next        int
-		URL         string
-		Query       string
-		AppendedStr string
-	}{Guild: guild,
-		Forum: forum,
-		URL:   s.URL}
+	filter, ok := s.tagFilterFromReq(w, r, forum)
+	if !ok {
+		return
+	}
 	channels, err := s.channels(guild.ID)
 	if err != nil {
 		s.displayErr(w, http.StatusInternalServerError,
 			fmt.Errorf("fetching guild threads: %w", err))
 		return
 	}
-	var posts []Post
-	for _, thread := range channels {
-
-		if thread.ParentID != forum.ID ||
-			thread.Type != discord.GuildPublicThread {
-			continue
-		}
-
-		parent, err := s.channel(thread.ParentID)
-		if err != nil {
-			s.displayErr(w, http.StatusInternalServerError,
-				fmt.Errorf("fetching parent channel's type: %w", err))
-		}
-		if parent == nil {
-			continue
-		}
-		if parent.Type != discord.GuildForum {
-			continue
-		}
-		post := Post{Channel: thread}
-		for _, tag := range thread.AppliedTags {
-			for _, availtag := range forum.AvailableTags {
-				if availtag.ID == tag {
-					post.Tags = append(post.Tags, availtag)
-				}
-			}
-		}
-		posts = append(posts, post)
-	}
-	sort.SliceStable(posts, func(i, j int) bool {
-		if posts[i].Flags^posts[j].Flags&discord.PinnedThread != 0 {
-			return posts[i].Flags&discord.PinnedThread != 0
-		}
-		return posts[i].LastMessageID.Time().After(posts[j].LastMessageID.Time())
-	})
 	page, err := strconv.Atoi(chi.URLParam(r, "page"))
 	if err != nil || page < 1 {
 		page = 1
 	}
-	if page > 1 {
-		ctx.Prev = page - 1
-	}
-	if len(posts) > page*25 {
-		ctx.Next = page + 1
-		posts = posts[(page-1)*25 : page*25]
-	} else if len(posts) >= (page-1)*25 {
-		posts = posts[(page-1)*25:]
-	} else {
-		posts = nil
-	}
-	ctx.Posts = posts
-	s.executeTemplate(w, r, "forum.gohtml", ctx)
+	s.executeTemplate(w, r, "forum.gohtml", s.forumPage(guild, forum, channels, filter, page))
+}
+
+// forumPage is what forum.gohtml is executed with.
+type forumPage struct {
+	Guild       *discord.Guild
+	Forum       *discord.Channel
+	Tag         *discord.Tag
+	Filter      tagFilter
+	Posts       []Post
+	Prev        int
+	Next        int
+	URL         string
+	PageBase    string
+	Query       string
+	AppendedStr string
+}
+
+// forumPage returns the given page of the posts in forum that match filter.
+func (s *server) forumPage(guild *discord.Guild, forum *discord.Channel, channels []discord.Channel, filter tagFilter, page int) forumPage {
+	ctx := forumPage{Guild: guild,
+		Forum:    forum,
+		Filter:   filter,
+		URL:      s.URL,
+		PageBase: fmt.Sprintf("/%s/%s", guild.ID, forum.ID),
+	}
+	if tag := filter.Tag(forum); tag != nil {
+		ctx.Tag = tag
+		ctx.PageBase = fmt.Sprintf("/%s/%s/tag/%s", guild.ID, forum.ID, tag.ID)
+	} else if q := filter.Query(); q != "" {
+		ctx.AppendedStr = "?" + q
+	}
+	ctx.Posts, ctx.Prev, ctx.Next = paginate(forumPosts(forum, channels, filter), page)
+	return ctx
 }
 
 func (s *server) getPost(w http.ResponseWriter, r *http.Request) {
@@ -508,6 +653,11 @@ func (s *server) getPost(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		return
 	}
+	if isThread(forum.Type) {
+		// a link to a message, which has the post where the forum would be
+		s.redirectToMessage(w, r, guild, forum)
+		return
+	}
 	post, ok := s.postFromReq(w, r)
 	if !ok {
 		return
@@ -517,18 +667,6 @@ func (s *server) getPost(w http.ResponseWriter, r *http.Request) {
 		s.displayErr(w, http.StatusNotFound, fmt.Errorf("threads cannot be viewed unless they are in a forum channel"))
 		return
 	}
-	ctx := struct {
-		Guild         *discord.Guild
-		Forum         *discord.Channel
-		Post          *discord.Channel
-		Prev          discord.MessageID
-		Next          discord.MessageID
-		MessageGroups []MessageGroup
-		URL           string
-	}{Guild: guild,
-		Forum: forum,
-		Post:  post,
-		URL:   s.URL}
 
 	var curstr string
 	asc := true
@@ -552,15 +690,9 @@ func (s *server) getPost(w http.ResponseWriter, r *http.Request) {
 	var hasbefore, hasafter bool
 	var err error
 	if asc {
-		msgs, hasbefore, hasafter, err = s.messageCache.MessagesAfter(r.Context(), post.ID, cur, 25)
+		msgs, hasbefore, hasafter, err = s.messageCache.MessagesAfter(r.Context(), post.ID, cur, messagesPerPage)
 	} else {
-		msgs, hasbefore, hasafter, err = s.messageCache.MessagesBefore(r.Context(), post.ID, cur, 25)
-	}
-	if hasafter && len(msgs) > 0 {
-		ctx.Next = msgs[len(msgs)-1].ID
-	}
-	if hasbefore && len(msgs) != 0 {
-		ctx.Prev = msgs[0].ID
+		msgs, hasbefore, hasafter, err = s.messageCache.MessagesBefore(r.Context(), post.ID, cur, messagesPerPage)
 	}
 	if err != nil {
 		s.displayErr(w, http.StatusInternalServerError,
@@ -573,69 +705,226 @@ func (s *server) getPost(w http.ResponseWriter, r *http.Request) {
 			fmt.Errorf("fetching post's members: %w", err))
 		return
 	}
+	ctx, err := s.postPage(r.Context(), guild, forum, post, msgs, hasbefore, hasafter)
+	if err != nil {
+		s.displayErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.executeTemplate(w, r, "post.gohtml", ctx)
+}
 
-	topic := forum.Topic
-	restrictRole := 0
+// messagesPerPage is how many messages a page of a post shows.
+const messagesPerPage = 25
 
-	if strings.Contains(topic, "<?dforum ") {
-		sections := s.optionsRegex.FindStringSubmatch(topic)
-		for _, section := range sections[1:] {
+// redirectToMessage redirects a link to a message in post, as Discord makes
+// them, to the page of the post that shows the message. The pages of a post
+// are counted from its first message, so that every message always has the
+// same link.
+func (s *server) redirectToMessage(w http.ResponseWriter, r *http.Request, guild *discord.Guild, post *discord.Channel) {
+	msgIDsf, err := discord.ParseSnowflake(chi.URLParam(r, "postID"))
+	if err != nil {
+		s.displayErr(w, http.StatusBadRequest, err)
+		return
+	}
+	msgID := discord.MessageID(msgIDsf)
+	if post.GuildID != guild.ID {
+		s.displayErr(w, http.StatusNotFound, nil)
+		return
+	}
+	forum, err := s.channel(post.ParentID)
+	if err != nil {
+		s.displayErr(w, http.StatusInternalServerError,
+			fmt.Errorf("fetching forum: %w", err))
+		return
+	}
+	if forum.Type != discord.GuildForum {
+		s.displayErr(w, http.StatusNotFound, fmt.Errorf("threads cannot be viewed unless they are in a forum channel"))
+		return
+	}
+	if forum.NSFW {
+		s.displayErr(w, http.StatusForbidden,
+			errors.New("NSFW content is not served"))
+		return
+	}
+	index, found, err := s.messageCache.MessageIndex(r.Context(), post.ID, msgID)
+	if err != nil {
+		s.displayErr(w, http.StatusInternalServerError,
+			fmt.Errorf("fetching post's messages: %w", err))
+		return
+	}
+	if !found {
+		s.displayErr(w, http.StatusNotFound, nil)
+		return
+	}
+	target := fmt.Sprintf("/%s/%s/%s", guild.ID, forum.ID, post.ID)
+	if index >= messagesPerPage {
+		// the page starts after the message before its first one
+		start := msgID
+		if n := index % messagesPerPage; n > 0 {
+			msgs, _, _, err := s.messageCache.MessagesBefore(r.Context(), post.ID, msgID, n)
 			if err != nil {
 				s.displayErr(w, http.StatusInternalServerError,
-					fmt.Errorf("fetching forum's topic: %w", err))
+					fmt.Errorf("fetching post's messages: %w", err))
 				return
 			}
-			options := strings.Split(section, ",")
-			for _, option := range options {
-				parts := strings.Split(option, "=")
-				if len(parts) < 2 {
-					continue
-				}
-				key := parts[0]
-				value := parts[1]
-				switch key {
-				case "consentrole":
-					restrictRole, err = strconv.Atoi(value)
-					if err != nil {
-						s.displayErr(w, http.StatusInternalServerError,
-							fmt.Errorf("error parsing the ID for the server's consent role: %w", err))
-						return
-					}
+			if len(msgs) > 0 {
+				start = msgs[0].ID
+			}
+		}
+		target += "?after=" + (start - 1).String()
+	}
+	http.Redirect(w, r, target+"#m"+msgID.String(), http.StatusFound)
+}
+
+// postPage is what post.gohtml is executed with.
+type postPage struct {
+	Guild         *discord.Guild
+	Forum         *discord.Channel
+	Post          *discord.Channel
+	Prev          discord.MessageID
+	Next          discord.MessageID
+	MessageGroups []MessageGroup
+	// Starter holds the post's first message, which is nil if it couldn't
+	// be found.
+	Starter *MessageGroup
+	URL     string
+
+	// texts are the contents of the messages as plain text.
+	texts map[discord.MessageID]string
+}
+
+// postPage returns the page of post that shows msgs. hasbefore and hasafter
+// report whether the post has messages before and after them.
+func (s *server) postPage(ctx context.Context, guild *discord.Guild, forum, post *discord.Channel,
+	msgs []discord.Message, hasbefore, hasafter bool) (postPage, error) {
+	page := postPage{Guild: guild,
+		Forum: forum,
+		Post:  post,
+		URL:   s.URL}
+	if hasafter && len(msgs) > 0 {
+		page.Next = msgs[len(msgs)-1].ID
+	}
+	if hasbefore && len(msgs) != 0 {
+		page.Prev = msgs[0].ID
+	}
+	consentRole, err := s.consentRole(forum)
+	if err != nil {
+		return postPage{}, err
+	}
+	page.MessageGroups, err = s.messageGroups(ctx, guild.ID, msgs, consentRole)
+	if err != nil {
+		return postPage{}, err
+	}
+	if len(msgs) > 0 && msgs[0].ID == discord.MessageID(post.ID) {
+		starter := page.MessageGroups[0]
+		starter.Messages = starter.Messages[:1]
+		page.Starter = &starter
+	} else if msg := s.starterMessage(ctx, *post); msg != nil {
+		grps, err := s.messageGroups(ctx, guild.ID, []discord.Message{*msg}, consentRole)
+		if err != nil {
+			return postPage{}, err
+		}
+		page.Starter = &grps[0]
+	}
+	page.texts = make(map[discord.MessageID]string)
+	for _, grp := range page.MessageGroups {
+		for _, msg := range grp.Messages {
+			page.texts[msg.ID] = s.plainMentions(msg.Message)
+		}
+	}
+	if page.Starter != nil {
+		msg := page.Starter.Messages[0]
+		page.texts[msg.ID] = s.plainMentions(msg.Message)
+	}
+	return page, nil
+}
+
+// consentRole returns the role set by the consentrole option in the forum's
+// topic, which authors need for their messages to be shown, or 0 if the
+// option isn't set.
+func (s *server) consentRole(forum *discord.Channel) (discord.RoleID, error) {
+	if !strings.Contains(forum.Topic, "<?dforum ") {
+		return 0, nil
+	}
+	var role discord.RoleID
+	sections := s.optionsRegex.FindStringSubmatch(forum.Topic)
+	if len(sections) == 0 {
+		return 0, nil
+	}
+	for _, section := range sections[1:] {
+		options := strings.Split(section, ",")
+		for _, option := range options {
+			parts := strings.Split(option, "=")
+			if len(parts) < 2 {
+				continue
+			}
+			key := parts[0]
+			value := parts[1]
+			switch key {
+			case "consentrole":
+				sf, err := discord.ParseSnowflake(value)
+				if err != nil {
+					return 0, fmt.Errorf("error parsing the ID for the server's consent role: %w", err)
 				}
+				role = discord.RoleID(sf)
 			}
 		}
 	}
+	return role, nil
+}
 
+// messageGroups groups consecutive messages by the same author. The messages
+// of authors returned by hiddenAuthors are hidden.
+func (s *server) messageGroups(ctx context.Context, guildID discord.GuildID, msgs []discord.Message, consentRole discord.RoleID) ([]MessageGroup, error) {
+	refs, err := s.referencedMessages(ctx, msgs)
+	if err != nil {
+		return nil, err
+	}
+	// the authors of the messages replied to may be hidden too
+	authored := msgs[:len(msgs):len(msgs)]
+	for _, ref := range refs {
+		authored = append(authored, ref)
+	}
+	// and so may the users they mention
+	for _, m := range msgs {
+		for _, user := range m.Mentions {
+			authored = append(authored, discord.Message{Author: user.User})
+		}
+	}
+	hidden, err := s.hiddenAuthors(ctx, guildID, authored, consentRole)
+	if err != nil {
+		return nil, err
+	}
 	var msgrps []MessageGroup
-	i := -1
+	var last discord.UserID
 	for _, m := range msgs {
-		m.GuildID = guild.ID
-		msg := s.message(m)
-		if i == -1 || msgrps[i].Author.ID != m.Author.ID {
-			auth := s.author(m)
-			if restrictRole != 0 {
-				goodToGo := false
-				for _, rl := range auth.OtherRoles {
-					if int(rl.ID) == restrictRole {
-						goodToGo = true
-						break
-					}
-				}
-				if !goodToGo {
-					s.displayErr(w, http.StatusForbidden,
-						errors.New("one or more users in this post did not consent to their post being shown"))
-					return
-				}
+		m.GuildID = guildID
+		if len(msgrps) == 0 || last != m.Author.ID {
+			grp := MessageGroup{Hidden: hidden[m.Author.ID]}
+			if grp.Hidden {
+				grp.Author = hiddenAuthor
+				grp.Author.Avatar = s.media.URL(hiddenAuthor.Avatar)
+			} else {
+				grp.Author = s.author(m)
 			}
-
-			msgrps = append(msgrps, MessageGroup{auth, []Message{msg}})
-			i++
+			msgrps = append(msgrps, grp)
+			last = m.Author.ID
+		}
+		grp := &msgrps[len(msgrps)-1]
+		if grp.Hidden {
+			grp.Messages = append(grp.Messages, hiddenMessage(m))
 		} else {
-			msgrps[i].Messages = append(msgrps[i].Messages, msg)
+			reply := s.reply(m, refs, hidden)
+			// the reply is all that is shown of the message replied to,
+			// which may be by a hidden author
+			m.ReferencedMessage = nil
+			m.Mentions = hideMentions(m.Mentions, hidden)
+			msg := s.message(m)
+			msg.Reply = reply
+			grp.Messages = append(grp.Messages, msg)
 		}
 	}
-	ctx.MessageGroups = msgrps
-	s.executeTemplate(w, r, "post.gohtml", ctx)
+	return msgrps, nil
 }
 
 func (s *server) guildFromReq(w http.ResponseWriter, r *http.Request) (*discord.Guild, bool) {
@@ -3,21 +3,29 @@ package main
 import (
 	"bytes"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
 	"github.com/go-chi/chi/v5/middleware"
+	"golang.org/x/exp/slices"
 )
 
 type Sitemap struct {
 	XMLName xml.Name `xml:"sitemap"`
 	Loc     string   `xml:"loc"`
+	LastMod string   `xml:"lastmod,omitempty"`
 }
 
 type URL struct {
@@ -38,14 +46,16 @@ const (
 const MaxSitemapURLs = 50000
 const MaxSitemapSize = 52_428_800
 
+// sitemapInterval is how often the sitemaps of the guilds that changed are
+// rewritten.
+const sitemapInterval = time.Hour
+
 func (s *server) getSitemap(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path == "/sitemap.xml" {
 		var wr = middleware.NewWrapResponseWriter(w, r.ProtoMajor)
 		http.ServeFile(wr, r, path.Join(s.SitemapDir, "sitemap.xml"))
 		if wr.Status() == http.StatusNotFound {
-			go func() {
-				s.updateSitemap <- struct{}{}
-			}()
+			s.requestSitemapUpdate()
 		}
 		return
 	}
@@ -53,130 +63,165 @@ func (s *server) getSitemap(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, path.Join(s.SitemapDir, r.URL.Path))
 }
 
-func (s *server) writeSitemap() error {
-	dir := s.SitemapDir
-	if err := os.MkdirAll(dir, 0755); err != nil {
+// atomicFile is a temporary file that replaces the file it is named after
+// once it is committed, so that the file is never seen half written.
+type atomicFile struct {
+	*os.File
+	name string
+}
+
+func createAtomic(name string) (*atomicFile, error) {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{f, name}, nil
+}
+
+// Commit closes the file and moves it in place.
+func (f *atomicFile) Commit() error {
+	if err := f.Chmod(0644); err != nil {
+		f.Abort()
 		return err
 	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), f.name); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
 
-	var files []io.Closer
-	defer func() {
-		for _, f := range files {
-			f.Close()
-		}
-	}()
+// Abort closes and removes the file, leaving the file it replaces as it was.
+func (f *atomicFile) Abort() {
+	f.Close()
+	os.Remove(f.Name())
+}
 
-	var sitemapCount int
+// sitemapFile is a file written by a sitemapWriter.
+type sitemapFile struct {
+	Name string
+	// LastMod is the latest last modification time of its URLs.
+	LastMod time.Time
+	URLs    int
+}
 
-	var buffer bytes.Buffer
-	sitemapEnc := xml.NewEncoder(&buffer)
-	var sitemap *os.File
-	var sitemapLen int
-	var sitemapURLs int
-	var encode func(URL) error
-	_encode := func(u URL) error {
-		if sitemap == nil {
-			sitemapCount++
-			sitemapPath := filepath.Join(dir, fmt.Sprintf("sitemap%d.xml", sitemapCount))
-			var err error
-			sitemap, err = os.Create(sitemapPath)
-			if err != nil {
-				return err
-			}
-			files = append(files, sitemap)
-			if _, err := io.WriteString(sitemap, xml.Header); err != nil {
-				return err
-			}
-			if _, err := io.WriteString(sitemap, XMLURLSetStart); err != nil {
-				return err
-			}
-			sitemapLen = len(xml.Header) + len(XMLURLSetStart)
-			sitemapURLs = 0
+// sitemapWriter writes a sitemap into a directory, split into as many files
+// as needed. The files are named prefix1.xml, prefix2.xml and so on.
+type sitemapWriter struct {
+	dir    string
+	prefix string
+	files  []sitemapFile
+
+	buffer     bytes.Buffer
+	enc        *xml.Encoder
+	sitemap    *atomicFile
+	sitemapLen int
+	current    sitemapFile
+}
+
+func newSitemapWriter(dir, prefix string) (*sitemapWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	w := &sitemapWriter{dir: dir, prefix: prefix}
+	w.enc = xml.NewEncoder(&w.buffer)
+	return w, nil
+}
+
+// Add adds loc to the sitemap, last modified at lastmod unless it is zero.
+func (w *sitemapWriter) Add(loc string, lastmod time.Time) error {
+	if w.sitemap == nil {
+		w.current = sitemapFile{Name: fmt.Sprintf("%s%d.xml", w.prefix, len(w.files)+1)}
+		var err error
+		w.sitemap, err = createAtomic(filepath.Join(w.dir, w.current.Name))
+		if err != nil {
+			return err
 		}
-		if err := sitemapEnc.Encode(u); err != nil {
+		if _, err := io.WriteString(w.sitemap, xml.Header); err != nil {
 			return err
 		}
-		sitemapLen += buffer.Len()
-		sitemapURLs++
-		if sitemapLen+len(XMLURLSetEnd) > MaxSitemapSize || sitemapURLs > MaxSitemapURLs {
-			if _, err := io.WriteString(sitemap, XMLURLSetEnd); err != nil {
-				return err
-			}
-			sitemap.Close()
-			buffer.Reset()
-			sitemap = nil
-			sitemapLen = 0
-			return encode(u)
+		if _, err := io.WriteString(w.sitemap, XMLURLSetStart); err != nil {
+			return err
 		}
-		_, err := buffer.WriteTo(sitemap)
+		w.sitemapLen = len(xml.Header) + len(XMLURLSetStart)
+	}
+	u := URL{Location: loc}
+	if !lastmod.IsZero() {
+		u.LastMod = sitemapTime(lastmod)
+	}
+	if err := w.enc.Encode(u); err != nil {
 		return err
 	}
-	encode = _encode
-	guilds, _ := s.discord.Cabinet.Guilds()
-	me, _ := s.discord.Cabinet.Me()
-	for _, guild := range guilds {
-		if err := encode(URL{
-			Location: fmt.Sprintf("%s/%s", s.URL, guild.ID),
-		}); err != nil {
+	if w.sitemapLen+w.buffer.Len()+len(XMLURLSetEnd) > MaxSitemapSize || w.current.URLs+1 > MaxSitemapURLs {
+		w.buffer.Reset()
+		if err := w.finishFile(); err != nil {
 			return err
 		}
-		memberSelf, err := s.discord.Member(guild.ID, me.ID)
-		if err != nil {
-			return fmt.Errorf("error fetching self as member: %w", err)
-		}
-		channels, err := s.channels(guild.ID)
-		if err != nil {
-			return fmt.Errorf("error fetching channels: %w", err)
-		}
-		for _, forum := range channels {
-			if forum.Type != discord.GuildForum {
-				continue
-			}
+		return w.Add(loc, lastmod)
+	}
+	w.sitemapLen += w.buffer.Len()
+	w.current.URLs++
+	if lastmod.After(w.current.LastMod) {
+		w.current.LastMod = lastmod
+	}
+	_, err := w.buffer.WriteTo(w.sitemap)
+	return err
+}
 
-			perms := discord.CalcOverwrites(guild, forum, *memberSelf)
-			if !perms.Has(0 |
-				discord.PermissionReadMessageHistory |
-				discord.PermissionViewChannel) {
-				continue
-			}
-			if err = encode(URL{
-				Location: fmt.Sprintf("%s/%s/%s", s.URL, guild.ID, forum.ID),
-			}); err != nil {
-				return err
-			}
-		}
-		for _, post := range channels {
-			if post.Type != discord.GuildPublicThread {
-				continue
-			}
-			parent, err := s.channel(post.ParentID)
-			if err != nil {
-				continue
-			}
-			if parent.Type != discord.GuildForum {
-				continue
-			}
-			if err = encode(URL{
-				Location: fmt.Sprintf("%s/%s/%s/%s", s.URL, guild.ID, post.ParentID, post.ID),
-			}); err != nil {
-				return err
-			}
-		}
+func (w *sitemapWriter) finishFile() error {
+	if w.sitemap == nil {
+		return nil
 	}
-	if sitemap != nil {
-		if _, err := io.WriteString(sitemap, XMLURLSetEnd); err != nil {
-			return err
-		}
-		sitemap.Close()
-		buffer.Reset()
-		sitemap = nil
+	f := w.sitemap
+	w.sitemap = nil
+	w.sitemapLen = 0
+	if _, err := io.WriteString(f, XMLURLSetEnd); err != nil {
+		f.Abort()
+		return err
 	}
-	index := filepath.Join(dir, "sitemap.xml")
-	w, err := os.Create(index)
+	if err := f.Commit(); err != nil {
+		return err
+	}
+	w.files = append(w.files, w.current)
+	return nil
+}
+
+// Close finishes the last sitemap file and returns the files written.
+func (w *sitemapWriter) Close() ([]sitemapFile, error) {
+	if err := w.finishFile(); err != nil {
+		return nil, err
+	}
+	return w.files, nil
+}
+
+// abort removes the sitemap file being written, if any. The files that were
+// already finished are kept.
+func (w *sitemapWriter) abort() {
+	if w.sitemap != nil {
+		w.sitemap.Abort()
+		w.sitemap = nil
+	}
+}
+
+// writeSitemapIndex writes the sitemap.xml index of files into dir, which is
+// served at baseURL.
+func writeSitemapIndex(dir, baseURL string, files []sitemapFile) error {
+	index, err := createAtomic(filepath.Join(dir, "sitemap.xml"))
 	if err != nil {
 		return err
 	}
-	defer w.Close()
+	if err := writeSitemapIndexTo(index, baseURL, files); err != nil {
+		index.Abort()
+		return err
+	}
+	return index.Commit()
+}
+
+func writeSitemapIndexTo(w io.Writer, baseURL string, files []sitemapFile) error {
 	if _, err := io.WriteString(w, xml.Header); err != nil {
 		return err
 	}
@@ -184,18 +229,367 @@ func (s *server) writeSitemap() error {
 		return err
 	}
 	enc := xml.NewEncoder(w)
-	for i := 0; i < sitemapCount; i++ {
-		if err = enc.Encode(Sitemap{
-			Loc: fmt.Sprintf("%s/sitemap/sitemap%d.xml", s.URL, i+1),
-		}); err != nil {
+	for _, file := range files {
+		sm := Sitemap{Loc: fmt.Sprintf("%s/%s", baseURL, file.Name)}
+		if !file.LastMod.IsZero() {
+			sm.LastMod = sitemapTime(file.LastMod)
+		}
+		if err := enc.Encode(sm); err != nil {
 			return err
 		}
 	}
 	if _, err := io.WriteString(w, XMLSitemapIndexEnd); err != nil {
 		return err
 	}
-	if _, err = w.Write([]byte{'\n'}); err != nil {
+	_, err := w.Write([]byte{'\n'})
+	return err
+}
+
+// removeStaleSitemaps removes the sitemap files in dir that aren't among
+// files, like those of guilds that are gone.
+func removeStaleSitemaps(dir string, files []sitemapFile) error {
+	names, err := filepath.Glob(filepath.Join(dir, "sitemap*.xml"))
+	if err != nil {
 		return err
 	}
-	return w.Close()
+	keep := map[string]bool{"sitemap.xml": true}
+	for _, file := range files {
+		keep[file.Name] = true
+	}
+	for _, name := range names {
+		if keep[filepath.Base(name)] {
+			continue
+		}
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSitemaps returns the sitemap files of each guild that are in dir, so
+// that those written before a restart are kept until their guild changes.
+// Guilds whose files can't be read are left out, so that they are rewritten.
+func readSitemaps(dir string) (map[discord.GuildID][]sitemapFile, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "sitemap-*-*.xml"))
+	if err != nil {
+		return nil, err
+	}
+	sitemaps := make(map[discord.GuildID][]sitemapFile)
+	numbers := make(map[string]int)
+	unreadable := make(map[discord.GuildID]bool)
+	for _, name := range names {
+		base := filepath.Base(name)
+		guild, number, ok := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(base, "sitemap-"), ".xml"), "-")
+		if !ok {
+			continue
+		}
+		guildID, err := discord.ParseSnowflake(guild)
+		if err != nil {
+			continue
+		}
+		n, err := strconv.Atoi(number)
+		if err != nil {
+			continue
+		}
+		file, err := readSitemapFile(name)
+		if err != nil {
+			log.Printf("reading sitemap %s: %v", base, err)
+			unreadable[discord.GuildID(guildID)] = true
+			continue
+		}
+		numbers[base] = n
+		sitemaps[discord.GuildID(guildID)] = append(sitemaps[discord.GuildID(guildID)], file)
+	}
+	for guildID, files := range sitemaps {
+		if unreadable[guildID] {
+			delete(sitemaps, guildID)
+			continue
+		}
+		sort.Slice(files, func(i, j int) bool {
+			return numbers[files[i].Name] < numbers[files[j].Name]
+		})
+	}
+	return sitemaps, nil
+}
+
+// readSitemapFile reads back the sitemapFile of a file written by a
+// sitemapWriter.
+func readSitemapFile(name string) (sitemapFile, error) {
+	file := sitemapFile{Name: filepath.Base(name)}
+	f, err := os.Open(name)
+	if err != nil {
+		return file, err
+	}
+	defer f.Close()
+	dec := xml.NewDecoder(f)
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return file, nil
+		}
+		if err != nil {
+			return file, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "url" {
+			continue
+		}
+		var u URL
+		if err := dec.DecodeElement(&u, &start); err != nil {
+			return file, err
+		}
+		file.URLs++
+		if u.LastMod == "" {
+			continue
+		}
+		lastmod, err := time.Parse(time.RFC3339, u.LastMod)
+		if err != nil {
+			return file, err
+		}
+		if lastmod.After(file.LastMod) {
+			file.LastMod = lastmod
+		}
+	}
+}
+
+func sitemapTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// threadLastMod returns when a thread was last modified, which is when its
+// last message was sent.
+func threadLastMod(thread *discord.Channel) time.Time {
+	t := thread.ID.Time()
+	if thread.LastMessageID.IsValid() && thread.LastMessageID.Time().After(t) {
+		t = thread.LastMessageID.Time()
+	}
+	return t
+}
+
+// postsLastMod returns the latest threadLastMod of the posts in forum, or of
+// those with the given tag if it is valid.
+func postsLastMod(forum discord.ChannelID, tag discord.TagID, channels []discord.Channel) time.Time {
+	var latest time.Time
+	for _, post := range forumThreads(forum, channels) {
+		if tag.IsValid() && !slices.Contains(post.AppliedTags, tag) {
+			continue
+		}
+		if t := threadLastMod(&post); t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+// markSitemapDirty notes that the sitemap of guildID has to be rewritten.
+func (s *server) markSitemapDirty(guildID discord.GuildID) {
+	if !guildID.IsValid() {
+		return
+	}
+	s.sitemapMu.Lock()
+	s.sitemapDirty[guildID] = struct{}{}
+	s.sitemapMu.Unlock()
+}
+
+// handleSitemapChange marks the guilds whose sitemap an event changes as
+// dirty.
+func (s *server) handleSitemapChange(ev interface{}) {
+	switch ev := ev.(type) {
+	case *gateway.MessageCreateEvent:
+		s.markSitemapDirty(ev.GuildID)
+	case *gateway.ThreadCreateEvent:
+		s.markSitemapDirty(ev.GuildID)
+	case *gateway.ThreadUpdateEvent:
+		s.markSitemapDirty(ev.GuildID)
+	case *gateway.ThreadDeleteEvent:
+		s.markSitemapDirty(ev.GuildID)
+	case *gateway.ThreadListSyncEvent:
+		s.markSitemapDirty(ev.GuildID)
+	case *gateway.ChannelCreateEvent:
+		s.markSitemapDirty(ev.GuildID)
+	case *gateway.ChannelUpdateEvent:
+		s.markSitemapDirty(ev.GuildID)
+	case *gateway.ChannelDeleteEvent:
+		s.markSitemapDirty(ev.GuildID)
+	case *gateway.GuildCreateEvent:
+		s.handleGuildCreateSitemap(ev)
+	case *gateway.GuildUpdateEvent:
+		s.markSitemapDirty(ev.ID)
+	case *gateway.GuildRoleUpdateEvent:
+		// the bot's permissions decide which forums are listed
+		s.markSitemapDirty(ev.GuildID)
+	case *gateway.GuildMemberUpdateEvent:
+		if me, err := s.discord.Cabinet.Me(); err == nil && ev.User.ID == me.ID {
+			s.markSitemapDirty(ev.GuildID)
+		}
+	}
+}
+
+// handleGuildCreateSitemap marks a guild that became available as dirty if
+// its posts changed since its sitemap was written, as the guild is sent
+// again after every restart. Posts deleted in the meantime are left until
+// the guild changes again.
+func (s *server) handleGuildCreateSitemap(ev *gateway.GuildCreateEvent) {
+	s.sitemapMu.Lock()
+	files, ok := s.sitemaps[ev.ID]
+	s.sitemapMu.Unlock()
+	if !ok {
+		// written for the first time anyway
+		return
+	}
+	var written time.Time
+	for _, file := range files {
+		if file.LastMod.After(written) {
+			written = file.LastMod
+		}
+	}
+	forums := make(map[discord.ChannelID]bool)
+	for _, ch := range ev.Channels {
+		if ch.Type == discord.GuildForum {
+			forums[ch.ID] = true
+		}
+	}
+	for i, thread := range ev.Threads {
+		if forums[thread.ParentID] && threadLastMod(&ev.Threads[i]).After(written) {
+			s.markSitemapDirty(ev.ID)
+			return
+		}
+	}
+}
+
+// writeSitemap brings the sitemap up to date. Every guild has its own
+// sitemap files, which are only rewritten if the guild changed since they
+// were last written. The index listing them is rewritten every time.
+func (s *server) writeSitemap() error {
+	start := time.Now()
+	if err := os.MkdirAll(s.SitemapDir, 0755); err != nil {
+		return err
+	}
+	guilds, _ := s.discord.Cabinet.Guilds()
+	me, _ := s.discord.Cabinet.Me()
+
+	s.sitemapMu.Lock()
+	dirty := s.sitemapDirty
+	s.sitemapDirty = make(map[discord.GuildID]struct{})
+	written := s.sitemaps
+	s.sitemapMu.Unlock()
+
+	sitemaps := make(map[discord.GuildID][]sitemapFile, len(guilds))
+	var files []sitemapFile
+	var firstErr error
+	var rewritten int
+	for i, guild := range guilds {
+		gfiles, ok := written[guild.ID]
+		if _, changed := dirty[guild.ID]; changed || !ok {
+			newFiles, err := s.writeGuildSitemap(&guilds[i], me)
+			if err != nil {
+				// the old files stay until the next try
+				s.markSitemapDirty(guild.ID)
+				if firstErr == nil {
+					firstErr = fmt.Errorf("guild %s: %w", guild.ID, err)
+				}
+			} else {
+				gfiles = newFiles
+				rewritten++
+			}
+		}
+		sitemaps[guild.ID] = gfiles
+		files = append(files, gfiles...)
+	}
+	s.sitemapMu.Lock()
+	s.sitemaps = sitemaps
+	s.sitemapMu.Unlock()
+
+	if err := writeSitemapIndex(s.SitemapDir, s.URL+"/sitemap", files); err != nil {
+		return err
+	}
+	if err := removeStaleSitemaps(s.SitemapDir, files); err != nil {
+		return err
+	}
+	var urls int
+	for _, file := range files {
+		urls += file.URLs
+	}
+	sitemapDuration.Set(time.Since(start).Seconds())
+	sitemapURLCount.Set(float64(urls))
+	if rewritten > 0 {
+		log.Printf("Rewrote the sitemaps of %d of %d guilds.", rewritten, len(guilds))
+	}
+	return firstErr
+}
+
+// writeGuildSitemap writes the sitemap files of guild.
+func (s *server) writeGuildSitemap(guild *discord.Guild, me *discord.User) ([]sitemapFile, error) {
+	sw, err := newSitemapWriter(s.SitemapDir, fmt.Sprintf("sitemap-%s-", guild.ID))
+	if err != nil {
+		return nil, err
+	}
+	defer sw.abort()
+	if me == nil {
+		return nil, errors.New("the bot's user is unknown")
+	}
+	memberSelf, err := s.discord.Member(guild.ID, me.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching self as member: %w", err)
+	}
+	channels, err := s.channels(guild.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching channels: %w", err)
+	}
+	var forums []discord.Channel
+	var guildLastMod time.Time
+	for _, forum := range channels {
+		if forum.Type != discord.GuildForum {
+			continue
+		}
+		perms := discord.CalcOverwrites(*guild, forum, *memberSelf)
+		if !perms.Has(0 |
+			discord.PermissionReadMessageHistory |
+			discord.PermissionViewChannel) {
+			continue
+		}
+		forums = append(forums, forum)
+		if t := postsLastMod(forum.ID, 0, channels); t.After(guildLastMod) {
+			guildLastMod = t
+		}
+	}
+	if err := sw.Add(fmt.Sprintf("%s/%s", s.URL, guild.ID), guildLastMod); err != nil {
+		return nil, err
+	}
+	for _, forum := range forums {
+		if err = sw.Add(
+			fmt.Sprintf("%s/%s/%s", s.URL, guild.ID, forum.ID),
+			postsLastMod(forum.ID, 0, channels),
+		); err != nil {
+			return nil, err
+		}
+		for _, tag := range forum.AvailableTags {
+			if err = sw.Add(
+				fmt.Sprintf("%s/%s/%s/tag/%s", s.URL, guild.ID, forum.ID, tag.ID),
+				postsLastMod(forum.ID, tag.ID, channels),
+			); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, post := range channels {
+		if post.Type != discord.GuildPublicThread {
+			continue
+		}
+		parent, err := s.channel(post.ParentID)
+		if err != nil {
+			continue
+		}
+		if parent.Type != discord.GuildForum {
+			continue
+		}
+		if err = sw.Add(
+			fmt.Sprintf("%s/%s/%s/%s", s.URL, guild.ID, post.ParentID, post.ID),
+			threadLastMod(&post),
+		); err != nil {
+			return nil, err
+		}
+	}
+	return sw.Close()
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+)
+
+func TestReadSitemaps(t *testing.T) {
+	dir := t.TempDir()
+	lastmod := time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)
+	sw, err := newSitemapWriter(dir, "sitemap-100-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < MaxSitemapURLs+1; i++ {
+		if err := sw.Add("https://dforum.example/100", lastmod.Add(-time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := sw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a guild with a broken file is left out, so that it is rewritten
+	if err := os.WriteFile(filepath.Join(dir, "sitemap-200-1.xml"), []byte("<urlset><url>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readSitemaps(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("read sitemaps of %d guilds, want 1", len(got))
+	}
+	files := got[discord.GuildID(100)]
+	if len(files) != len(want) {
+		t.Fatalf("read %d files, want %d", len(files), len(want))
+	}
+	for i := range want {
+		if files[i].Name != want[i].Name || files[i].URLs != want[i].URLs || !files[i].LastMod.Equal(want[i].LastMod) {
+			t.Errorf("file %d is %+v, want %+v", i, files[i], want[i])
+		}
+	}
+}
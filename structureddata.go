@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+)
+
+// These are the schema.org types that post pages describe themselves with in
+// JSON-LD, so that search engines can tell what they are about.
+
+type ldPosting struct {
+	Context              string                 `json:"@context"`
+	Type                 string                 `json:"@type"`
+	URL                  string                 `json:"url"`
+	Headline             string                 `json:"headline"`
+	Text                 string                 `json:"text,omitempty"`
+	Image                string                 `json:"image,omitempty"`
+	Author               *ldPerson              `json:"author,omitempty"`
+	DatePublished        string                 `json:"datePublished"`
+	DateModified         string                 `json:"dateModified"`
+	InteractionStatistic []ldInteractionCounter `json:"interactionStatistic"`
+	Comment              []ldComment            `json:"comment,omitempty"`
+}
+
+type ldPerson struct {
+	Type string `json:"@type"`
+	Name string `json:"name"`
+}
+
+type ldComment struct {
+	Type          string   `json:"@type"`
+	URL           string   `json:"url"`
+	Text          string   `json:"text,omitempty"`
+	Author        ldPerson `json:"author"`
+	DatePublished string   `json:"datePublished"`
+	DateModified  string   `json:"dateModified,omitempty"`
+}
+
+type ldInteractionCounter struct {
+	Type                 string `json:"@type"`
+	InteractionType      string `json:"interactionType"`
+	UserInteractionCount int    `json:"userInteractionCount"`
+}
+
+type ldBreadcrumbList struct {
+	Context         string       `json:"@context"`
+	Type            string       `json:"@type"`
+	ItemListElement []ldListItem `json:"itemListElement"`
+}
+
+type ldListItem struct {
+	Type     string `json:"@type"`
+	Position int    `json:"position"`
+	Name     string `json:"name"`
+	Item     string `json:"item"`
+}
+
+func ldTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func ldPersonFor(author Author) *ldPerson {
+	return &ldPerson{Type: "Person", Name: author.Name}
+}
+
+// Posting describes the post as a DiscussionForumPosting, with the messages
+// on the page as its comments.
+func (p postPage) Posting() ldPosting {
+	published := p.Post.ID.Time()
+	modified := published
+	if p.Post.LastMessageID.IsValid() && p.Post.LastMessageID.Time().After(modified) {
+		modified = p.Post.LastMessageID.Time()
+	}
+	posting := ldPosting{
+		Context:       "https://schema.org",
+		Type:          "DiscussionForumPosting",
+		URL:           fmt.Sprintf("%s/%s/%s/%s", p.URL, p.Guild.ID, p.Forum.ID, p.Post.ID),
+		Headline:      p.Post.Name,
+		DatePublished: ldTime(published),
+		DateModified:  ldTime(modified),
+		InteractionStatistic: []ldInteractionCounter{{
+			Type:                 "InteractionCounter",
+			InteractionType:      "https://schema.org/CommentAction",
+			UserInteractionCount: p.Post.MessageCount,
+		}},
+	}
+	if p.Starter != nil {
+		starter := p.Starter.Messages[0]
+		posting.Author = ldPersonFor(p.Starter.Author)
+		posting.Text = p.texts[starter.ID]
+		if len(starter.MediaPreviews) > 0 {
+			posting.Image = string(starter.MediaPreviews[0].Thumbnail)
+		}
+		var likes int
+		for _, reaction := range starter.Reactions {
+			likes += reaction.Count
+		}
+		posting.InteractionStatistic = append(posting.InteractionStatistic, ldInteractionCounter{
+			Type:                 "InteractionCounter",
+			InteractionType:      "https://schema.org/LikeAction",
+			UserInteractionCount: likes,
+		})
+	}
+	for _, grp := range p.MessageGroups {
+		for _, msg := range grp.Messages {
+			if msg.ID == discord.MessageID(p.Post.ID) {
+				continue
+			}
+			comment := ldComment{
+				Type:          "Comment",
+				URL:           p.URL + messageURL(*p.Post, msg.ID),
+				Text:          p.texts[msg.ID],
+				Author:        *ldPersonFor(grp.Author),
+				DatePublished: ldTime(msg.ID.Time()),
+			}
+			if msg.EditedTimestamp.IsValid() {
+				comment.DateModified = ldTime(msg.EditedTimestamp.Time())
+			}
+			posting.Comment = append(posting.Comment, comment)
+		}
+	}
+	return posting
+}
+
+// Breadcrumbs describes the way from the guild to the post.
+func (p postPage) Breadcrumbs() ldBreadcrumbList {
+	guildURL := fmt.Sprintf("%s/%s", p.URL, p.Guild.ID)
+	forumURL := fmt.Sprintf("%s/%s", guildURL, p.Forum.ID)
+	return ldBreadcrumbList{
+		Context: "https://schema.org",
+		Type:    "BreadcrumbList",
+		ItemListElement: []ldListItem{
+			{"ListItem", 1, p.Guild.Name, guildURL},
+			{"ListItem", 2, p.Forum.Name, forumURL},
+			{"ListItem", 3, p.Post.Name, fmt.Sprintf("%s/%s", forumURL, p.Post.ID)},
+		},
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/exp/slices"
+)
+
+// tagFilter selects forum posts by the tags applied to them.
+type tagFilter struct {
+	Tags []discord.TagID
+	// All requires posts to have every tag in Tags instead of any of them.
+	All bool
+
+	// route is set when the filter comes from a /tag/{tagID} URL.
+	route bool
+}
+
+// tagFilterFromReq reads the filter from the tag in the URL path, or
+// otherwise from the tag-filter and tag-mode query parameters. Tags that
+// forum doesn't have are ignored in query parameters, but are not found in
+// the path.
+func (s *server) tagFilterFromReq(w http.ResponseWriter, r *http.Request, forum *discord.Channel) (tagFilter, bool) {
+	if tagIDstr := chi.URLParam(r, "tagID"); tagIDstr != "" {
+		tagIDsf, err := discord.ParseSnowflake(tagIDstr)
+		if err != nil {
+			s.displayErr(w, http.StatusBadRequest, err)
+			return tagFilter{}, false
+		}
+		tagID := discord.TagID(tagIDsf)
+		if !forumHasTag(forum, tagID) {
+			s.displayErr(w, http.StatusNotFound,
+				fmt.Errorf("forum has no tag with ID %s", tagID))
+			return tagFilter{}, false
+		}
+		return tagFilter{Tags: []discord.TagID{tagID}, route: true}, true
+	}
+	var filter tagFilter
+	query := r.URL.Query()
+	for _, tagIDstr := range query["tag-filter"] {
+		if tagIDstr == "" {
+			continue
+		}
+		tagIDsf, err := discord.ParseSnowflake(tagIDstr)
+		if err != nil {
+			s.displayErr(w, http.StatusBadRequest,
+				fmt.Errorf("invalid tag filter: %w", err))
+			return tagFilter{}, false
+		}
+		tagID := discord.TagID(tagIDsf)
+		if forumHasTag(forum, tagID) && !filter.Has(tagID) {
+			filter.Tags = append(filter.Tags, tagID)
+		}
+	}
+	filter.All = query.Get("tag-mode") == "all"
+	return filter, true
+}
+
+func forumHasTag(forum *discord.Channel, id discord.TagID) bool {
+	return forumTag(forum, id) != nil
+}
+
+func forumTag(forum *discord.Channel, id discord.TagID) *discord.Tag {
+	for i := range forum.AvailableTags {
+		if forum.AvailableTags[i].ID == id {
+			return &forum.AvailableTags[i]
+		}
+	}
+	return nil
+}
+
+// Match reports whether thread passes the filter.
+func (f tagFilter) Match(thread discord.Channel) bool {
+	if len(f.Tags) == 0 {
+		return true
+	}
+	for _, tag := range f.Tags {
+		has := slices.Contains(thread.AppliedTags, tag)
+		if has && !f.All {
+			return true
+		}
+		if !has && f.All {
+			return false
+		}
+	}
+	return f.All
+}
+
+// Has reports whether tag is one of the tags being filtered by.
+func (f tagFilter) Has(tag discord.TagID) bool {
+	return slices.Contains(f.Tags, tag)
+}
+
+// Tag returns the tag of forum that the filter's URL is for, or nil if the
+// filter didn't come from a /tag/{tagID} URL.
+func (f tagFilter) Tag(forum *discord.Channel) *discord.Tag {
+	if !f.route {
+		return nil
+	}
+	return forumTag(forum, f.Tags[0])
+}
+
+// Query encodes the filter as query parameters, without a leading "?".
+func (f tagFilter) Query() string {
+	if len(f.Tags) == 0 {
+		return ""
+	}
+	values := make(url.Values)
+	for _, tag := range f.Tags {
+		values.Add("tag-filter", tag.String())
+	}
+	if f.All {
+		values.Set("tag-mode", "all")
+	}
+	return values.Encode()
+}